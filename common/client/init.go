@@ -13,6 +13,10 @@ var HTTPClient *http.Client
 var ImpatientHTTPClient *http.Client
 var UserContentRequestHTTPClient *http.Client
 
+// GeminiHTTPClient keeps enough idle connections around for the gemini relay that busy
+// channels don't pay for a new TLS handshake on most requests
+var GeminiHTTPClient *http.Client
+
 func Init() {
 	if config.UserContentRequestProxy != "" {
 		logger.SysLog(fmt.Sprintf("using %s as proxy to fetch user content", config.UserContentRequestProxy))
@@ -31,12 +35,14 @@ func Init() {
 		UserContentRequestHTTPClient = &http.Client{}
 	}
 	var transport http.RoundTripper
+	var relayProxyURL *url.URL
 	if config.RelayProxy != "" {
 		logger.SysLog(fmt.Sprintf("using %s as api relay proxy", config.RelayProxy))
 		proxyURL, err := url.Parse(config.RelayProxy)
 		if err != nil {
 			logger.FatalLog(fmt.Sprintf("USER_CONTENT_REQUEST_PROXY set but invalid: %s", config.UserContentRequestProxy))
 		}
+		relayProxyURL = proxyURL
 		transport = &http.Transport{
 			Proxy: http.ProxyURL(proxyURL),
 		}
@@ -57,4 +63,22 @@ func Init() {
 		Timeout:   5 * time.Second,
 		Transport: transport,
 	}
+
+	GeminiHTTPClient = &http.Client{
+		Timeout:   time.Duration(config.RelayTimeout) * time.Second,
+		Transport: newGeminiTransport(relayProxyURL),
+	}
+}
+
+func newGeminiTransport(proxyURL *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	transport.MaxIdleConnsPerHost = config.GeminiMaxIdleConnsPerHost
+	if transport.MaxIdleConns < config.GeminiMaxIdleConnsPerHost {
+		transport.MaxIdleConns = config.GeminiMaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = time.Duration(config.GeminiIdleConnTimeout) * time.Second
+	return transport
 }
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTLSServer(tb testing.TB) (*httptest.Server, *tls.Config, *atomic.Int32) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"candidates": []}`))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	tb.Cleanup(server.Close)
+	return server, server.Client().Transport.(*http.Transport).TLSClientConfig, &connections
+}
+
+func get(tb testing.TB, httpClient *http.Client, url string) {
+	resp, err := httpClient.Get(url)
+	require.NoError(tb, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+func TestGeminiTransportReusesConnections(t *testing.T) {
+	server, tlsConfig, connections := newTLSServer(t)
+	transport := newGeminiTransport(nil)
+	transport.TLSClientConfig = tlsConfig
+	httpClient := &http.Client{Transport: transport}
+
+	const concurrency = 20
+	round := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				get(t, httpClient, server.URL)
+			}()
+		}
+		wg.Wait()
+	}
+	round()
+	opened := connections.Load()
+	assert.LessOrEqual(t, opened, int32(concurrency))
+	// the pool keeps every connection of the first round, so the second one opens none
+	round()
+	assert.Equal(t, opened, connections.Load())
+}
+
+func BenchmarkGeminiTransport(b *testing.B) {
+	server, tlsConfig, _ := newTLSServer(b)
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			transport := newGeminiTransport(nil)
+			transport.TLSClientConfig = tlsConfig
+			get(b, &http.Client{Transport: transport}, server.URL)
+			transport.CloseIdleConnections()
+		}
+	})
+	b.Run("warm", func(b *testing.B) {
+		transport := newGeminiTransport(nil)
+		transport.TLSClientConfig = tlsConfig
+		httpClient := &http.Client{Transport: transport}
+		for i := 0; i < b.N; i++ {
+			get(b, httpClient, server.URL)
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/songquanpeng/one-api/common/env"
 	"os"
 	"strconv"
@@ -140,13 +142,73 @@ var MetricQueueSize = env.Int("METRIC_QUEUE_SIZE", 10)
 var MetricSuccessRateThreshold = env.Float64("METRIC_SUCCESS_RATE_THRESHOLD", 0.8)
 var MetricSuccessChanSize = env.Int("METRIC_SUCCESS_CHAN_SIZE", 1024)
 var MetricFailChanSize = env.Int("METRIC_FAIL_CHAN_SIZE", 128)
+var EnablePrometheusMetric = env.Bool("ENABLE_PROMETHEUS_METRIC", false) // expose /metrics for prometheus to scrape
 
 var InitialRootToken = os.Getenv("INITIAL_ROOT_TOKEN")
 
 var InitialRootAccessToken = os.Getenv("INITIAL_ROOT_ACCESS_TOKEN")
 
-var GeminiVersion = env.String("GEMINI_VERSION", "v1")
-
+var GeminiVersion = env.String("GEMINI_API_VERSION", env.String("GEMINI_VERSION", "")) // empty means v1beta for models that need it, v1 otherwise
+var GeminiStreamTimeout = env.Int("GEMINI_STREAM_TIMEOUT", 300)                        // unit is second, max wait between two stream chunks
+var GeminiRequestTimeout = env.Int("GEMINI_REQUEST_TIMEOUT", 0)                        // unit is second, limits non-stream calls, 0 means RELAY_TIMEOUT only
+var GeminiStreamKeepaliveInterval = env.Int("GEMINI_STREAM_KEEPALIVE_INTERVAL", 15)    // unit is second, 0 disables the keepalive comments
+var GeminiRetryTimes = env.Int("GEMINI_RETRY_TIMES", 2)
+var GeminiMaxIdleConnsPerHost = env.Int("GEMINI_MAX_IDLE_CONNS_PER_HOST", 100)
+var GeminiIdleConnTimeout = env.Int("GEMINI_IDLE_CONN_TIMEOUT", 90) // unit is second
+var GeminiRetryBaseDelay = env.Int("GEMINI_RETRY_BASE_DELAY", 500)  // unit is millisecond
+var GeminiStreamFallbackEnabled = env.Bool("GEMINI_STREAM_FALLBACK_ENABLED", true)
+var GeminiMaxImageSize = env.Int("GEMINI_MAX_IMAGE_SIZE", 20) // unit is MB
+var GeminiMaxAudioSize = env.Int("GEMINI_MAX_AUDIO_SIZE", 20) // unit is MB
+var GeminiMaxVideoSize = env.Int("GEMINI_MAX_VIDEO_SIZE", 20) // unit is MB
+var GeminiFileUploadEnabled = env.Bool("GEMINI_FILE_UPLOAD_ENABLED", false)
+var GeminiMaxUploadSize = env.Int("GEMINI_MAX_UPLOAD_SIZE", 100)                 // unit is MB
+var GeminiMaxResponseSize = env.Int("GEMINI_MAX_RESPONSE_SIZE", 50)              // unit is MB
+var GeminiEarlyTruncationRatio = env.Float64("GEMINI_EARLY_TRUNCATION_RATIO", 0) // warn when MAX_TOKENS is hit below this share of max_tokens, 0 disables
+var GeminiCitationsEnabled = env.Bool("GEMINI_CITATIONS_ENABLED", false)
+var GeminiSafetyRatingsEnabled = env.Bool("GEMINI_SAFETY_RATINGS_ENABLED", false)
+var GeminiAvgLogprobsEnabled = env.Bool("GEMINI_AVG_LOGPROBS_ENABLED", false)
+var GeminiRecitationFinishReasonEnabled = env.Bool("GEMINI_RECITATION_FINISH_REASON_ENABLED", false)
+var GeminiReasoningContentEnabled = env.Bool("GEMINI_REASONING_CONTENT_ENABLED", true)
+var GeminiContextCacheEnabled = env.Bool("GEMINI_CONTEXT_CACHE_ENABLED", false)
+var GeminiContextCacheMinTokens = env.Int("GEMINI_CONTEXT_CACHE_MIN_TOKENS", 32768) // gemini rejects caches smaller than this
+var GeminiContextCacheTTL = env.Int("GEMINI_CONTEXT_CACHE_TTL", 3600)               // unit is second
+var GeminiStripJSONFences = env.Bool("GEMINI_STRIP_JSON_FENCES", false)
+var GeminiDryRunEnabled = env.Bool("GEMINI_DRY_RUN_ENABLED", false)              // lets clients send X-Dreame-Dry-Run: 1
+var GeminiJSONSchemaValidation = env.String("GEMINI_JSON_SCHEMA_VALIDATION", "") // empty, "error" or "repair"
+var GeminiModelMapping = env.String("GEMINI_MODEL_MAPPING", "")                  // JSON object, e.g. {"gpt-3.5-turbo": "gemini-1.5-flash"}
+var GeminiChannelRateLimit = env.Int("GEMINI_CHANNEL_RATE_LIMIT", 0)             // requests per minute, 0 means no limit
+var GeminiRateLimitMaxWait = env.Int("GEMINI_RATE_LIMIT_MAX_WAIT", 0)            // unit is second
+var GeminiMaxMessages = env.Int("GEMINI_MAX_MESSAGES", 0)                        // 0 means no limit
+var GeminiMaxPromptTokens = env.Int("GEMINI_MAX_PROMPT_TOKENS", 0)               // 0 means no limit
+var GeminiOmitSafetySettingsAllowed = env.Bool("GEMINI_OMIT_SAFETY_SETTINGS_ALLOWED", false)
+var GeminiLogitBiasStrict = env.Bool("GEMINI_LOGIT_BIAS_STRICT", false)            // reject logit_bias with a 400 instead of dropping it
+var GeminiCircuitBreakerThreshold = env.Int("GEMINI_CIRCUIT_BREAKER_THRESHOLD", 0) // consecutive failures that open the breaker of a channel, 0 disables it
+var GeminiCircuitBreakerCooldown = env.Int("GEMINI_CIRCUIT_BREAKER_COOLDOWN", 30)  // unit is second
+
+// GeminiModelMap is GEMINI_MODEL_MAPPING as parsed by ParseGeminiModelMapping at startup
+var GeminiModelMap map[string]string
+
+// ParseGeminiModelMapping fills GeminiModelMap from GeminiModelMapping, the "models/" prefix of
+// the targets is dropped so that lookups need no further work
+func ParseGeminiModelMapping() error {
+	GeminiModelMap = nil
+	if GeminiModelMapping == "" {
+		return nil
+	}
+	var modelMapping map[string]string
+	err := json.Unmarshal([]byte(GeminiModelMapping), &modelMapping)
+	if err != nil {
+		return fmt.Errorf("must be a JSON object of model names: %w", err)
+	}
+	for alias, modelName := range modelMapping {
+		if modelName == "" {
+			return fmt.Errorf("%s is mapped to an empty model name", alias)
+		}
+		modelMapping[alias] = strings.TrimPrefix(modelName, "models/")
+	}
+	GeminiModelMap = modelMapping
+	return nil
+}
 
 var OnlyOneLogFile = env.Bool("ONLY_ONE_LOG_FILE", false)
 
@@ -11,6 +11,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func OpenBrowser(url string) {
@@ -137,3 +139,24 @@ func String2Int(str string) int {
 	}
 	return num
 }
+
+// EndUserMaxLength bounds the client-reported end user kept in the logs
+const EndUserMaxLength = 64
+
+// SanitizeEndUser makes the end user a client reports in OpenAI's user field safe to log,
+// control and format characters are dropped and the rest is cut to EndUserMaxLength runes
+func SanitizeEndUser(user string) string {
+	var builder strings.Builder
+	length := 0
+	for _, r := range user {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		if length == EndUserMaxLength {
+			break
+		}
+		builder.WriteRune(r)
+		length++
+	}
+	return builder.String()
+}
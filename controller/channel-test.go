@@ -81,6 +81,12 @@ func testChannel(channel *model.Channel, request *relaymodel.GeneralOpenAIReques
 		}
 	}
 	meta.OriginModelName, meta.ActualModelName = request.Model, modelName
+	if channel.Type == channeltype.Gemini {
+		// a bad key shows up here with gemini's own message, before any tokens are spent
+		if _, err := listGeminiModels(channel); err != nil {
+			return err, nil
+		}
+	}
 	request.Model = modelName
 	convertedRequest, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, request)
 	if err != nil {
@@ -1,10 +1,13 @@
 package controller
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/helper"
 	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/adaptor/gemini"
+	"github.com/songquanpeng/one-api/relay/channeltype"
 	"net/http"
 	"strconv"
 	"strings"
@@ -84,6 +87,14 @@ func AddChannel(c *gin.Context) {
 		})
 		return
 	}
+	err = validateChannelConfig(&channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	channel.CreatedTime = helper.GetTimestamp()
 	keys := strings.Split(channel.Key, "\n")
 	channels := make([]model.Channel, 0, len(keys))
@@ -155,6 +166,14 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	err = validateChannelConfig(&channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	err = channel.Update()
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
@@ -170,3 +189,19 @@ func UpdateChannel(c *gin.Context) {
 	})
 	return
 }
+
+// validateChannelConfig refuses settings of gemini channels that would otherwise only fail, or
+// quietly fall back, once the channel is in use
+func validateChannelConfig(channel *model.Channel) error {
+	if channel.Type != channeltype.Gemini {
+		return nil
+	}
+	cfg, err := channel.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("invalid channel config: %w", err)
+	}
+	if cfg.SafetySetting != "" {
+		return gemini.ValidateSafetySetting(cfg.SafetySetting)
+	}
+	return nil
+}
@@ -3,15 +3,19 @@ package controller
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/helper"
 	"github.com/songquanpeng/one-api/model"
 	relay "github.com/songquanpeng/one-api/relay"
+	"github.com/songquanpeng/one-api/relay/adaptor/gemini"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/apitype"
 	"github.com/songquanpeng/one-api/relay/channeltype"
 	"github.com/songquanpeng/one-api/relay/meta"
 	relaymodel "github.com/songquanpeng/one-api/relay/model"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -129,6 +133,64 @@ func ListAllModels(c *gin.Context) {
 	})
 }
 
+// ListChannelModels asks the upstream of a channel which models its key can access
+func ListChannelModels(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	channel, err := model.GetChannelById(id, true)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if channel.Type != channeltype.Gemini {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("channel type %d does not support listing upstream models", channel.Type),
+		})
+		return
+	}
+	modelNames, err := listGeminiModels(channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	channelModels := make([]OpenAIModels, 0, len(modelNames))
+	for _, modelName := range modelNames {
+		channelModels = append(channelModels, OpenAIModels{
+			Id:      modelName,
+			Object:  "model",
+			Created: 1626777600,
+			OwnedBy: "google",
+			Root:    modelName,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    channelModels,
+	})
+}
+
+// listGeminiModels lists the models the key of a gemini channel can access, it fails when the key is not usable
+func listGeminiModels(channel *model.Channel) ([]string, error) {
+	baseURL := helper.AssignOrDefault(channel.GetBaseURL(), channeltype.ChannelBaseURLs[channel.Type])
+	cfg, _ := channel.LoadCompatibleConfig()
+	version := helper.AssignOrDefault(cfg.APIVersion, config.GeminiVersion)
+	return gemini.ListModels(baseURL, channel.Key, version)
+}
+
 func ListModels(c *gin.Context) {
 	ctx := c.Request.Context()
 	var availableModels []string
@@ -14,6 +14,7 @@ import (
 	"github.com/songquanpeng/one-api/controller"
 	"github.com/songquanpeng/one-api/middleware"
 	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/adaptor/gemini"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/router"
 	"os"
@@ -89,6 +90,12 @@ func main() {
 		logger.SysLog("metric enabled, will disable channel if too much request failed")
 	}
 	openai.InitTokenEncoders()
+	if err := gemini.ValidateSafetySetting(config.GeminiSafetySetting); err != nil {
+		logger.FatalLog("GEMINI_SAFETY_SETTING: " + err.Error())
+	}
+	if err := config.ParseGeminiModelMapping(); err != nil {
+		logger.FatalLog("GEMINI_MODEL_MAPPING: " + err.Error())
+	}
 	client.Init()
 
 	// Initialize HTTP server
@@ -6,7 +6,6 @@ import (
 	"github.com/songquanpeng/one-api/common/ctxkey"
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/model"
-	"github.com/songquanpeng/one-api/relay/channeltype"
 	"net/http"
 	"strconv"
 )
@@ -65,31 +64,7 @@ func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, mode
 	c.Set(ctxkey.OriginalModel, modelName) // for retry
 	c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
 	c.Set(ctxkey.BaseURL, channel.GetBaseURL())
-	cfg, _ := channel.LoadConfig()
 	// this is for backward compatibility
-	if channel.Other != nil {
-		switch channel.Type {
-		case channeltype.Azure:
-			if cfg.APIVersion == "" {
-				cfg.APIVersion = *channel.Other
-			}
-		case channeltype.Xunfei:
-			if cfg.APIVersion == "" {
-				cfg.APIVersion = *channel.Other
-			}
-		case channeltype.Gemini:
-			if cfg.APIVersion == "" {
-				cfg.APIVersion = *channel.Other
-			}
-		case channeltype.AIProxyLibrary:
-			if cfg.LibraryID == "" {
-				cfg.LibraryID = *channel.Other
-			}
-		case channeltype.Ali:
-			if cfg.Plugin == "" {
-				cfg.Plugin = *channel.Other
-			}
-		}
-	}
+	cfg, _ := channel.LoadCompatibleConfig()
 	c.Set(ctxkey.Config, cfg)
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/helper"
 	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/channeltype"
 	"gorm.io/gorm"
 )
 
@@ -39,13 +40,17 @@ type Channel struct {
 }
 
 type ChannelConfig struct {
-	Region     string `json:"region,omitempty"`
-	SK         string `json:"sk,omitempty"`
-	AK         string `json:"ak,omitempty"`
-	UserID     string `json:"user_id,omitempty"`
-	APIVersion string `json:"api_version,omitempty"`
-	LibraryID  string `json:"library_id,omitempty"`
-	Plugin     string `json:"plugin,omitempty"`
+	Region        string `json:"region,omitempty"`
+	SK            string `json:"sk,omitempty"`
+	AK            string `json:"ak,omitempty"`
+	UserID        string `json:"user_id,omitempty"`
+	APIVersion    string `json:"api_version,omitempty"`
+	LibraryID     string `json:"library_id,omitempty"`
+	Plugin        string `json:"plugin,omitempty"`
+	SafetySetting string `json:"safety_setting,omitempty"`
+	RateLimit     int    `json:"rate_limit,omitempty"` // requests per minute, only gemini for now
+	// only honoured with GEMINI_OMIT_SAFETY_SETTINGS_ALLOWED, gemini then applies its own defaults
+	OmitSafetySettings bool `json:"omit_safety_settings,omitempty"`
 }
 
 func GetAllChannels(startIdx int, num int, scope string) ([]*Channel, error) {
@@ -183,6 +188,29 @@ func (channel *Channel) LoadConfig() (ChannelConfig, error) {
 	return cfg, nil
 }
 
+// LoadCompatibleConfig is LoadConfig with the values older channels kept in Other filled in
+func (channel *Channel) LoadCompatibleConfig() (ChannelConfig, error) {
+	cfg, err := channel.LoadConfig()
+	if channel.Other == nil {
+		return cfg, err
+	}
+	switch channel.Type {
+	case channeltype.Azure, channeltype.Xunfei, channeltype.Gemini:
+		if cfg.APIVersion == "" {
+			cfg.APIVersion = *channel.Other
+		}
+	case channeltype.AIProxyLibrary:
+		if cfg.LibraryID == "" {
+			cfg.LibraryID = *channel.Other
+		}
+	case channeltype.Ali:
+		if cfg.Plugin == "" {
+			cfg.Plugin = *channel.Other
+		}
+	}
+	return cfg, err
+}
+
 func UpdateChannelStatusById(id int, status int) {
 	err := UpdateAbilityStatus(id, status == ChannelStatusEnabled)
 	if err != nil {
@@ -35,8 +35,9 @@ func ConvertRequest(request model.GeneralOpenAIRequest) *ChatRequest {
 		enableSearch = true
 		aliModel = strings.TrimSuffix(aliModel, EnableSearchModelSuffix)
 	}
-	if request.TopP >= 1 {
-		request.TopP = 0.9999
+	topP := request.GetTopP()
+	if topP >= 1 {
+		topP = 0.9999
 	}
 	return &ChatRequest{
 		Model: aliModel,
@@ -48,9 +49,9 @@ func ConvertRequest(request model.GeneralOpenAIRequest) *ChatRequest {
 			IncrementalOutput: request.Stream,
 			Seed:              uint64(request.Seed),
 			MaxTokens:         request.MaxTokens,
-			Temperature:       request.Temperature,
-			TopP:              request.TopP,
-			TopK:              request.TopK,
+			Temperature:       request.GetTemperature(),
+			TopP:              topP,
+			TopK:              request.GetTopK(),
 			ResultFormat:      "message",
 			Tools:             request.Tools,
 		},
@@ -56,9 +56,9 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *Request {
 	claudeRequest := Request{
 		Model:       textRequest.Model,
 		MaxTokens:   textRequest.MaxTokens,
-		Temperature: textRequest.Temperature,
-		TopP:        textRequest.TopP,
-		TopK:        textRequest.TopK,
+		Temperature: textRequest.GetTemperature(),
+		TopP:        textRequest.GetTopP(),
+		TopK:        textRequest.GetTopK(),
 		Stream:      textRequest.Stream,
 		Tools:       claudeTools,
 	}
@@ -58,8 +58,8 @@ func RenderPrompt(messages []relaymodel.Message) string {
 func ConvertRequest(textRequest relaymodel.GeneralOpenAIRequest) *Request {
 	llamaRequest := Request{
 		MaxGenLen:   textRequest.MaxTokens,
-		Temperature: textRequest.Temperature,
-		TopP:        textRequest.TopP,
+		Temperature: textRequest.GetTemperature(),
+		TopP:        textRequest.GetTopP(),
 	}
 	if llamaRequest.MaxGenLen == 0 {
 		llamaRequest.MaxGenLen = 2048
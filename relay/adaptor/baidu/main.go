@@ -56,8 +56,8 @@ var baiduTokenStore sync.Map
 func ConvertRequest(request model.GeneralOpenAIRequest) *ChatRequest {
 	baiduRequest := ChatRequest{
 		Messages:        make([]Message, 0, len(request.Messages)),
-		Temperature:     request.Temperature,
-		TopP:            request.TopP,
+		Temperature:     request.GetTemperature(),
+		TopP:            request.GetTopP(),
 		PenaltyScore:    request.FrequencyPenalty,
 		Stream:          request.Stream,
 		DisableSearch:   false,
@@ -24,7 +24,7 @@ func ConvertCompletionsRequest(textRequest model.GeneralOpenAIRequest) *Request
 		Prompt:      p,
 		MaxTokens:   textRequest.MaxTokens,
 		Stream:      textRequest.Stream,
-		Temperature: textRequest.Temperature,
+		Temperature: textRequest.GetTemperature(),
 	}
 }
 
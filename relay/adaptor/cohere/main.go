@@ -38,9 +38,9 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *Request {
 		Model:            textRequest.Model,
 		Message:          "",
 		MaxTokens:        textRequest.MaxTokens,
-		Temperature:      textRequest.Temperature,
-		P:                textRequest.TopP,
-		K:                textRequest.TopK,
+		Temperature:      textRequest.GetTemperature(),
+		P:                textRequest.GetTopP(),
+		K:                textRequest.GetTopK(),
 		Stream:           textRequest.Stream,
 		FrequencyPenalty: textRequest.FrequencyPenalty,
 		PresencePenalty:  textRequest.FrequencyPenalty,
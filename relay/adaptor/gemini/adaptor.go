@@ -1,14 +1,22 @@
 package gemini
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/client"
 	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
 	"github.com/songquanpeng/one-api/common/helper"
+	"github.com/songquanpeng/one-api/common/logger"
 	channelhelper "github.com/songquanpeng/one-api/relay/adaptor"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/meta"
@@ -17,14 +25,42 @@ import (
 )
 
 type Adaptor struct {
+	meta           *meta.Meta
+	includeUsage   bool
+	jsonMode       bool
+	responseSchema map[string]any
+	requestStart   time.Time
+	dryRun         bool
+	fakeStream     bool
+	rawResponse    bool
+	requestCtx     context.Context
+	cancelRequest  context.CancelFunc
 }
 
-func (a *Adaptor) Init(meta *meta.Meta) {
+// DryRunHeader asks for the request the relay would send to gemini instead of an answer
+const DryRunHeader = "X-Dreame-Dry-Run"
+
+// isDryRun is only honoured when GEMINI_DRY_RUN_ENABLED is on, it is a debugging aid for
+// the OpenAI to gemini conversion and must not be left open to every client
+func isDryRun(c *gin.Context) bool {
+	return config.GeminiDryRunEnabled && c.GetHeader(DryRunHeader) == "1"
+}
 
+// RawResponseHeader asks for gemini's own generateContent response instead of the OpenAI shape,
+// streams are always converted
+const RawResponseHeader = "X-Dreame-Raw-Response"
+
+func (a *Adaptor) Init(meta *meta.Meta) {
+	a.meta = meta
+	meta.ActualModelName = resolveModelName(meta.ActualModelName)
 }
 
 func (a *Adaptor) GetRequestURL(meta *meta.Meta) (string, error) {
-	version := helper.AssignOrDefault(meta.Config.APIVersion, config.GeminiVersion)
+	return getRequestURL(meta), nil
+}
+
+func getRequestURL(meta *meta.Meta) string {
+	version := getAPIVersion(meta, meta.ActualModelName)
 	action := ""
 	switch meta.Mode {
 	case relaymode.Embeddings:
@@ -36,7 +72,32 @@ func (a *Adaptor) GetRequestURL(meta *meta.Meta) (string, error) {
 	if meta.IsStream {
 		action = "streamGenerateContent?alt=sse"
 	}
-	return fmt.Sprintf("%s/%s/models/%s:%s", meta.BaseURL, version, meta.ActualModelName, action), nil
+	return fmt.Sprintf("%s/%s/models/%s:%s", meta.BaseURL, version, meta.ActualModelName, action)
+}
+
+// getAPIVersion prefers the channel setting, then GEMINI_API_VERSION, and otherwise
+// picks v1beta for models whose features are only available there
+func getAPIVersion(meta *meta.Meta, modelName string) string {
+	if meta != nil && meta.Config.APIVersion != "" {
+		return meta.Config.APIVersion
+	}
+	if config.GeminiVersion != "" {
+		return config.GeminiVersion
+	}
+	if isBetaAPIRequired(modelName) {
+		return "v1beta"
+	}
+	return "v1"
+}
+
+// resolveModelName applies GEMINI_MODEL_MAPPING, so that operators can serve client-facing
+// aliases (e.g. gpt-3.5-turbo) with a real gemini model, unknown names pass through untouched
+func resolveModelName(modelName string) string {
+	modelName = strings.TrimPrefix(modelName, "models/")
+	if mapped, ok := config.GeminiModelMap[modelName]; ok {
+		return mapped
+	}
+	return modelName
 }
 
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *meta.Meta) error {
@@ -51,10 +112,54 @@ func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.G
 	}
 	switch relayMode {
 	case relaymode.Embeddings:
-		geminiEmbeddingRequest := ConvertEmbeddingRequest(*request)
+		geminiEmbeddingRequest, err := ConvertEmbeddingRequest(*request)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(ctxkey.ConvertedRequest, geminiEmbeddingRequest)
 		return geminiEmbeddingRequest, nil
 	default:
-		geminiRequest := ConvertRequest(*request)
+		a.includeUsage = request.StreamOptions != nil && request.StreamOptions.IncludeUsage
+		a.rawResponse = c.GetHeader(RawResponseHeader) == "1"
+		a.jsonMode = request.ResponseFormat != nil &&
+			(request.ResponseFormat.Type == "json_object" || request.ResponseFormat.Type == "json_schema")
+		a.responseSchema = nil
+		if request.ResponseFormat != nil && request.ResponseFormat.Type == "json_schema" && request.ResponseFormat.JsonSchema != nil {
+			a.responseSchema = request.ResponseFormat.JsonSchema.Schema
+		}
+		// Init resolved the model name already
+		if a.meta != nil && a.meta.ActualModelName != "" {
+			request.Model = a.meta.ActualModelName
+		}
+		// gemini has nothing like OpenAI's user, keep it around for the logs
+		if user := helper.SanitizeEndUser(request.User); user != "" {
+			c.Set(ctxkey.EndUser, user)
+		}
+		geminiRequest, err := ConvertRequest(c.Request.Context(), *request)
+		if err != nil {
+			return nil, err
+		}
+		if a.meta != nil && a.meta.Config.SafetySetting != "" {
+			geminiRequest.SafetySettings = getSafetySettings(a.meta.Config.SafetySetting)
+		}
+		if a.meta != nil && a.meta.Config.OmitSafetySettings {
+			if config.GeminiOmitSafetySettingsAllowed {
+				geminiRequest.SafetySettings = nil
+			} else {
+				logger.Warnf(c.Request.Context(), "channel %d asks to omit the safety settings, ignored without GEMINI_OMIT_SAFETY_SETTINGS_ALLOWED", a.meta.ChannelId)
+			}
+		}
+		if getAPIVersion(a.meta, request.Model) == "v1" {
+			stripBetaFeatures(geminiRequest)
+		}
+		// a dry run shows the media inline rather than leaving files behind in the files API
+		if !isDryRun(c) {
+			if err = uploadLargeMedia(c.Request.Context(), a.meta, geminiRequest); err != nil {
+				return nil, err
+			}
+		}
+		applyContextCache(a.meta, geminiRequest, request.Model)
+		c.Set(ctxkey.ConvertedRequest, geminiRequest)
 		return geminiRequest, nil
 	}
 }
@@ -67,25 +172,176 @@ func (a *Adaptor) ConvertImageRequest(request *model.ImageRequest) (any, error)
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, meta *meta.Meta, requestBody io.Reader) (*http.Response, error) {
-	return channelhelper.DoRequestHelper(a, c, meta, requestBody)
+	// buffer the body so it can be replayed when gemini asks us to retry
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	a.fakeStream = false
+	if isDryRun(c) {
+		a.dryRun = true
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(requestBytes)),
+		}, nil
+	}
+	// an open breaker fails fast without spending the rate limit of the channel
+	if circuitBreakerEnabled() {
+		if err = allowRequest(meta.ChannelId); err != nil {
+			return nil, err
+		}
+	}
+	if rate := getRateLimit(meta); rate > 0 {
+		err = rateLimiter.wait(c.Request.Context(), meta.ChannelId, rate, time.Duration(config.GeminiRateLimitMaxWait)*time.Second)
+		if err != nil {
+			// the request never went out, a probe the breaker let through is left to the next one
+			if circuitBreakerEnabled() {
+				circuitBreakers.breaker(meta.ChannelId).release()
+			}
+			return nil, err
+		}
+	}
+	a.requestStart = time.Now()
+	ctx := a.withRequestTimeout(c.Request.Context(), meta)
+	resp, err := doRequestWithRetry(ctx, func() (*http.Response, error) {
+		return a.doRequest(ctx, c, meta, bytes.NewReader(requestBytes))
+	})
+	if circuitBreakerEnabled() {
+		recordResponse(c.Request.Context(), meta.ChannelId, resp, err)
+	}
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("gemini did not answer within %ds: %w", config.GeminiRequestTimeout, err)
+	}
+	// done here rather than in DoResponse, the relay treats the refusal as an error before that
+	if err == nil && meta.IsStream && config.GeminiStreamFallbackEnabled && isStreamUnsupported(resp) {
+		logger.Warnf(c.Request.Context(), "model %s does not support streaming, falling back to generateContent", meta.ActualModelName)
+		_ = resp.Body.Close()
+		nonStreamMeta := *meta
+		nonStreamMeta.IsStream = false
+		resp, err = a.DoRequest(c, &nonStreamMeta, bytes.NewReader(requestBytes))
+		a.fakeStream = err == nil
+	}
+	return resp, err
+}
+
+// withRequestTimeout bounds a non-stream call by GEMINI_REQUEST_TIMEOUT, reading the response
+// included, streams are watched chunk by chunk with GEMINI_STREAM_TIMEOUT instead
+func (a *Adaptor) withRequestTimeout(ctx context.Context, meta *meta.Meta) context.Context {
+	// a repair request replaces the call whose response has been read already
+	a.releaseRequest()
+	if meta.IsStream || config.GeminiRequestTimeout <= 0 {
+		return ctx
+	}
+	a.requestCtx, a.cancelRequest = context.WithTimeout(ctx, time.Duration(config.GeminiRequestTimeout)*time.Second)
+	return a.requestCtx
+}
+
+func (a *Adaptor) releaseRequest() {
+	if a.cancelRequest != nil {
+		a.cancelRequest()
+	}
+	a.requestCtx, a.cancelRequest = nil, nil
+}
+
+// doRequestError is how the relay controller reports a failed DoRequest, for the calls the adaptor makes itself
+func doRequestError(err error) *model.ErrorWithStatusCode {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return openai.ErrorWrapper(err, "upstream_timeout", http.StatusGatewayTimeout)
+	}
+	return openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+}
+
+// isRequestTimeout reports whether GEMINI_REQUEST_TIMEOUT cut the current call short
+func (a *Adaptor) isRequestTimeout() bool {
+	return a.requestCtx != nil && errors.Is(a.requestCtx.Err(), context.DeadlineExceeded)
+}
+
+// doRequest sends the request on client.GeminiHTTPClient, whose pool is sized for gemini traffic
+func (a *Adaptor) doRequest(ctx context.Context, c *gin.Context, meta *meta.Meta, requestBody io.Reader) (*http.Response, error) {
+	resp, err := doGeminiRequest(ctx, client.GeminiHTTPClient, meta, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	_ = c.Request.Body.Close()
+	return resp, nil
+}
+
+// doGeminiRequest posts an already converted request to gemini, the endpoint, API version and
+// key all come from meta. It needs no gin context, so tests can hand in a client with a fake
+// transport and look at what would have been sent.
+func doGeminiRequest(ctx context.Context, httpClient *http.Client, meta *meta.Meta, requestBody io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, getRequestURL(meta), requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("new request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if meta.IsStream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	req.Header.Set("x-goog-api-key", meta.APIKey)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request failed: %w", err)
+	}
+	return resp, nil
 }
 
 func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *meta.Meta) (usage *model.Usage, err *model.ErrorWithStatusCode) {
+	if a.dryRun {
+		return dryRunHandler(c, resp)
+	}
+	defer a.releaseRequest()
+	if a.requestStart.IsZero() {
+		a.requestStart = time.Now()
+	}
+	defer func() {
+		recordMetrics(meta.ActualModelName, meta.IsStream, a.requestStart, usage, err)
+	}()
 	if meta.IsStream {
 		var responseText string
-		err, responseText = StreamHandler(c, resp)
-		usage = openai.ResponseText2Usage(responseText, meta.ActualModelName, meta.PromptTokens)
+		resp.Body = &firstByteReader{ReadCloser: resp.Body, modelName: meta.ActualModelName, start: a.requestStart}
+		if a.fakeStream {
+			err, responseText, usage = FakeStreamHandler(c, resp, meta.ActualModelName, a.includeUsage)
+		} else {
+			err, responseText, usage = StreamHandler(c, resp, meta.ActualModelName, a.includeUsage)
+		}
+		if err == nil && usage == nil {
+			usage = openai.ResponseText2Usage(responseText, TokenizerModel, meta.PromptTokens)
+		}
 	} else {
 		switch meta.Mode {
 		case relaymode.Embeddings:
-			err, usage = EmbeddingHandler(c, resp)
+			err, usage = EmbeddingHandler(c, resp, meta.PromptTokens, meta.ActualModelName)
 		default:
-			err, usage = Handler(c, resp, meta.PromptTokens, meta.ActualModelName)
+			if a.rawResponse {
+				err, usage = RawHandler(c, resp, meta.PromptTokens, meta.ActualModelName)
+			} else if a.jsonMode && (config.GeminiStripJSONFences || (a.responseSchema != nil && config.GeminiJSONSchemaValidation != "")) {
+				err, usage = a.handleJSONResponse(c, resp, meta)
+			} else {
+				err, usage = Handler(c, resp, meta.PromptTokens, meta.ActualModelName)
+			}
+		}
+		if err != nil && a.isRequestTimeout() {
+			logger.Warnf(c.Request.Context(), "gemini did not answer within %ds, aborted", config.GeminiRequestTimeout)
+			err = openai.ErrorWrapper(fmt.Errorf("gemini did not answer within %ds", config.GeminiRequestTimeout), "upstream_timeout", http.StatusGatewayTimeout)
 		}
 	}
 	return
 }
 
+// dryRunHandler hands the converted request back to the client as is, also for stream requests,
+// nothing reached gemini so there is nothing to bill
+func dryRunHandler(c *gin.Context, resp *http.Response) (*model.Usage, *model.ErrorWithStatusCode) {
+	requestBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, openai.ErrorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+	}
+	_ = resp.Body.Close()
+	c.Data(http.StatusOK, "application/json", requestBody)
+	return &model.Usage{}, nil
+}
+
 func (a *Adaptor) GetModelList() []string {
 	return ModelList
 }
@@ -93,3 +349,70 @@ func (a *Adaptor) GetModelList() []string {
 func (a *Adaptor) GetChannelName() string {
 	return "google gemini"
 }
+
+// handleJSONResponse handles the non-stream response to a request for JSON output. With
+// GEMINI_STRIP_JSON_FENCES markdown code fences around the JSON are removed, and with
+// GEMINI_JSON_SCHEMA_VALIDATION the completion is checked against the json_schema of the request.
+// In repair mode a mismatch is sent back to gemini once along with what is wrong with it,
+// otherwise and when the repair fails too the client gets an error, billed for the calls made.
+func (a *Adaptor) handleJSONResponse(c *gin.Context, resp *http.Response, meta *meta.Meta) (*model.ErrorWithStatusCode, *model.Usage) {
+	geminiResponse, errWithStatusCode := parseResponse(c, resp, meta.ActualModelName)
+	if errWithStatusCode != nil {
+		return errWithStatusCode, blockedPromptUsage(geminiResponse, meta.PromptTokens)
+	}
+	if config.GeminiStripJSONFences {
+		stripJSONFences(geminiResponse)
+	}
+	usage := responseUsage(geminiResponse, meta.PromptTokens)
+	if a.responseSchema == nil || config.GeminiJSONSchemaValidation == "" {
+		return renderResponse(c, geminiResponse, meta.ActualModelName, usage), &usage
+	}
+	validationErr := validateResponseJSON(geminiResponse.GetResponseText(), a.responseSchema)
+	if validationErr != nil && config.GeminiJSONSchemaValidation == "repair" {
+		logger.Warnf(c.Request.Context(), "response of %s does not match the json_schema, asking for a repair: %s", meta.ActualModelName, validationErr.Error())
+		repairedResponse, errWithStatusCode := a.doRepairRequest(c, meta, geminiResponse, validationErr)
+		if errWithStatusCode != nil {
+			// the first call went through all the same
+			errWithStatusCode.Billed = true
+			return errWithStatusCode, &usage
+		}
+		// both calls are paid for
+		repairUsage := responseUsage(repairedResponse, meta.PromptTokens)
+		usage.PromptTokens += repairUsage.PromptTokens
+		usage.CompletionTokens += repairUsage.CompletionTokens
+		usage.TotalTokens += repairUsage.TotalTokens
+		if config.GeminiStripJSONFences {
+			stripJSONFences(repairedResponse)
+		}
+		geminiResponse = repairedResponse
+		validationErr = validateResponseJSON(geminiResponse.GetResponseText(), a.responseSchema)
+	}
+	if validationErr != nil {
+		// gemini answered, what it answered is paid for whether it matches or not
+		errWithStatusCode := openai.ErrorWrapper(fmt.Errorf("response does not match the json_schema: %w", validationErr), "invalid_response_json", http.StatusBadGateway)
+		errWithStatusCode.Billed = true
+		return errWithStatusCode, &usage
+	}
+	return renderResponse(c, geminiResponse, meta.ActualModelName, usage), &usage
+}
+
+func (a *Adaptor) doRepairRequest(c *gin.Context, meta *meta.Meta, geminiResponse *ChatResponse, validationErr error) (*ChatResponse, *model.ErrorWithStatusCode) {
+	convertedRequest, ok := c.Get(ctxkey.ConvertedRequest)
+	if !ok {
+		return nil, openai.ErrorWrapper(errors.New("converted request not found"), "get_converted_request_failed", http.StatusInternalServerError)
+	}
+	repairRequest := *convertedRequest.(*ChatRequest)
+	repairRequest.Contents = append(append([]ChatContent{}, repairRequest.Contents...),
+		ChatContent{Role: "model", Parts: []Part{{Text: geminiResponse.GetResponseText()}}},
+		ChatContent{Role: "user", Parts: []Part{{Text: fmt.Sprintf("Your answer does not match the required JSON schema (%s). Reply again with only the corrected JSON.", validationErr.Error())}}},
+	)
+	requestBody, err := json.Marshal(repairRequest)
+	if err != nil {
+		return nil, openai.ErrorWrapper(err, "marshal_repair_request_failed", http.StatusInternalServerError)
+	}
+	resp, err := a.DoRequest(c, meta, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, doRequestError(err)
+	}
+	return parseResponse(c, resp, meta.ActualModelName)
+}
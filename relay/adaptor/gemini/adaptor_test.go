@@ -0,0 +1,646 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/helper"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoResponseFallsBackToNonStream(t *testing.T) {
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, ":streamGenerateContent") {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "models/gemini-exp is not found for API version v1, or is not supported for streamGenerateContent.", "status": "NOT_FOUND"}}`))
+			return
+		}
+		assert.True(t, strings.HasSuffix(r.URL.Path, ":generateContent"))
+		_, _ = w.Write([]byte(`{
+			"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}]}, "finishReason": "STOP"}],
+			"usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 1, "totalTokenCount": 4}
+		}`))
+	}))
+	defer server.Close()
+
+	c, w := newTestContext()
+	streamMeta := &meta.Meta{
+		Mode:            relaymode.ChatCompletions,
+		BaseURL:         server.URL,
+		ActualModelName: "gemini-exp",
+		IsStream:        true,
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(streamMeta)
+	convertedRequest, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+		Model:    "gemini-exp",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, convertedRequest)
+
+	requestBody, err := GetConvertedRequestBody(c)
+	require.NoError(t, err)
+	resp, err := adaptor.DoRequest(c, streamMeta, bytes.NewReader(requestBody))
+	require.NoError(t, err)
+	usage, errWithStatusCode := adaptor.DoResponse(c, resp, streamMeta)
+	require.Nil(t, errWithStatusCode)
+	require.NotNil(t, usage)
+	assert.Equal(t, 4, usage.TotalTokens)
+	assert.Contains(t, w.Body.String(), `"content":"Hello"`)
+	assert.Contains(t, w.Body.String(), "data: [DONE]")
+
+	defer func(enabled bool) { config.GeminiStreamFallbackEnabled = enabled }(config.GeminiStreamFallbackEnabled)
+	config.GeminiStreamFallbackEnabled = false
+	c, _ = newTestContext()
+	c.Set(ctxkey.ConvertedRequest, convertedRequest)
+	resp, err = adaptor.DoRequest(c, streamMeta, bytes.NewReader(requestBody))
+	require.NoError(t, err)
+	_, errWithStatusCode = adaptor.DoResponse(c, resp, streamMeta)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusNotFound, errWithStatusCode.StatusCode)
+}
+
+func TestGetConvertedRequestBody(t *testing.T) {
+	c, _ := newTestContext()
+	_, err := GetConvertedRequestBody(c)
+	assert.Error(t, err)
+
+	adaptor := &Adaptor{}
+	adaptor.Init(&meta.Meta{})
+	convertedRequest, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+		Model:    "gemini-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+	})
+	require.NoError(t, err)
+	expected, err := json.Marshal(convertedRequest)
+	require.NoError(t, err)
+
+	// can be read as many times as needed
+	for i := 0; i < 2; i++ {
+		requestBody, err := GetConvertedRequestBody(c)
+		require.NoError(t, err)
+		assert.Equal(t, expected, requestBody)
+	}
+}
+
+func TestGetRequestURLUsesConfiguredVersion(t *testing.T) {
+	defer func(version string) { config.GeminiVersion = version }(config.GeminiVersion)
+	config.GeminiVersion = ""
+
+	adaptor := &Adaptor{}
+	requestMeta := &meta.Meta{
+		Mode:            relaymode.ChatCompletions,
+		BaseURL:         "https://generativelanguage.googleapis.com",
+		ActualModelName: "gemini-pro",
+	}
+	url, err := adaptor.GetRequestURL(requestMeta)
+	require.NoError(t, err)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1/models/gemini-pro:generateContent", url)
+
+	requestMeta.ActualModelName = "gemini-1.5-pro"
+	url, err = adaptor.GetRequestURL(requestMeta)
+	require.NoError(t, err)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/gemini-1.5-pro:generateContent", url)
+
+	config.GeminiVersion = "v1"
+	url, err = adaptor.GetRequestURL(requestMeta)
+	require.NoError(t, err)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1/models/gemini-1.5-pro:generateContent", url)
+
+	requestMeta.Config.APIVersion = "v1alpha"
+	requestMeta.IsStream = true
+	url, err = adaptor.GetRequestURL(requestMeta)
+	require.NoError(t, err)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1alpha/models/gemini-1.5-pro:streamGenerateContent?alt=sse", url)
+}
+
+func TestConvertRequestStripsBetaFeaturesOnV1(t *testing.T) {
+	request := &model.GeneralOpenAIRequest{
+		Model: "gemini-1.5-pro",
+		Messages: []model.Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Hi"},
+		},
+		ResponseFormat: &model.ResponseFormat{Type: "json_object"},
+		Tools:          []model.Tool{{Type: "function", Function: model.Function{Name: "noop"}}},
+	}
+	c, _ := newTestContext()
+
+	adaptor := &Adaptor{}
+	adaptor.Init(&meta.Meta{})
+	convertedRequest, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, request)
+	require.NoError(t, err)
+	geminiRequest := convertedRequest.(*ChatRequest)
+	assert.NotNil(t, geminiRequest.SystemInstruction)
+	assert.NotNil(t, geminiRequest.Tools)
+	assert.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+
+	adaptor.Init(&meta.Meta{Config: dbmodel.ChannelConfig{APIVersion: "v1"}})
+	convertedRequest, err = adaptor.ConvertRequest(c, relaymode.ChatCompletions, request)
+	require.NoError(t, err)
+	geminiRequest = convertedRequest.(*ChatRequest)
+	assert.Nil(t, geminiRequest.SystemInstruction)
+	assert.Nil(t, geminiRequest.Tools)
+	assert.Nil(t, geminiRequest.ToolConfig)
+	assert.Empty(t, geminiRequest.GenerationConfig.ResponseMimeType)
+	require.Len(t, geminiRequest.Contents, 3)
+	assert.Equal(t, "Be brief.", geminiRequest.Contents[0].Parts[0].Text)
+	assert.Equal(t, "model", geminiRequest.Contents[1].Role)
+}
+
+func TestConvertRequestOmitSafetySettings(t *testing.T) {
+	defer func(allowed bool) { config.GeminiOmitSafetySettingsAllowed = allowed }(config.GeminiOmitSafetySettingsAllowed)
+	config.GeminiOmitSafetySettingsAllowed = true
+	request := &model.GeneralOpenAIRequest{
+		Model:    "gemini-1.5-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+	}
+	convert := func(channelConfig dbmodel.ChannelConfig) *ChatRequest {
+		c, _ := newTestContext()
+		adaptor := &Adaptor{}
+		adaptor.Init(&meta.Meta{ChannelId: 96, Config: channelConfig})
+		convertedRequest, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, request)
+		require.NoError(t, err)
+		return convertedRequest.(*ChatRequest)
+	}
+
+	assert.Len(t, convert(dbmodel.ChannelConfig{}).SafetySettings, len(SafetyCategories))
+	geminiRequest := convert(dbmodel.ChannelConfig{OmitSafetySettings: true, SafetySetting: "BLOCK_ONLY_HIGH"})
+	assert.Nil(t, geminiRequest.SafetySettings)
+	body, err := json.Marshal(geminiRequest)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "safety_settings")
+
+	// the channel alone can not opt out
+	config.GeminiOmitSafetySettingsAllowed = false
+	assert.Len(t, convert(dbmodel.ChannelConfig{OmitSafetySettings: true}).SafetySettings, len(SafetyCategories))
+}
+
+func TestResolveModelName(t *testing.T) {
+	defer func(modelMapping string) {
+		config.GeminiModelMapping = modelMapping
+		_ = config.ParseGeminiModelMapping()
+	}(config.GeminiModelMapping)
+	config.GeminiModelMapping = ""
+	require.NoError(t, config.ParseGeminiModelMapping())
+	assert.Equal(t, "gemini-pro", resolveModelName("gemini-pro"))
+	assert.Equal(t, "gemini-pro", resolveModelName("models/gemini-pro"))
+
+	config.GeminiModelMapping = `{"gpt-3.5-turbo": "gemini-1.5-flash", "gpt-4o": "models/gemini-1.5-pro"}`
+	require.NoError(t, config.ParseGeminiModelMapping())
+	assert.Equal(t, "gemini-1.5-flash", resolveModelName("gpt-3.5-turbo"))
+	assert.Equal(t, "gemini-1.5-pro", resolveModelName("gpt-4o"))
+	assert.Equal(t, "gemini-pro", resolveModelName("gemini-pro"))
+
+	// Init resolves the name once, the converted request follows it
+	c, _ := newTestContext()
+	adaptor := &Adaptor{}
+	relayMeta := &meta.Meta{
+		Mode:            relaymode.ChatCompletions,
+		BaseURL:         "https://generativelanguage.googleapis.com",
+		ActualModelName: "gpt-3.5-turbo",
+	}
+	adaptor.Init(relayMeta)
+	url, err := adaptor.GetRequestURL(relayMeta)
+	require.NoError(t, err)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/gemini-1.5-flash:generateContent", url)
+	request := &model.GeneralOpenAIRequest{Model: "gpt-3.5-turbo", Messages: []model.Message{{Role: "user", Content: "Hi"}}}
+	_, err = adaptor.ConvertRequest(c, relaymode.ChatCompletions, request)
+	require.NoError(t, err)
+	assert.Equal(t, "gemini-1.5-flash", request.Model)
+
+	// a broken mapping is refused at startup rather than ignored on every request
+	for _, modelMapping := range []string{`not json`, `["gemini-pro"]`, `{"gpt-4o": ""}`} {
+		config.GeminiModelMapping = modelMapping
+		assert.Error(t, config.ParseGeminiModelMapping(), modelMapping)
+		assert.Nil(t, config.GeminiModelMap)
+	}
+}
+
+func TestEndUserIsLogged(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(writer io.Writer) { gin.DefaultErrorWriter = writer }(gin.DefaultErrorWriter)
+	gin.DefaultErrorWriter = &logs
+
+	c, _ := newTestContext()
+	adaptor := &Adaptor{}
+	adaptor.Init(&meta.Meta{})
+	_, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+		Model:    "gemini-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+		User:     "user-1234",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "user-1234", c.GetString(ctxkey.EndUser))
+
+	ErrorHandler(c, newTestResponse(http.StatusInternalServerError, `{"error": {"code": 500, "message": "Internal error", "status": "INTERNAL"}}`), "gemini-pro")
+	assert.Contains(t, logs.String(), "[gemini gemini-pro, user user-1234]")
+
+	// the client can't break the log line or bloat it
+	c, _ = newTestContext()
+	_, err = adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+		Model:    "gemini-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+		User:     "user-1234\n[SYS] forged line\u202e" + strings.Repeat("x", 100),
+	})
+	require.NoError(t, err)
+	user := c.GetString(ctxkey.EndUser)
+	assert.Len(t, []rune(user), helper.EndUserMaxLength)
+	assert.True(t, strings.HasPrefix(user, "user-1234[SYS] forged linexxx"))
+}
+
+func TestDoResponseValidatesJSONSchema(t *testing.T) {
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+	defer func(mode string) { config.GeminiJSONSchemaValidation = mode }(config.GeminiJSONSchemaValidation)
+
+	const invalid = `{"candidates": [{"content": {"role": "model", "parts": [{"text": "{\"name\": 42}"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15}}`
+	const valid = `{"candidates": [{"content": {"role": "model", "parts": [{"text": "{\"name\": \"Ada\"}"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 20, "candidatesTokenCount": 5, "totalTokenCount": 25}}`
+	var repairRequests []ChatRequest
+	repairResponse := valid
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ChatRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		repairRequests = append(repairRequests, request)
+		_, _ = w.Write([]byte(repairResponse))
+	}))
+	defer server.Close()
+
+	run := func(mode string, body string) (*httptest.ResponseRecorder, *model.Usage, *model.ErrorWithStatusCode) {
+		config.GeminiJSONSchemaValidation = mode
+		c, w := newTestContext()
+		relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, BaseURL: server.URL, ActualModelName: "gemini-1.5-pro"}
+		adaptor := &Adaptor{}
+		adaptor.Init(relayMeta)
+		_, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+			Model:    "gemini-1.5-pro",
+			Messages: []model.Message{{Role: "user", Content: "Who wrote the first program?"}},
+			ResponseFormat: &model.ResponseFormat{Type: "json_schema", JsonSchema: &model.JSONSchema{
+				Name: "person",
+				Schema: map[string]any{
+					"type":       "object",
+					"required":   []any{"name"},
+					"properties": map[string]any{"name": map[string]any{"type": "string"}},
+				},
+			}},
+		})
+		require.NoError(t, err)
+		usage, errWithStatusCode := adaptor.DoResponse(c, newTestResponse(http.StatusOK, body), relayMeta)
+		return w, usage, errWithStatusCode
+	}
+
+	// pass
+	w, usage, errWithStatusCode := run("error", valid)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, 25, usage.TotalTokens)
+	assert.Contains(t, w.Body.String(), `Ada`)
+
+	// fail without retry, the call is billed all the same
+	w, usage, errWithStatusCode = run("error", invalid)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusBadGateway, errWithStatusCode.StatusCode)
+	assert.Equal(t, "invalid_response_json", errWithStatusCode.Code)
+	assert.True(t, errWithStatusCode.Billed)
+	require.NotNil(t, usage)
+	assert.Equal(t, 15, usage.TotalTokens)
+	assert.Contains(t, errWithStatusCode.Message, "$.name: expected string")
+	assert.Empty(t, w.Body.String())
+	assert.Empty(t, repairRequests)
+
+	// fail with repair
+	w, usage, errWithStatusCode = run("repair", invalid)
+	require.Nil(t, errWithStatusCode)
+	require.Len(t, repairRequests, 1)
+	contents := repairRequests[0].Contents
+	require.Len(t, contents, 3)
+	assert.Equal(t, "model", contents[1].Role)
+	assert.Equal(t, `{"name": 42}`, contents[1].Parts[0].Text)
+	assert.Contains(t, contents[2].Parts[0].Text, "$.name: expected string")
+	assert.Equal(t, 40, usage.TotalTokens)
+	assert.Contains(t, w.Body.String(), `Ada`)
+
+	// a repair that does not match either is billed for both calls
+	repairRequests = nil
+	repairResponse = invalid
+	_, usage, errWithStatusCode = run("repair", invalid)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, "invalid_response_json", errWithStatusCode.Code)
+	assert.True(t, errWithStatusCode.Billed)
+	require.Len(t, repairRequests, 1)
+	assert.Equal(t, 30, usage.TotalTokens)
+	repairResponse = valid
+
+	// validation is off by default
+	repairRequests = nil
+	_, _, errWithStatusCode = run("", invalid)
+	assert.Nil(t, errWithStatusCode)
+	assert.Empty(t, repairRequests)
+}
+
+func TestDoResponseStripsJSONFences(t *testing.T) {
+	defer func(enabled bool) { config.GeminiStripJSONFences = enabled }(config.GeminiStripJSONFences)
+	const fenced = `{"candidates": [{"content": {"role": "model", "parts": [{"text": "` + "```json\\n" + `{\"name\": \"Ada\"}` + "\\n```" + `"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15}}`
+	run := func(responseFormat *model.ResponseFormat) string {
+		c, w := newTestContext()
+		relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, ActualModelName: "gemini-1.5-pro"}
+		adaptor := &Adaptor{}
+		adaptor.Init(relayMeta)
+		_, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+			Model:          "gemini-1.5-pro",
+			Messages:       []model.Message{{Role: "user", Content: "Who wrote the first program?"}},
+			ResponseFormat: responseFormat,
+		})
+		require.NoError(t, err)
+		_, errWithStatusCode := adaptor.DoResponse(c, newTestResponse(http.StatusOK, fenced), relayMeta)
+		require.Nil(t, errWithStatusCode)
+		var response struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Choices[0].Message.Content
+	}
+
+	// off by default
+	assert.Equal(t, "```json\n{\"name\": \"Ada\"}\n```", run(&model.ResponseFormat{Type: "json_object"}))
+
+	config.GeminiStripJSONFences = true
+	assert.Equal(t, `{"name": "Ada"}`, run(&model.ResponseFormat{Type: "json_object"}))
+	// plain text answers are never touched
+	assert.Equal(t, "```json\n{\"name\": \"Ada\"}\n```", run(nil))
+}
+
+func TestDoRequestDryRun(t *testing.T) {
+	defer func(enabled bool) { config.GeminiDryRunEnabled = enabled }(config.GeminiDryRunEnabled)
+	upstreamCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		_, _ = w.Write([]byte("data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hi\"}]}, \"finishReason\": \"STOP\"}], " +
+			"\"usageMetadata\": {\"promptTokenCount\": 3, \"candidatesTokenCount\": 1, \"totalTokenCount\": 4}}\n\n"))
+	}))
+	defer server.Close()
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+
+	run := func() (*httptest.ResponseRecorder, []byte, *model.Usage) {
+		c, w := newTestContext()
+		c.Request.Header.Set(DryRunHeader, "1")
+		relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, BaseURL: server.URL, ActualModelName: "gemini-1.5-pro", IsStream: true}
+		adaptor := &Adaptor{}
+		adaptor.Init(relayMeta)
+		_, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+			Model: "gemini-1.5-pro",
+			Messages: []model.Message{
+				{Role: "system", Content: "Be brief"},
+				{Role: "user", Content: "Hi"},
+				{Role: "assistant", Content: "Hello"},
+			},
+			Stream: true,
+		})
+		require.NoError(t, err)
+		requestBody, err := GetConvertedRequestBody(c)
+		require.NoError(t, err)
+		resp, err := adaptor.DoRequest(c, relayMeta, bytes.NewReader(requestBody))
+		require.NoError(t, err)
+		usage, errWithStatusCode := adaptor.DoResponse(c, resp, relayMeta)
+		require.Nil(t, errWithStatusCode)
+		return w, requestBody, usage
+	}
+
+	// the header alone is not enough
+	_, _, _ = run()
+	assert.Equal(t, 1, upstreamCalls)
+
+	config.GeminiDryRunEnabled = true
+	w, requestBody, usage := run()
+	assert.Equal(t, 1, upstreamCalls)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, string(requestBody), w.Body.String())
+	var geminiRequest ChatRequest
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &geminiRequest))
+	require.NotNil(t, geminiRequest.SystemInstruction)
+	assert.Equal(t, "Be brief", geminiRequest.SystemInstruction.Parts[0].Text)
+	require.Len(t, geminiRequest.Contents, 2)
+	assert.Equal(t, "model", geminiRequest.Contents[1].Role)
+	assert.Equal(t, &model.Usage{}, usage)
+}
+
+func TestDoRequestTimeout(t *testing.T) {
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+	defer func(timeout int) { config.GeminiRequestTimeout = timeout }(config.GeminiRequestTimeout)
+	config.GeminiRequestTimeout = 1
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// under /slow-body the headers come right away, only the body takes its time
+		if strings.HasPrefix(r.URL.Path, "/slow-body/") {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"candidates": [`))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	run := func(baseURL string) (*http.Response, error, *Adaptor, *meta.Meta) {
+		c, _ := newTestContext()
+		relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, BaseURL: baseURL, ActualModelName: "gemini-1.5-pro"}
+		adaptor := &Adaptor{}
+		adaptor.Init(relayMeta)
+		start := time.Now()
+		resp, err := adaptor.DoRequest(c, relayMeta, strings.NewReader(`{"contents": []}`))
+		assert.Less(t, time.Since(start), 3*time.Second)
+		return resp, err, adaptor, relayMeta
+	}
+
+	// no headers in time
+	_, err, _, _ := run(server.URL)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(), "gemini did not answer within 1s")
+
+	// headers in time, the body is not
+	resp, err, adaptor, relayMeta := run(server.URL + "/slow-body")
+	require.NoError(t, err)
+	c, w := newTestContext()
+	_, errWithStatusCode := adaptor.DoResponse(c, resp, relayMeta)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusGatewayTimeout, errWithStatusCode.StatusCode)
+	assert.Equal(t, "upstream_timeout", errWithStatusCode.Error.Code)
+	assert.Equal(t, "gemini did not answer within 1s", errWithStatusCode.Error.Message)
+	assert.Empty(t, w.Body.String())
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDoGeminiRequest(t *testing.T) {
+	defer func(version string) { config.GeminiVersion = version }(config.GeminiVersion)
+	config.GeminiVersion = ""
+	var sent *http.Request
+	var sentBody string
+	httpClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		sentBody = string(body)
+		return newTestResponse(http.StatusOK, `{}`), nil
+	})}
+	send := func(relayMeta *meta.Meta) {
+		sent = nil
+		resp, err := doGeminiRequest(context.Background(), httpClient, relayMeta, strings.NewReader(`{"contents": []}`))
+		require.NoError(t, err)
+		require.NotNil(t, sent)
+		_ = resp.Body.Close()
+	}
+
+	send(&meta.Meta{BaseURL: "https://generativelanguage.googleapis.com", ActualModelName: "gemini-1.5-pro", APIKey: "AIza-test"})
+	assert.Equal(t, http.MethodPost, sent.Method)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/gemini-1.5-pro:generateContent", sent.URL.String())
+	assert.Equal(t, "AIza-test", sent.Header.Get("x-goog-api-key"))
+	assert.Empty(t, sent.URL.Query().Get("key"), "the key must not leak into the URL")
+	assert.Equal(t, "application/json", sent.Header.Get("Content-Type"))
+	assert.Empty(t, sent.Header.Get("Accept"))
+	assert.Equal(t, `{"contents": []}`, sentBody)
+
+	send(&meta.Meta{BaseURL: "https://generativelanguage.googleapis.com", ActualModelName: "gemini-pro", IsStream: true})
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1/models/gemini-pro:streamGenerateContent?alt=sse", sent.URL.String())
+	assert.Equal(t, "text/event-stream", sent.Header.Get("Accept"))
+
+	send(&meta.Meta{BaseURL: "https://proxy.example.com", ActualModelName: "text-embedding-004", Mode: relaymode.Embeddings,
+		Config: dbmodel.ChannelConfig{APIVersion: "v1alpha"}})
+	assert.Equal(t, "https://proxy.example.com/v1alpha/models/text-embedding-004:batchEmbedContents", sent.URL.String())
+
+	config.GeminiVersion = "v1"
+	send(&meta.Meta{BaseURL: "https://generativelanguage.googleapis.com", ActualModelName: "gemini-2.0-flash"})
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1/models/gemini-2.0-flash:generateContent", sent.URL.String())
+
+	failingClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})}
+	_, err := doGeminiRequest(context.Background(), failingClient, &meta.Meta{BaseURL: "https://generativelanguage.googleapis.com"}, strings.NewReader(`{}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+}
+
+func TestDoRequestCancelledWithClient(t *testing.T) {
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+	// the text delivered before the disconnect is billed with an estimate
+	defer func(enabled bool) { config.ApproximateTokenEnabled = enabled }(config.ApproximateTokenEnabled)
+	config.ApproximateTokenEnabled = true
+	upstreamCancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Once\"}]}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			upstreamCancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	c, _ := newTestContext()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = c.Request.WithContext(ctx)
+	relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, BaseURL: server.URL, ActualModelName: "gemini-1.5-pro", IsStream: true}
+	adaptor := &Adaptor{}
+	adaptor.Init(relayMeta)
+	resp, err := adaptor.DoRequest(c, relayMeta, strings.NewReader(`{"contents": []}`))
+	require.NoError(t, err)
+	responded := make(chan struct{})
+	go func() {
+		defer close(responded)
+		_, _ = adaptor.DoResponse(c, resp, relayMeta)
+	}()
+
+	cancel()
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the upstream request outlived the client")
+	}
+	<-responded
+
+	// a client gone before gemini answered cancels the call itself
+	_, err = adaptor.DoRequest(c, relayMeta, strings.NewReader(`{"contents": []}`))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDoResponseRawResponse(t *testing.T) {
+	const body = `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "finishReason": "STOP", "index": 0, "avgLogprobs": -0.25}],
+		"usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 1, "totalTokenCount": 4}, "modelVersion": "gemini-1.5-pro-002"}`
+	run := func(raw bool) (*httptest.ResponseRecorder, *model.Usage) {
+		c, w := newTestContext()
+		if raw {
+			c.Request.Header.Set(RawResponseHeader, "1")
+		}
+		relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, ActualModelName: "gemini-1.5-pro", PromptTokens: 3}
+		adaptor := &Adaptor{}
+		adaptor.Init(relayMeta)
+		_, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+			Model:    "gemini-1.5-pro",
+			Messages: []model.Message{{Role: "user", Content: "Hi"}},
+		})
+		require.NoError(t, err)
+		usage, errWithStatusCode := adaptor.DoResponse(c, newTestResponse(http.StatusOK, body), relayMeta)
+		require.Nil(t, errWithStatusCode)
+		return w, usage
+	}
+
+	w, usage := run(true)
+	assert.Equal(t, body, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, 4, usage.TotalTokens)
+
+	// without the header the response is converted as usual
+	w, usage = run(false)
+	assert.Contains(t, w.Body.String(), `"object":"chat.completion"`)
+	assert.Equal(t, 4, usage.TotalTokens)
+}
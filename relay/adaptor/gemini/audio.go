@@ -0,0 +1,40 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// https://ai.google.dev/gemini-api/docs/audio#supported-formats
+var SupportedAudioFormats = map[string]string{
+	"wav":  "audio/wav",
+	"mp3":  "audio/mp3",
+	"aiff": "audio/aiff",
+	"aac":  "audio/aac",
+	"ogg":  "audio/ogg",
+	"flac": "audio/flac",
+}
+
+func maxAudioSize() int64 {
+	return mediaSizeLimit(config.GeminiMaxAudioSize)
+}
+
+// convertInputAudio turns an OpenAI input_audio part, base64 data plus a format name, into
+// inline data gemini accepts
+func convertInputAudio(audio *model.InputAudio) (*InlineData, error) {
+	if audio == nil || audio.Data == "" {
+		return nil, fmt.Errorf("%w: input_audio must have data", model.ErrInvalidRequest)
+	}
+	mimeType, ok := SupportedAudioFormats[strings.ToLower(audio.Format)]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported audio format %q", model.ErrInvalidRequest, audio.Format)
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(audio.Data))) > maxAudioSize() {
+		return nil, fmt.Errorf("%w: audio exceeds the %d MB limit", model.ErrInvalidRequest, maxAudioSize()>>20)
+	}
+	return &InlineData{MimeType: mimeType, Data: audio.Data}, nil
+}
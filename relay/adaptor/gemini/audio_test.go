@@ -0,0 +1,51 @@
+package gemini
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertRequestInputAudio(t *testing.T) {
+	audio := base64.StdEncoding.EncodeToString([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"))
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model: "gemini-1.5-flash",
+		Messages: []model.Message{{Role: "user", Content: []any{
+			map[string]any{"type": "text", "text": "Transcribe this"},
+			map[string]any{"type": "input_audio", "input_audio": map[string]any{"data": audio, "format": "mp3"}},
+		}}},
+	})
+	require.NoError(t, err)
+	parts := geminiRequest.Contents[0].Parts
+	require.Len(t, parts, 2)
+	require.NotNil(t, parts[1].InlineData)
+	assert.Equal(t, "audio/mp3", parts[1].InlineData.MimeType)
+	assert.Equal(t, audio, parts[1].InlineData.Data)
+}
+
+func TestConvertInputAudio(t *testing.T) {
+	defer func(size int) { config.GeminiMaxAudioSize = size }(config.GeminiMaxAudioSize)
+	config.GeminiMaxAudioSize = 1
+
+	inlineData, err := convertInputAudio(&model.InputAudio{Data: "UklGRg==", Format: "WAV"})
+	require.NoError(t, err)
+	assert.Equal(t, "audio/wav", inlineData.MimeType)
+
+	_, err = convertInputAudio(&model.InputAudio{Data: "UklGRg==", Format: "m4a"})
+	assert.True(t, errors.Is(err, model.ErrInvalidRequest))
+
+	_, err = convertInputAudio(&model.InputAudio{Format: "mp3"})
+	assert.True(t, errors.Is(err, model.ErrInvalidRequest))
+
+	tooLarge := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 1024*1024+1)))
+	_, err = convertInputAudio(&model.InputAudio{Data: tooLarge, Format: "mp3"})
+	assert.True(t, errors.Is(err, model.ErrInvalidRequest))
+	assert.Contains(t, err.Error(), "1 MB")
+}
@@ -0,0 +1,171 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// error bodies of gemini are small, a failing channel is recognised by the first part of it
+const maxErrorPeekSize = 64 * 1024
+
+// circuitBreaker stops a channel from sending requests to gemini after threshold consecutive
+// failures, for cooldown no request goes out at all, then a single probe decides whether the
+// channel is back (closed) or keeps failing (open for another cooldown)
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a request may go out, retryIn is how much of the cooldown is left otherwise
+func (b *circuitBreaker) allow(now time.Time, cooldown time.Duration) (retryIn time.Duration, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if elapsed := now.Sub(b.openedAt); elapsed < cooldown {
+			return cooldown - elapsed, false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return 0, true
+	case breakerHalfOpen:
+		// everyone else waits for the probe
+		if b.probing {
+			return cooldown, false
+		}
+		b.probing = true
+		return 0, true
+	}
+	return 0, true
+}
+
+// record counts the outcome of a request allow let through
+func (b *circuitBreaker) record(now time.Time, failed bool, threshold int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= threshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
+
+// release gives up the probe without an outcome, e.g. when the client went away, the next
+// request probes instead
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+type channelCircuitBreakers struct {
+	mutex    sync.Mutex
+	breakers map[int]*circuitBreaker
+}
+
+var circuitBreakers = channelCircuitBreakers{breakers: make(map[int]*circuitBreaker)}
+
+func (l *channelCircuitBreakers) breaker(channelId int) *circuitBreaker {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	breaker, ok := l.breakers[channelId]
+	if !ok {
+		breaker = &circuitBreaker{}
+		l.breakers[channelId] = breaker
+	}
+	return breaker
+}
+
+func circuitBreakerEnabled() bool {
+	return config.GeminiCircuitBreakerThreshold > 0
+}
+
+// allowRequest fails with model.ErrUpstreamUnavailable while the breaker of the channel is open
+func allowRequest(channelId int) error {
+	cooldown := time.Duration(config.GeminiCircuitBreakerCooldown) * time.Second
+	retryIn, ok := circuitBreakers.breaker(channelId).allow(time.Now(), cooldown)
+	if !ok {
+		return fmt.Errorf("%w: channel #%d keeps failing, retry in %s",
+			model.ErrUpstreamUnavailable, channelId, retryIn.Round(time.Second))
+	}
+	return nil
+}
+
+// recordResponse tells the breaker of the channel how the request went
+func recordResponse(ctx context.Context, channelId int, resp *http.Response, err error) {
+	breaker := circuitBreakers.breaker(channelId)
+	if err != nil && errors.Is(err, context.Canceled) {
+		breaker.release()
+		return
+	}
+	failed := err != nil || isChannelFailure(resp)
+	breaker.record(time.Now(), failed, config.GeminiCircuitBreakerThreshold)
+	if failed {
+		logger.Debugf(ctx, "gemini channel #%d failed, counted by its circuit breaker", channelId)
+	}
+}
+
+// isChannelFailure reports whether the response says the channel itself is broken (bad key,
+// unsupported region, outage) rather than the request, only those open the breaker
+func isChannelFailure(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode >= http.StatusInternalServerError:
+		return true
+	case resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusForbidden:
+		return false
+	}
+	geminiError := peekError(resp)
+	if geminiError == nil {
+		return false
+	}
+	// FAILED_PRECONDITION is what gemini answers for regions it does not serve
+	return isAPIKeyError(geminiError) || geminiError.Status == "FAILED_PRECONDITION"
+}
+
+// peekError parses the error of a response without consuming it, what has been read is put
+// back in front of the rest for the relay to report the error
+func peekError(resp *http.Response) *Error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorPeekSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil {
+		return nil
+	}
+	var errorResponse struct {
+		Error *Error `json:"error,omitempty"`
+	}
+	if json.Unmarshal(body, &errorResponse) != nil {
+		return nil
+	}
+	return errorResponse.Error
+}
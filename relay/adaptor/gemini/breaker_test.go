@@ -0,0 +1,207 @@
+package gemini
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	const threshold, cooldown = 3, 30 * time.Second
+	var breaker circuitBreaker
+
+	// closed, a success in between starts the count over
+	for _, failed := range []bool{true, true, false, true, true} {
+		_, ok := breaker.allow(now, cooldown)
+		require.True(t, ok)
+		breaker.record(now, failed, threshold)
+	}
+	assert.Equal(t, breakerClosed, breaker.state)
+
+	// the third failure in a row opens it
+	_, ok := breaker.allow(now, cooldown)
+	require.True(t, ok)
+	breaker.record(now, true, threshold)
+	assert.Equal(t, breakerOpen, breaker.state)
+	retryIn, ok := breaker.allow(now.Add(10*time.Second), cooldown)
+	assert.False(t, ok)
+	assert.Equal(t, 20*time.Second, retryIn)
+
+	// after the cooldown a single probe goes out
+	now = now.Add(cooldown)
+	_, ok = breaker.allow(now, cooldown)
+	assert.True(t, ok)
+	assert.Equal(t, breakerHalfOpen, breaker.state)
+	_, ok = breaker.allow(now, cooldown)
+	assert.False(t, ok)
+
+	// a failed probe opens it for another cooldown
+	breaker.record(now, true, threshold)
+	assert.Equal(t, breakerOpen, breaker.state)
+	_, ok = breaker.allow(now.Add(cooldown-time.Second), cooldown)
+	assert.False(t, ok)
+
+	// a probe that never got an answer leaves the next request to probe
+	now = now.Add(cooldown)
+	_, ok = breaker.allow(now, cooldown)
+	require.True(t, ok)
+	breaker.release()
+	assert.Equal(t, breakerHalfOpen, breaker.state)
+	_, ok = breaker.allow(now, cooldown)
+	require.True(t, ok)
+
+	// a successful probe closes it
+	breaker.record(now, false, threshold)
+	assert.Equal(t, breakerClosed, breaker.state)
+	assert.Zero(t, breaker.failures)
+	_, ok = breaker.allow(now, cooldown)
+	assert.True(t, ok)
+}
+
+func TestDoRequestCircuitBreaker(t *testing.T) {
+	defer func(threshold, cooldown, retryTimes int) {
+		config.GeminiCircuitBreakerThreshold, config.GeminiCircuitBreakerCooldown, config.GeminiRetryTimes = threshold, cooldown, retryTimes
+	}(config.GeminiCircuitBreakerThreshold, config.GeminiCircuitBreakerCooldown, config.GeminiRetryTimes)
+	config.GeminiCircuitBreakerThreshold, config.GeminiCircuitBreakerCooldown, config.GeminiRetryTimes = 2, 60, 0
+	const channelId = 100
+	resetBreaker := func() {
+		circuitBreakers.mutex.Lock()
+		delete(circuitBreakers.breakers, channelId)
+		circuitBreakers.mutex.Unlock()
+	}
+	resetBreaker()
+	defer resetBreaker()
+	const regionError = `{"error": {"code": 400, "message": "User location is not supported for the API use.", "status": "FAILED_PRECONDITION"}}`
+	upstreamCalls, statusCode, body := 0, http.StatusBadRequest, regionError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+
+	relayMeta := &meta.Meta{BaseURL: server.URL, ActualModelName: "gemini-1.5-pro", ChannelId: channelId}
+	send := func() (string, error) {
+		c, _ := newTestContext()
+		resp, err := (&Adaptor{}).DoRequest(c, relayMeta, bytes.NewReader([]byte(`{"contents":[]}`)))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		responseBody, err := io.ReadAll(resp.Body)
+		return string(responseBody), err
+	}
+
+	// the error still reaches the client after the breaker has looked at it
+	responseBody, err := send()
+	require.NoError(t, err)
+	assert.Equal(t, regionError, responseBody)
+	_, err = send()
+	require.NoError(t, err)
+	assert.Equal(t, 2, upstreamCalls)
+
+	// open, requests fail fast without reaching gemini
+	_, err = send()
+	assert.ErrorIs(t, err, model.ErrUpstreamUnavailable)
+	assert.Equal(t, 2, upstreamCalls)
+
+	// half open once the cooldown is over, the probe finds the channel working again
+	breaker := circuitBreakers.breaker(channelId)
+	breaker.mutex.Lock()
+	breaker.openedAt = breaker.openedAt.Add(-time.Minute)
+	breaker.mutex.Unlock()
+	statusCode, body = http.StatusOK, `{"candidates": []}`
+	_, err = send()
+	require.NoError(t, err)
+	assert.Equal(t, 3, upstreamCalls)
+	assert.Equal(t, breakerClosed, breaker.state)
+
+	// errors about the request itself say nothing about the channel
+	statusCode, body = http.StatusBadRequest, `{"error": {"code": 400, "message": "Invalid JSON payload", "status": "INVALID_ARGUMENT"}}`
+	for i := 0; i < 3; i++ {
+		_, err = send()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 6, upstreamCalls)
+	assert.Equal(t, breakerClosed, breaker.state)
+}
+
+func TestDoRequestCircuitBreakerBeforeRateLimit(t *testing.T) {
+	defer func(threshold, cooldown, rate, maxWait int) {
+		config.GeminiCircuitBreakerThreshold, config.GeminiCircuitBreakerCooldown = threshold, cooldown
+		config.GeminiChannelRateLimit, config.GeminiRateLimitMaxWait = rate, maxWait
+	}(config.GeminiCircuitBreakerThreshold, config.GeminiCircuitBreakerCooldown, config.GeminiChannelRateLimit, config.GeminiRateLimitMaxWait)
+	config.GeminiCircuitBreakerThreshold, config.GeminiCircuitBreakerCooldown = 1, 60
+	config.GeminiChannelRateLimit, config.GeminiRateLimitMaxWait = 0, 0
+	const channelId = 101
+	reset := func() {
+		circuitBreakers.mutex.Lock()
+		delete(circuitBreakers.breakers, channelId)
+		circuitBreakers.mutex.Unlock()
+		rateLimiter.mutex.Lock()
+		delete(rateLimiter.buckets, channelId)
+		rateLimiter.mutex.Unlock()
+	}
+	reset()
+	defer reset()
+	upstreamCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		_, _ = w.Write([]byte(`{"candidates": []}`))
+	}))
+	defer server.Close()
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+
+	send := func(relayMeta *meta.Meta) error {
+		c, _ := newTestContext()
+		resp, err := (&Adaptor{}).DoRequest(c, relayMeta, bytes.NewReader([]byte(`{"contents":[]}`)))
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	relayMeta := &meta.Meta{BaseURL: server.URL, ActualModelName: "gemini-1.5-pro", ChannelId: channelId}
+	relayMeta.Config.RateLimit = 1
+	breaker := circuitBreakers.breaker(channelId)
+	breaker.record(time.Now(), true, config.GeminiCircuitBreakerThreshold)
+
+	// requests turned away by the open breaker leave the rate limit alone
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, send(relayMeta), model.ErrUpstreamUnavailable)
+	}
+	breaker.record(time.Now(), false, config.GeminiCircuitBreakerThreshold)
+	require.NoError(t, send(relayMeta))
+	assert.Equal(t, 1, upstreamCalls)
+	reset()
+
+	// a probe turned away by the rate limit does not keep the breaker half open for good
+	breaker = circuitBreakers.breaker(channelId)
+	breaker.record(time.Now(), true, config.GeminiCircuitBreakerThreshold)
+	breaker.mutex.Lock()
+	breaker.openedAt = breaker.openedAt.Add(-time.Minute)
+	breaker.mutex.Unlock()
+	_, ok := rateLimiter.bucket(channelId).reserve(time.Now(), 1, 0)
+	require.True(t, ok)
+	assert.ErrorIs(t, send(relayMeta), model.ErrRateLimited)
+	assert.Equal(t, breakerHalfOpen, breaker.state)
+	assert.False(t, breaker.probing)
+	assert.Equal(t, 1, upstreamCalls)
+}
@@ -0,0 +1,190 @@
+package gemini
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+const (
+	// a cache is not used any more when it is about to expire, so the request never races its deletion
+	contextCacheExpiryMargin = time.Minute
+	// after a failed creation the instruction is sent inline for a while before trying again
+	contextCacheRetryDelay = 5 * time.Minute
+	// an instruction without a live cache that has not been seen for this long is forgotten
+	contextCacheSightingTTL = time.Hour
+)
+
+// https://ai.google.dev/api/caching#CachedContent
+type CachedContent struct {
+	Name              string       `json:"name,omitempty"`
+	Model             string       `json:"model,omitempty"`
+	SystemInstruction *ChatContent `json:"systemInstruction,omitempty"`
+	Ttl               string       `json:"ttl,omitempty"`
+	ExpireTime        time.Time    `json:"expireTime,omitempty"`
+	Error             *Error       `json:"error,omitempty"`
+}
+
+type contextCacheEntry struct {
+	Name       string
+	ExpiresAt  time.Time
+	Seen       int
+	LastSeen   time.Time
+	RetryAfter time.Time
+	Creating   bool
+}
+
+// stale reports whether the entry is of no use any more, neither a live cache nor a recent sighting
+func (e *contextCacheEntry) stale(now time.Time) bool {
+	if e.Creating || now.Before(e.RetryAfter) {
+		return false
+	}
+	if e.Name != "" && now.Before(e.ExpiresAt) {
+		return false
+	}
+	return now.Sub(e.LastSeen) > contextCacheSightingTTL
+}
+
+var (
+	contextCacheLock  sync.Mutex
+	contextCacheStore = make(map[string]*contextCacheEntry)
+)
+
+// applyContextCache swaps a large system instruction the channel has already sent before for a
+// reference to a cachedContents resource, so gemini bills the cached tokens at the reduced rate.
+// Any failure keeps the instruction inline.
+func applyContextCache(meta *meta.Meta, request *ChatRequest, modelName string) {
+	if !config.GeminiContextCacheEnabled || meta == nil || request.SystemInstruction == nil {
+		return
+	}
+	// gemini refuses system_instruction, tools and tool_config next to cachedContent
+	if request.Tools != nil || request.ToolConfig != nil {
+		return
+	}
+	if getAPIVersion(meta, modelName) == "v1" {
+		return
+	}
+	instruction, err := json.Marshal(request.SystemInstruction)
+	if err != nil {
+		return
+	}
+	var text strings.Builder
+	for _, part := range request.SystemInstruction.Parts {
+		text.WriteString(part.Text)
+	}
+	if openai.CountTokenText(text.String(), TokenizerModel) < config.GeminiContextCacheMinTokens {
+		return
+	}
+	hash := sha256.Sum256(instruction)
+	cacheKey := fmt.Sprintf("%d|%s|%s", meta.ChannelId, modelName, hex.EncodeToString(hash[:]))
+
+	name := getContextCache(meta, request.SystemInstruction, modelName, cacheKey)
+	if name == "" {
+		return
+	}
+	request.CachedContent = name
+	request.SystemInstruction = nil
+}
+
+// getContextCache returns the name of a live cache for the instruction, creating it the second
+// time the instruction is seen, an empty name means the instruction has to be sent inline.
+// The cache is created without holding contextCacheLock, requests for the same instruction send
+// it inline meanwhile.
+func getContextCache(meta *meta.Meta, instruction *ChatContent, modelName string, cacheKey string) string {
+	now := time.Now()
+	contextCacheLock.Lock()
+	entry, ok := contextCacheStore[cacheKey]
+	if !ok {
+		// instructions seen once long ago and caches gemini has deleted are forgotten along the way
+		for key, cached := range contextCacheStore {
+			if cached.stale(now) {
+				delete(contextCacheStore, key)
+			}
+		}
+		entry = &contextCacheEntry{}
+		contextCacheStore[cacheKey] = entry
+	}
+	if entry.Name != "" && now.Add(contextCacheExpiryMargin).Before(entry.ExpiresAt) {
+		name := entry.Name
+		contextCacheLock.Unlock()
+		return name
+	}
+	entry.Name = ""
+	entry.Seen++
+	entry.LastSeen = now
+	if entry.Seen < 2 || entry.Creating || now.Before(entry.RetryAfter) {
+		contextCacheLock.Unlock()
+		return ""
+	}
+	entry.Creating = true
+	contextCacheLock.Unlock()
+
+	cachedContent, err := createContextCache(meta, instruction, modelName)
+
+	contextCacheLock.Lock()
+	defer contextCacheLock.Unlock()
+	entry.Creating = false
+	if err != nil {
+		logger.SysErrorf("create gemini context cache for %s failed, sending the system instruction inline: %s", modelName, err.Error())
+		entry.RetryAfter = time.Now().Add(contextCacheRetryDelay)
+		return ""
+	}
+	entry.Name = cachedContent.Name
+	entry.ExpiresAt = cachedContent.ExpireTime
+	if entry.ExpiresAt.IsZero() {
+		entry.ExpiresAt = now.Add(time.Duration(config.GeminiContextCacheTTL) * time.Second)
+	}
+	return entry.Name
+}
+
+func createContextCache(meta *meta.Meta, instruction *ChatContent, modelName string) (*CachedContent, error) {
+	requestBody, err := json.Marshal(CachedContent{
+		Model:             "models/" + modelName,
+		SystemInstruction: instruction,
+		Ttl:               fmt.Sprintf("%ds", config.GeminiContextCacheTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	fullRequestURL := fmt.Sprintf("%s/%s/cachedContents", meta.BaseURL, getAPIVersion(meta, modelName))
+	req, err := http.NewRequest(http.MethodPost, fullRequestURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", meta.APIKey)
+	resp, err := client.ImpatientHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var cachedContent CachedContent
+	err = json.Unmarshal(body, &cachedContent)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal cached content failed, status code: %d: %w", resp.StatusCode, err)
+	}
+	if cachedContent.Error != nil {
+		return nil, fmt.Errorf("%s", errorGemini2OpenAI(cachedContent.Error, resp.StatusCode).Message)
+	}
+	if resp.StatusCode != http.StatusOK || cachedContent.Name == "" {
+		return nil, fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	return &cachedContent, nil
+}
@@ -0,0 +1,165 @@
+package gemini
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyContextCache(t *testing.T) {
+	if client.ImpatientHTTPClient == nil {
+		client.ImpatientHTTPClient = http.DefaultClient
+		defer func() { client.ImpatientHTTPClient = nil }()
+	}
+	defer func(enabled bool, minTokens int, approximate bool) {
+		config.GeminiContextCacheEnabled = enabled
+		config.GeminiContextCacheMinTokens = minTokens
+		config.ApproximateTokenEnabled = approximate
+	}(config.GeminiContextCacheEnabled, config.GeminiContextCacheMinTokens, config.ApproximateTokenEnabled)
+	config.GeminiContextCacheEnabled = true
+	config.GeminiContextCacheMinTokens = 10
+	config.ApproximateTokenEnabled = true
+	contextCacheLock.Lock()
+	contextCacheStore = make(map[string]*contextCacheEntry)
+	contextCacheLock.Unlock()
+
+	calls := 0
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/v1beta/cachedContents", r.URL.Path)
+		var cachedContent CachedContent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&cachedContent))
+		assert.Equal(t, "models/gemini-1.5-flash-001", cachedContent.Model)
+		assert.Equal(t, "3600s", cachedContent.Ttl)
+		if failing {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "Cached content is too small.", "status": "INVALID_ARGUMENT"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"name": "cachedContents/abc123", "model": "models/gemini-1.5-flash-001"}`))
+	}))
+	defer server.Close()
+
+	newRequest := func(instruction string) *ChatRequest {
+		return &ChatRequest{
+			Contents:          []ChatContent{{Role: "user", Parts: []Part{{Text: "What does it say?"}}}},
+			SystemInstruction: &ChatContent{Parts: []Part{{Text: instruction}}},
+		}
+	}
+	channelMeta := &meta.Meta{ChannelId: 1, BaseURL: server.URL, APIKey: "key"}
+	document := strings.Repeat("a long document ", 100)
+
+	// first sighting is sent inline
+	request := newRequest(document)
+	applyContextCache(channelMeta, request, "gemini-1.5-flash-001")
+	assert.NotNil(t, request.SystemInstruction)
+	assert.Empty(t, request.CachedContent)
+	assert.Equal(t, 0, calls)
+
+	// the repeat creates the cache and references it
+	request = newRequest(document)
+	applyContextCache(channelMeta, request, "gemini-1.5-flash-001")
+	assert.Nil(t, request.SystemInstruction)
+	assert.Equal(t, "cachedContents/abc123", request.CachedContent)
+	assert.Equal(t, 1, calls)
+
+	// later requests reuse it
+	request = newRequest(document)
+	applyContextCache(channelMeta, request, "gemini-1.5-flash-001")
+	assert.Equal(t, "cachedContents/abc123", request.CachedContent)
+	assert.Equal(t, 1, calls)
+
+	// small instructions are never cached
+	request = newRequest("Be brief.")
+	applyContextCache(channelMeta, request, "gemini-1.5-flash-001")
+	applyContextCache(channelMeta, request, "gemini-1.5-flash-001")
+	assert.NotNil(t, request.SystemInstruction)
+	assert.Equal(t, 1, calls)
+
+	// a failed creation falls back to the inline instruction
+	failing = true
+	otherDocument := strings.Repeat("another long document ", 100)
+	for i := 0; i < 3; i++ {
+		request = newRequest(otherDocument)
+		applyContextCache(channelMeta, request, "gemini-1.5-flash-001")
+		assert.NotNil(t, request.SystemInstruction)
+		assert.Empty(t, request.CachedContent)
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestGetContextCacheCreatesWithoutLock(t *testing.T) {
+	if client.ImpatientHTTPClient == nil {
+		client.ImpatientHTTPClient = http.DefaultClient
+		defer func() { client.ImpatientHTTPClient = nil }()
+	}
+	contextCacheLock.Lock()
+	contextCacheStore = make(map[string]*contextCacheEntry)
+	contextCacheLock.Unlock()
+
+	creating, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creating <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte(`{"name": "cachedContents/slow"}`))
+	}))
+	defer server.Close()
+	channelMeta := &meta.Meta{ChannelId: 1, BaseURL: server.URL, APIKey: "key"}
+	instruction := &ChatContent{Parts: []Part{{Text: "a long document"}}}
+
+	assert.Empty(t, getContextCache(channelMeta, instruction, "gemini-1.5-flash-001", "slow"))
+	created := make(chan string)
+	go func() {
+		created <- getContextCache(channelMeta, instruction, "gemini-1.5-flash-001", "slow")
+	}()
+	<-creating
+
+	// neither other instructions nor the same one wait for the creation
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Empty(t, getContextCache(channelMeta, instruction, "gemini-1.5-flash-001", "other"))
+		assert.Empty(t, getContextCache(channelMeta, instruction, "gemini-1.5-flash-001", "slow"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache lookups waited for the creation")
+	}
+
+	close(release)
+	assert.Equal(t, "cachedContents/slow", <-created)
+	assert.Equal(t, "cachedContents/slow", getContextCache(channelMeta, instruction, "gemini-1.5-flash-001", "slow"))
+}
+
+func TestContextCachePruning(t *testing.T) {
+	now := time.Now()
+	contextCacheLock.Lock()
+	contextCacheStore = map[string]*contextCacheEntry{
+		"seen once":     {Seen: 1, LastSeen: now.Add(-2 * contextCacheSightingTTL)},
+		"expired":       {Name: "cachedContents/old", ExpiresAt: now.Add(-time.Minute), Seen: 5, LastSeen: now.Add(-2 * contextCacheSightingTTL)},
+		"live":          {Name: "cachedContents/live", ExpiresAt: now.Add(time.Hour), Seen: 5, LastSeen: now.Add(-2 * contextCacheSightingTTL)},
+		"recently seen": {Seen: 1, LastSeen: now},
+		"failed":        {Seen: 2, LastSeen: now.Add(-2 * contextCacheSightingTTL), RetryAfter: now.Add(time.Minute)},
+	}
+	contextCacheLock.Unlock()
+
+	// a first sighting of a new instruction sweeps the store
+	assert.Empty(t, getContextCache(&meta.Meta{}, &ChatContent{}, "gemini-1.5-flash-001", "new"))
+	contextCacheLock.Lock()
+	defer contextCacheLock.Unlock()
+	var keys []string
+	for key := range contextCacheStore {
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"live", "recently seen", "failed", "new"}, keys)
+}
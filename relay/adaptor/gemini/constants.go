@@ -3,6 +3,134 @@ package gemini
 // https://ai.google.dev/models/gemini
 
 var ModelList = []string{
-	"gemini-pro", "gemini-1.0-pro-001", "gemini-1.5-pro",
+	"gemini-pro", "gemini-1.0-pro-001", "gemini-1.5-pro", "gemini-2.0-flash-thinking-exp",
 	"gemini-pro-vision", "gemini-1.0-pro-vision-001", "embedding-001", "text-embedding-004",
 }
+
+// https://ai.google.dev/gemini-api/docs/safety-settings
+
+var SafetyCategories = []string{
+	"HARM_CATEGORY_HARASSMENT",
+	"HARM_CATEGORY_HATE_SPEECH",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	"HARM_CATEGORY_DANGEROUS_CONTENT",
+}
+
+// FallbackSafetyThreshold replaces a threshold that slipped past validation, a typo must not
+// switch the filters off
+const FallbackSafetyThreshold = "BLOCK_ONLY_HIGH"
+
+// ContentFilterBlockReasons are the block reasons about the content of the prompt itself
+var ContentFilterBlockReasons = map[string]bool{
+	"SAFETY":             true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"IMAGE_SAFETY":       true,
+}
+
+var SafetyThresholds = map[string]bool{
+	"BLOCK_NONE":             true,
+	"BLOCK_ONLY_HIGH":        true,
+	"BLOCK_MEDIUM_AND_ABOVE": true,
+	"BLOCK_LOW_AND_ABOVE":    true,
+}
+
+// TokenizerModel is what local token estimates are based on when gemini does not report
+// usageMetadata, gemini models have no tiktoken encoding so o200k_base is used instead, it
+// splits CJK and other non-English text far closer to gemini than cl100k_base does
+const TokenizerModel = "gpt-4o"
+
+// https://ai.google.dev/gemini-api/docs/models/gemini
+// ModelMaxOutputTokens and ModelMaxCandidates are keyed by model name prefix, the longest
+// matching prefix wins so that e.g. gemini-pro-vision is not taken for gemini-pro
+var ModelMaxOutputTokens = map[string]int{
+	"gemini-pro":                    2048,
+	"gemini-1.0-pro":                2048,
+	"gemini-pro-vision":             4096,
+	"gemini-1.0-pro-vision":         4096,
+	"gemini-1.5-pro":                8192,
+	"gemini-1.5-flash":              8192,
+	"gemini-2.0-flash":              8192,
+	"gemini-2.0-flash-thinking-exp": 65536,
+	"gemini-2.5-pro":                65536,
+	"gemini-2.5-flash":              65536,
+}
+
+var ModelMaxCandidates = map[string]int{
+	"gemini-pro":                    1,
+	"gemini-1.0-pro":                1,
+	"gemini-1.5-pro":                8,
+	"gemini-1.5-flash":              8,
+	"gemini-2.0-flash":              8,
+	"gemini-2.0-flash-thinking-exp": 1,
+	"gemini-2.5-pro":                8,
+	"gemini-2.5-flash":              8,
+}
+
+// PenaltyRange is what a model accepts for presencePenalty and frequencyPenalty,
+// the zero value stands for a model that accepts no penalty at all
+type PenaltyRange struct {
+	Min float64
+	Max float64
+}
+
+func (r PenaltyRange) clamp(penalty float64) float64 {
+	if penalty < r.Min {
+		return r.Min
+	}
+	if penalty > r.Max {
+		return r.Max
+	}
+	return penalty
+}
+
+// StructuredOutputModels take responseMimeType and responseSchema, keyed by model name prefix
+// like ModelMaxOutputTokens, gemini 1.0 and the thinking experiment answer in free text only
+var StructuredOutputModels = map[string]bool{
+	"gemini-1.5":                    true,
+	"gemini-2.0-flash":              true,
+	"gemini-2.0-flash-thinking-exp": false,
+	"gemini-2.0-pro":                true,
+	"gemini-2.5":                    true,
+}
+
+// LegacyModels are keyed by model name prefix like ModelMaxOutputTokens, they predate the system
+// instruction, seed and logprobs, every other model gets those sent as they are
+var LegacyModels = map[string]bool{
+	"gemini-1.0": true,
+	"gemini-pro": true,
+	"gemma":      true,
+}
+
+// ModelPenaltyRanges is keyed by model name prefix like ModelMaxOutputTokens,
+// models that are not listed get no penalties
+var ModelPenaltyRanges = map[string]PenaltyRange{
+	"gemini-1.5-pro":                {Min: MinPenalty, Max: MaxPenalty},
+	"gemini-1.5-flash":              {Min: MinPenalty, Max: MaxPenalty},
+	"gemini-2.0-flash":              {Min: MinPenalty, Max: MaxPenalty},
+	"gemini-2.0-flash-thinking-exp": {},
+	"gemini-2.5-flash":              {Min: MinPenalty, Max: MaxPenalty},
+}
+
+// MaxEmbeddingBatchSize is how many inputs batchEmbedContents takes in one call
+const MaxEmbeddingBatchSize = 100
+
+// DynamicThinkingBudget lets the model pick the budget from the complexity of the request
+const DynamicThinkingBudget = -1
+
+// ThinkingBudgetRange is the budget a thinking model accepts besides DynamicThinkingBudget,
+// 0 turns thinking off on the models that allow it
+type ThinkingBudgetRange struct {
+	Min        int
+	Max        int
+	CanDisable bool
+}
+
+// https://ai.google.dev/gemini-api/docs/thinking#set-budget
+// ModelThinkingBudgets is keyed by model name prefix like ModelMaxOutputTokens,
+// models that are not listed take no thinkingConfig
+var ModelThinkingBudgets = map[string]ThinkingBudgetRange{
+	"gemini-2.5-pro":        {Min: 128, Max: 32768},
+	"gemini-2.5-flash":      {Min: 1, Max: 24576, CanDisable: true},
+	"gemini-2.5-flash-lite": {Min: 512, Max: 24576, CanDisable: true},
+}
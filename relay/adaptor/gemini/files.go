@@ -0,0 +1,261 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+const (
+	// an uploaded file is not referenced any more when it is about to expire, a long generation
+	// must not outlive the file it reads
+	fileExpiryMargin = 10 * time.Minute
+	// gemini deletes uploaded files after 48 hours, used when the upload does not say
+	fileDefaultTTL = 48 * time.Hour
+	// videos are processed after the upload, the request waits this long for them at most
+	fileProcessingTimeout = 2 * time.Minute
+)
+
+// fileStatePollInterval is a variable so that tests do not have to wait for real
+var fileStatePollInterval = time.Second
+
+// https://ai.google.dev/api/files#File
+type File struct {
+	Name           string    `json:"name,omitempty"`
+	DisplayName    string    `json:"displayName,omitempty"`
+	MimeType       string    `json:"mimeType,omitempty"`
+	SizeBytes      string    `json:"sizeBytes,omitempty"`
+	Uri            string    `json:"uri,omitempty"`
+	State          string    `json:"state,omitempty"`
+	ExpirationTime time.Time `json:"expirationTime,omitempty"`
+	Error          *Error    `json:"error,omitempty"`
+}
+
+type FileResponse struct {
+	File  *File  `json:"file,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+type uploadedFileEntry struct {
+	Uri       string
+	MimeType  string
+	ExpiresAt time.Time
+}
+
+var (
+	uploadedFilesLock  sync.Mutex
+	uploadedFilesStore = make(map[string]*uploadedFileEntry)
+)
+
+// mediaSizeLimit is the largest media accepted given its inline limit in MB, with
+// GEMINI_FILE_UPLOAD_ENABLED larger media is uploaded to the files API instead of being refused
+func mediaSizeLimit(inlineLimit int) int64 {
+	if config.GeminiFileUploadEnabled && config.GeminiMaxUploadSize > inlineLimit {
+		inlineLimit = config.GeminiMaxUploadSize
+	}
+	return int64(inlineLimit) * 1024 * 1024
+}
+
+// inlineSizeLimit is the size above which media is uploaded rather than sent inline
+func inlineSizeLimit(mimeType string) int64 {
+	limit := config.GeminiMaxImageSize
+	switch {
+	case strings.HasPrefix(mimeType, "audio/"):
+		limit = config.GeminiMaxAudioSize
+	case strings.HasPrefix(mimeType, "video/"):
+		limit = config.GeminiMaxVideoSize
+	}
+	return int64(limit) * 1024 * 1024
+}
+
+// uploadLargeMedia swaps every inline media part above its inline limit for a fileData reference
+// to the same media in the files API. A channel uploads the same media once, later requests
+// reuse the file until gemini is about to delete it.
+func uploadLargeMedia(ctx context.Context, meta *meta.Meta, request *ChatRequest) error {
+	if !config.GeminiFileUploadEnabled || meta == nil {
+		return nil
+	}
+	contents := request.Contents
+	if request.SystemInstruction != nil {
+		contents = append([]ChatContent{*request.SystemInstruction}, contents...)
+	}
+	for _, content := range contents {
+		for i := range content.Parts {
+			part := &content.Parts[i]
+			if part.InlineData == nil || int64(base64.StdEncoding.DecodedLen(len(part.InlineData.Data))) <= inlineSizeLimit(part.InlineData.MimeType) {
+				continue
+			}
+			fileData, err := getUploadedFile(ctx, meta, part.InlineData)
+			if err != nil {
+				return fmt.Errorf("upload %s to the gemini files API failed: %w", part.InlineData.MimeType, err)
+			}
+			part.InlineData = nil
+			part.FileData = fileData
+		}
+	}
+	return nil
+}
+
+// getUploadedFile returns a reference to the media in the files API, uploading it unless the
+// channel has done so before. The media is decoded on the fly, once for its hash and once more
+// for the upload, rather than held in memory a second time.
+func getUploadedFile(ctx context.Context, meta *meta.Meta, inlineData *InlineData) (*FileData, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, base64.NewDecoder(base64.StdEncoding, strings.NewReader(inlineData.Data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: media is not valid base64", model.ErrInvalidRequest)
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	fileKey := fmt.Sprintf("%d|%s", meta.ChannelId, digest)
+
+	now := time.Now()
+	uploadedFilesLock.Lock()
+	entry, ok := uploadedFilesStore[fileKey]
+	uploadedFilesLock.Unlock()
+	if ok && now.Add(fileExpiryMargin).Before(entry.ExpiresAt) {
+		return &FileData{MimeType: entry.MimeType, FileUri: entry.Uri}, nil
+	}
+
+	media := base64.NewDecoder(base64.StdEncoding, strings.NewReader(inlineData.Data))
+	file, err := uploadFile(ctx, meta, media, size, inlineData.MimeType, "one-api-"+digest[:16])
+	if err != nil {
+		return nil, err
+	}
+	entry = &uploadedFileEntry{Uri: file.Uri, MimeType: inlineData.MimeType, ExpiresAt: file.ExpirationTime}
+	if entry.ExpiresAt.IsZero() {
+		entry.ExpiresAt = now.Add(fileDefaultTTL)
+	}
+	uploadedFilesLock.Lock()
+	// files gemini has deleted are of no use any more, forget them along the way
+	for key, uploaded := range uploadedFilesStore {
+		if !now.Before(uploaded.ExpiresAt) {
+			delete(uploadedFilesStore, key)
+		}
+	}
+	uploadedFilesStore[fileKey] = entry
+	uploadedFilesLock.Unlock()
+	logger.Debugf(ctx, "uploaded %d bytes of %s to gemini as %s", size, inlineData.MimeType, file.Name)
+	return &FileData{MimeType: entry.MimeType, FileUri: entry.Uri}, nil
+}
+
+// uploadFile runs gemini's resumable upload in one go, streaming size bytes of media, and waits
+// until the file can be used
+// https://ai.google.dev/api/files#method:-media.upload
+func uploadFile(ctx context.Context, meta *meta.Meta, media io.Reader, size int64, mimeType string, displayName string) (*File, error) {
+	metadata, err := json.Marshal(map[string]any{"file": File{DisplayName: displayName}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/upload/v1beta/files", meta.BaseURL), bytes.NewReader(metadata))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", meta.APIKey)
+	req.Header.Set("X-Goog-Upload-Protocol", "resumable")
+	req.Header.Set("X-Goog-Upload-Command", "start")
+	req.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("X-Goog-Upload-Header-Content-Type", mimeType)
+	resp, err := client.GeminiHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	uploadURL := resp.Header.Get("X-Goog-Upload-URL")
+	if resp.StatusCode != http.StatusOK || uploadURL == "" {
+		return nil, fmt.Errorf("start upload failed, status code: %d", resp.StatusCode)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, media)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-goog-api-key", meta.APIKey)
+	req.Header.Set("X-Goog-Upload-Offset", "0")
+	req.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+	file, err := doFileRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(fileProcessingTimeout)
+	for file.State == "PROCESSING" {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is still processing after %s", file.Name, fileProcessingTimeout)
+		}
+		timer := time.NewTimer(fileStatePollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1beta/%s", meta.BaseURL, file.Name), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-goog-api-key", meta.APIKey)
+		file, err = doFileRequest(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if file.State == "FAILED" {
+		message := "processing failed"
+		if file.Error != nil {
+			message = file.Error.Message
+		}
+		return nil, fmt.Errorf("%s: %s", file.Name, message)
+	}
+	return file, nil
+}
+
+// doFileRequest sends a request of the files API, the upload answers with the file wrapped
+// in {"file": ...} while files.get answers with the bare file
+func doFileRequest(req *http.Request) (*File, error) {
+	resp, err := client.GeminiHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var fileResponse FileResponse
+	err = json.Unmarshal(body, &fileResponse)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal file failed, status code: %d: %w", resp.StatusCode, err)
+	}
+	if fileResponse.Error != nil {
+		return nil, fmt.Errorf("%s", errorGemini2OpenAI(fileResponse.Error, resp.StatusCode).Message)
+	}
+	file := fileResponse.File
+	if file == nil {
+		file = &File{}
+		if err = json.Unmarshal(body, file); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK || file.Uri == "" {
+		return nil, fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	return file, nil
+}
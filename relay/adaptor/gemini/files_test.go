@@ -0,0 +1,119 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadLargeMedia(t *testing.T) {
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+	defer func(enabled bool, videoSize int, interval time.Duration) {
+		config.GeminiFileUploadEnabled, config.GeminiMaxVideoSize, fileStatePollInterval = enabled, videoSize, interval
+	}(config.GeminiFileUploadEnabled, config.GeminiMaxVideoSize, fileStatePollInterval)
+	config.GeminiFileUploadEnabled, config.GeminiMaxVideoSize, fileStatePollInterval = true, 1, time.Millisecond
+	uploadedFilesLock.Lock()
+	uploadedFilesStore = make(map[string]*uploadedFileEntry)
+	uploadedFilesLock.Unlock()
+
+	video := []byte(strings.Repeat("v", 1024*1024+1))
+	uploads, polls := 0, 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "key", r.Header.Get("x-goog-api-key"))
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/v1beta/files":
+			assert.Equal(t, "start", r.Header.Get("X-Goog-Upload-Command"))
+			assert.Equal(t, "video/mp4", r.Header.Get("X-Goog-Upload-Header-Content-Type"))
+			assert.Equal(t, "1048577", r.Header.Get("X-Goog-Upload-Header-Content-Length"))
+			w.Header().Set("X-Goog-Upload-URL", server.URL+"/upload/session/1?key=key")
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/session/1":
+			uploads++
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, video, body)
+			assert.Equal(t, "upload, finalize", r.Header.Get("X-Goog-Upload-Command"))
+			_, _ = w.Write([]byte(`{"file": {"name": "files/abc", "mimeType": "video/mp4", "uri": "` + server.URL + `/v1beta/files/abc", "state": "PROCESSING"}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1beta/files/abc":
+			polls++
+			state := "PROCESSING"
+			if polls > 1 {
+				state = "ACTIVE"
+			}
+			_, _ = w.Write([]byte(`{"name": "files/abc", "mimeType": "video/mp4", "uri": "` + server.URL + `/v1beta/files/abc", "state": "` + state + `"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	convert := func(channelId int, data []byte) *ChatRequest {
+		c, _ := newTestContext()
+		relayMeta := &meta.Meta{Mode: relaymode.ChatCompletions, ChannelId: channelId, BaseURL: server.URL, APIKey: "key", ActualModelName: "gemini-1.5-pro"}
+		adaptor := &Adaptor{}
+		adaptor.Init(relayMeta)
+		geminiRequest, err := adaptor.ConvertRequest(c, relaymode.ChatCompletions, &model.GeneralOpenAIRequest{
+			Model: "gemini-1.5-pro",
+			Messages: []model.Message{{Role: "user", Content: []any{
+				map[string]any{"type": "text", "text": "Summarize the clip"},
+				map[string]any{"type": "video_url", "video_url": map[string]any{
+					"url": "data:video/mp4;base64," + base64.StdEncoding.EncodeToString(data), "start_offset": 5.0,
+				}},
+			}}},
+		})
+		require.NoError(t, err)
+		return geminiRequest.(*ChatRequest)
+	}
+
+	// oversized media goes through the files API once the file is active
+	parts := convert(1, video).Contents[0].Parts
+	require.Len(t, parts, 2)
+	assert.Nil(t, parts[1].InlineData)
+	require.NotNil(t, parts[1].FileData)
+	assert.Equal(t, server.URL+"/v1beta/files/abc", parts[1].FileData.FileUri)
+	assert.Equal(t, "video/mp4", parts[1].FileData.MimeType)
+	assert.Equal(t, &VideoMetadata{StartOffset: "5s"}, parts[1].VideoMetadata)
+	assert.Equal(t, 1, uploads)
+	assert.Equal(t, 2, polls)
+
+	// the channel reuses the file
+	parts = convert(1, video).Contents[0].Parts
+	assert.Equal(t, server.URL+"/v1beta/files/abc", parts[1].FileData.FileUri)
+	assert.Equal(t, 1, uploads)
+
+	// files of one API key are not visible to another channel
+	convert(2, video)
+	assert.Equal(t, 2, uploads)
+
+	// media within the inline limit stays inline
+	parts = convert(1, []byte("small")).Contents[0].Parts
+	require.NotNil(t, parts[1].InlineData)
+	assert.Nil(t, parts[1].FileData)
+	assert.Equal(t, 2, uploads)
+}
+
+func TestMediaSizeLimit(t *testing.T) {
+	defer func(enabled bool, size int) {
+		config.GeminiFileUploadEnabled, config.GeminiMaxUploadSize = enabled, size
+	}(config.GeminiFileUploadEnabled, config.GeminiMaxUploadSize)
+	config.GeminiFileUploadEnabled, config.GeminiMaxUploadSize = false, 100
+	assert.Equal(t, int64(20*1024*1024), mediaSizeLimit(20))
+	config.GeminiFileUploadEnabled = true
+	assert.Equal(t, int64(100*1024*1024), mediaSizeLimit(20))
+	// an upload limit below the inline limit never shrinks what is accepted inline
+	assert.Equal(t, int64(200*1024*1024), mediaSizeLimit(200))
+}
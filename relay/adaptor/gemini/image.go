@@ -0,0 +1,143 @@
+package gemini
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/model"
+	"golang.org/x/sync/errgroup"
+)
+
+// https://ai.google.dev/gemini-api/docs/vision#technical-details-image
+var SupportedImageMimeTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+	"image/heic": true,
+}
+
+var dataURLPattern = regexp.MustCompile(`^data:([^;,]+);base64,(.*)$`)
+
+// ImageFetchConcurrency bounds how many images of one request are downloaded at the same time
+const ImageFetchConcurrency = 4
+
+func maxImageSize() int64 {
+	return mediaSizeLimit(config.GeminiMaxImageSize)
+}
+
+// fetchImageAsInlineData turns an image_url (a data URL or a remote http(s) URL) into
+// inline data gemini accepts, problems with the image itself are reported as ErrInvalidRequest
+func fetchImageAsInlineData(ctx context.Context, url string) (*InlineData, error) {
+	if matches := dataURLPattern.FindStringSubmatch(url); matches != nil {
+		mimeType, data := strings.ToLower(matches[1]), matches[2]
+		if !SupportedImageMimeTypes[mimeType] {
+			return nil, fmt.Errorf("%w: unsupported image type %s", model.ErrInvalidRequest, mimeType)
+		}
+		if int64(base64.StdEncoding.DecodedLen(len(data))) > maxImageSize() {
+			return nil, fmt.Errorf("%w: image exceeds the %d MB limit", model.ErrInvalidRequest, maxImageSize()>>20)
+		}
+		return &InlineData{MimeType: mimeType, Data: data}, nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("%w: image url must be a data url or an http(s) url", model.ErrInvalidRequest)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.UserContentRequestTimeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid image url: %s", model.ErrInvalidRequest, err.Error())
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("one-api/%s", common.Version))
+	resp, err := client.UserContentRequestHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to fetch image: %s", model.ErrInvalidRequest, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: failed to fetch image, status code: %d", model.ErrInvalidRequest, resp.StatusCode)
+	}
+	if resp.ContentLength > maxImageSize() {
+		return nil, fmt.Errorf("%w: image exceeds the %d MB limit", model.ErrInvalidRequest, maxImageSize()>>20)
+	}
+	// read one byte more than allowed to tell a body of exactly the limit from a larger one
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize()+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read image: %s", model.ErrInvalidRequest, err.Error())
+	}
+	if int64(len(body)) > maxImageSize() {
+		return nil, fmt.Errorf("%w: image exceeds the %d MB limit", model.ErrInvalidRequest, maxImageSize()>>20)
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !SupportedImageMimeTypes[mimeType] {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(body))
+	}
+	if !SupportedImageMimeTypes[mimeType] {
+		return nil, fmt.Errorf("%w: unsupported image type %s", model.ErrInvalidRequest, mimeType)
+	}
+	return &InlineData{
+		MimeType: mimeType,
+		Data:     base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+// collectImageURLs lists the image urls ConvertRequest sends to gemini, in the order it meets them
+func collectImageURLs(messages []model.Message) []string {
+	var urls []string
+	for _, message := range messages {
+		imageNum := 0
+		for _, part := range message.ParseContent() {
+			if part.Type != model.ContentTypeImageURL {
+				continue
+			}
+			imageNum += 1
+			if imageNum > VisionMaxImageNum {
+				continue
+			}
+			urls = append(urls, part.ImageURL.Url)
+		}
+	}
+	return urls
+}
+
+// fetchImagesAsInlineData fetches the images concurrently, the result keeps the order of urls.
+// The first failure, like the client going away, cancels the fetches still running and names the
+// image that failed.
+func fetchImagesAsInlineData(ctx context.Context, urls []string) ([]*InlineData, error) {
+	inlineData := make([]*InlineData, len(urls))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(ImageFetchConcurrency)
+	for i, url := range urls {
+		i, url := i, url
+		group.Go(func() error {
+			data, err := fetchImageAsInlineData(ctx, url)
+			if err != nil {
+				return fmt.Errorf("image %d (%s): %w", i+1, describeImageURL(url), err)
+			}
+			inlineData[i] = data
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return inlineData, nil
+}
+
+// describeImageURL keeps error messages short, a data url is not worth repeating back
+func describeImageURL(url string) string {
+	if strings.HasPrefix(url, "data:") {
+		return "data url"
+	}
+	return url
+}
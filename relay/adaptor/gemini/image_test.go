@@ -0,0 +1,158 @@
+package gemini
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestFetchImageAsInlineData(t *testing.T) {
+	if client.UserContentRequestHTTPClient == nil {
+		client.UserContentRequestHTTPClient = http.DefaultClient
+		defer func() { client.UserContentRequestHTTPClient = nil }()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("User-Agent"), "one-api/")
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(pngHeader)
+		case "/unlabelled":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(pngHeader)
+		case "/image.gif":
+			w.Header().Set("Content-Type", "image/gif")
+			_, _ = w.Write([]byte("GIF89a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	inlineData, err := fetchImageAsInlineData(context.Background(), server.URL+"/image.png")
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", inlineData.MimeType)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(pngHeader), inlineData.Data)
+
+	inlineData, err = fetchImageAsInlineData(context.Background(), server.URL+"/unlabelled")
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", inlineData.MimeType)
+
+	inlineData, err = fetchImageAsInlineData(context.Background(), "data:image/jpeg;base64,/9j/4AAQ")
+	require.NoError(t, err)
+	assert.Equal(t, &InlineData{MimeType: "image/jpeg", Data: "/9j/4AAQ"}, inlineData)
+
+	for _, url := range []string{
+		server.URL + "/image.gif",
+		server.URL + "/missing.png",
+		"data:image/gif;base64,R0lGODlh",
+		"ftp://example.com/image.png",
+	} {
+		_, err = fetchImageAsInlineData(context.Background(), url)
+		assert.ErrorIs(t, err, model.ErrInvalidRequest, url)
+	}
+
+	defer func(maxImageSize int) { config.GeminiMaxImageSize = maxImageSize }(config.GeminiMaxImageSize)
+	config.GeminiMaxImageSize = 0
+	_, err = fetchImageAsInlineData(context.Background(), server.URL+"/image.png")
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.ErrorContains(t, err, "limit")
+}
+
+func TestConvertRequestFetchesImagesConcurrently(t *testing.T) {
+	if client.UserContentRequestHTTPClient == nil {
+		client.UserContentRequestHTTPClient = http.DefaultClient
+		defer func() { client.UserContentRequestHTTPClient = nil }()
+	}
+	slowStarted := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/first.png", "/second.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(pngHeader)
+		case "/slow.png":
+			// only returns once the failing fetch has cancelled it
+			slowStarted <- struct{}{}
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(10 * time.Second):
+			}
+		case "/missing.png":
+			// fail only once the slow fetch is in flight, there is nothing to cancel otherwise
+			select {
+			case <-slowStarted:
+			case <-time.After(5 * time.Second):
+			}
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	newRequest := func(paths ...string) model.GeneralOpenAIRequest {
+		var content []any
+		for _, path := range paths {
+			content = append(content, map[string]any{"type": "image_url", "image_url": map[string]any{"url": server.URL + path}})
+		}
+		return model.GeneralOpenAIRequest{
+			Model:    "gemini-1.5-flash",
+			Messages: []model.Message{{Role: "user", Content: content}},
+		}
+	}
+
+	geminiRequest, err := ConvertRequest(context.Background(), newRequest("/first.png", "/second.png"))
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents[0].Parts, 2)
+	for _, part := range geminiRequest.Contents[0].Parts {
+		require.NotNil(t, part.InlineData)
+		assert.Equal(t, "image/png", part.InlineData.MimeType)
+	}
+
+	start := time.Now()
+	_, err = ConvertRequest(context.Background(), newRequest("/first.png", "/slow.png", "/missing.png"))
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.ErrorContains(t, err, "image 3 ("+server.URL+"/missing.png)")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow fetch was not cancelled")
+	}
+	assert.Eventually(t, func() bool {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return !strings.Contains(stacks, "gemini.fetchImagesAsInlineData.func")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the client going away cancels the fetches too
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-slowStarted
+		cancel()
+	}()
+	start = time.Now()
+	_, err = ConvertRequest(ctx, newRequest("/first.png", "/slow.png"))
+	assert.ErrorContains(t, err, context.Canceled.Error())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow fetch was not cancelled")
+	}
+}
@@ -2,21 +2,29 @@ package gemini
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/songquanpeng/one-api/common/render"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/songquanpeng/one-api/common"
 	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
 	"github.com/songquanpeng/one-api/common/helper"
-	"github.com/songquanpeng/one-api/common/image"
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/common/random"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/constant"
+	"github.com/songquanpeng/one-api/relay/constant/finishreason"
+	"github.com/songquanpeng/one-api/relay/constant/role"
 	"github.com/songquanpeng/one-api/relay/model"
 
 	"github.com/gin-gonic/gin"
@@ -26,36 +34,67 @@ import (
 
 const (
 	VisionMaxImageNum = 16
+	MaxStopSequences  = 5
+	// gemini 1.5 rejects penalties outside of [-2.0, 2.0)
+	MinPenalty = -2.0
+	MaxPenalty = 1.99
+	// gemini returns at most this many alternatives per token
+	MaxTopLogprobs = 20
+	// a single SSE line may carry a whole candidate (e.g. inline images),
+	// which easily exceeds bufio.Scanner's 64KB default
+	streamMaxLineSize = 16 * 1024 * 1024
 )
 
-// Setting safety to the lowest possible values since Gemini is already powerless enough
-func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
+// ConvertRequest turns an OpenAI chat request into a gemini one, the safety settings come from
+// GEMINI_SAFETY_SETTING and the channel may override them afterwards
+func ConvertRequest(ctx context.Context, textRequest model.GeneralOpenAIRequest) (*ChatRequest, error) {
+	if err := checkConversationLength(textRequest.Messages); err != nil {
+		return nil, err
+	}
+	if len(textRequest.LogitBias) > 0 {
+		if config.GeminiLogitBiasStrict {
+			return nil, fmt.Errorf("%w: logit_bias is not supported by gemini", model.ErrInvalidRequest)
+		}
+		logger.SysLogf("logit_bias is not supported by gemini, dropped %d biased tokens", len(textRequest.LogitBias))
+	}
 	geminiRequest := ChatRequest{
-		Contents: make([]ChatContent, 0, len(textRequest.Messages)),
-		SafetySettings: []ChatSafetySettings{
-			{
-				Category:  "HARM_CATEGORY_HARASSMENT",
-				Threshold: config.GeminiSafetySetting,
-			},
-			{
-				Category:  "HARM_CATEGORY_HATE_SPEECH",
-				Threshold: config.GeminiSafetySetting,
-			},
-			{
-				Category:  "HARM_CATEGORY_SEXUALLY_EXPLICIT",
-				Threshold: config.GeminiSafetySetting,
-			},
-			{
-				Category:  "HARM_CATEGORY_DANGEROUS_CONTENT",
-				Threshold: config.GeminiSafetySetting,
-			},
-		},
+		Contents:       make([]ChatContent, 0, len(textRequest.Messages)),
+		SafetySettings: getSafetySettings(config.GeminiSafetySetting),
 		GenerationConfig: ChatGenerationConfig{
-			Temperature:     textRequest.Temperature,
-			TopP:            textRequest.TopP,
-			MaxOutputTokens: textRequest.MaxTokens,
+			Temperature:        textRequest.Temperature,
+			TopP:               textRequest.TopP,
+			TopK:               textRequest.TopK,
+			CandidateCount:     clampCandidateCount(textRequest.N, textRequest.Model),
+			StopSequences:      convertStopSequences(textRequest.Stop),
+			ResponseModalities: getResponseModalities(textRequest),
 		},
 	}
+	// left unset, gemini falls back to the output limit of the model
+	if textRequest.MaxTokens > 0 {
+		geminiRequest.GenerationConfig.MaxOutputTokens = clampMaxOutputTokens(textRequest.MaxTokens, textRequest.Model)
+	}
+	if err := clampSamplingParameters(&geminiRequest.GenerationConfig, textRequest.Model); err != nil {
+		return nil, err
+	}
+	setPenalties(&geminiRequest.GenerationConfig, textRequest.Model, textRequest.PresencePenalty, textRequest.FrequencyPenalty)
+	if textRequest.ThinkingBudget != nil {
+		thinkingConfig, err := getThinkingConfig(textRequest.Model, *textRequest.ThinkingBudget)
+		if err != nil {
+			return nil, err
+		}
+		geminiRequest.GenerationConfig.ThinkingConfig = thinkingConfig
+	}
+	if textRequest.Seed != 0 && isSeedSupported(textRequest.Model) {
+		geminiRequest.GenerationConfig.Seed = int(textRequest.Seed)
+	}
+	if textRequest.Logprobs {
+		setLogprobs(&geminiRequest.GenerationConfig, textRequest.Model, textRequest.TopLogprobs)
+	}
+	if textRequest.ResponseFormat != nil {
+		if err := setResponseFormat(&geminiRequest.GenerationConfig, textRequest.Model, textRequest.ResponseFormat); err != nil {
+			return nil, err
+		}
+	}
 	if textRequest.Tools != nil {
 		functions := make([]model.Function, 0, len(textRequest.Tools))
 		for _, tool := range textRequest.Tools {
@@ -73,15 +112,26 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 			},
 		}
 	}
+	if geminiRequest.Tools != nil {
+		geminiRequest.ToolConfig = convertToolChoice(textRequest.ToolChoice)
+	}
+	if textRequest.WebSearchOptions != nil {
+		if searchTool := getSearchTool(textRequest.Model); searchTool != nil {
+			geminiRequest.Tools = append(geminiRequest.Tools, *searchTool)
+		}
+	}
+	useSystemInstruction := isSystemInstructionSupported(textRequest.Model)
 	shouldAddDummyModelMessage := false
+	images, err := fetchImagesAsInlineData(ctx, collectImageURLs(textRequest.Messages))
+	if err != nil {
+		return nil, err
+	}
+	imageIndex := 0
+	// tool results only carry the id of the call they answer, gemini wants the function name
+	toolCallNames := make(map[string]string)
 	for _, message := range textRequest.Messages {
 		content := ChatContent{
 			Role: message.Role,
-			Parts: []Part{
-				{
-					Text: message.StringContent(),
-				},
-			},
 		}
 		openaiContent := message.ParseContent()
 		var parts []Part
@@ -96,26 +146,64 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 				if imageNum > VisionMaxImageNum {
 					continue
 				}
-				mimeType, data, _ := image.GetImageFromUrl(part.ImageURL.Url)
 				parts = append(parts, Part{
-					InlineData: &InlineData{
-						MimeType: mimeType,
-						Data:     data,
-					},
+					InlineData: images[imageIndex],
+				})
+				imageIndex++
+			} else if part.Type == model.ContentTypeInputAudio {
+				inlineData, err := convertInputAudio(part.InputAudio)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, Part{
+					InlineData: inlineData,
 				})
+			} else if part.Type == model.ContentTypeVideoURL {
+				videoPart, err := convertVideoURL(part.VideoURL)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, *videoPart)
+			}
+		}
+		if message.Role == role.Tool {
+			functionResponse, err := convertToolResult(message, toolCallNames)
+			if err != nil {
+				return nil, err
+			}
+			parts = []Part{{FunctionResponse: functionResponse}}
+		}
+		for _, toolCall := range message.ToolCalls {
+			toolCallNames[toolCall.Id] = toolCall.Function.Name
+			var args any
+			if argString, ok := toolCall.Function.Arguments.(string); ok {
+				if err := json.Unmarshal([]byte(argString), &args); err != nil {
+					return nil, fmt.Errorf("invalid arguments for tool call %s: %w", toolCall.Id, err)
+				}
+			} else {
+				args = toolCall.Function.Arguments
 			}
+			parts = append(parts, Part{
+				FunctionCall: &FunctionCall{
+					FunctionName: toolCall.Function.Name,
+					Arguments:    args,
+				},
+			})
 		}
 		content.Parts = parts
 
-		// there's no assistant role in gemini and API shall vomit if Role is not user or model
-		if content.Role == "assistant" {
-			content.Role = "model"
+		if content.Role == role.System && useSystemInstruction {
+			if geminiRequest.SystemInstruction == nil {
+				geminiRequest.SystemInstruction = &ChatContent{}
+			}
+			geminiRequest.SystemInstruction.Parts = append(geminiRequest.SystemInstruction.Parts, parts...)
+			continue
 		}
-		// Converting system prompt to prompt from user for the same reason
-		if content.Role == "system" {
-			content.Role = "user"
+		// Converting system prompt to prompt from user, see convertRole
+		if content.Role == role.System {
 			shouldAddDummyModelMessage = true
 		}
+		content.Role = convertRole(content.Role)
 		geminiRequest.Contents = append(geminiRequest.Contents, content)
 
 		// If a system message is the last message, we need to add a dummy model message to make gemini happy
@@ -131,12 +219,502 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 			shouldAddDummyModelMessage = false
 		}
 	}
+	if geminiRequest.SystemInstruction != nil {
+		geminiRequest.SystemInstruction.Parts = joinTextParts(geminiRequest.SystemInstruction.Parts)
+	}
+	geminiRequest.Contents = mergeConsecutiveContents(geminiRequest.Contents)
+	// gemini answers an empty contents with an opaque error, system prompts alone don't count
+	if len(geminiRequest.Contents) == 0 {
+		return nil, fmt.Errorf("%w: messages must not be empty", model.ErrInvalidRequest)
+	}
+
+	return &geminiRequest, nil
+}
+
+// checkConversationLength refuses conversations above GEMINI_MAX_MESSAGES messages or
+// GEMINI_MAX_PROMPT_TOKENS prompt tokens before anything is sent upstream
+func checkConversationLength(messages []model.Message) error {
+	if config.GeminiMaxMessages > 0 && len(messages) > config.GeminiMaxMessages {
+		return fmt.Errorf("%w: conversation has %d messages, at most %d are allowed",
+			model.ErrInvalidRequest, len(messages), config.GeminiMaxMessages)
+	}
+	if config.GeminiMaxPromptTokens <= 0 {
+		return nil
+	}
+	// only the text counts, media is limited by its size
+	promptTokens := 0
+	for _, message := range messages {
+		promptTokens += openai.CountTokenText(message.StringContent(), TokenizerModel)
+		if promptTokens > config.GeminiMaxPromptTokens {
+			return fmt.Errorf("%w: prompt exceeds the limit of %d tokens",
+				model.ErrInvalidRequest, config.GeminiMaxPromptTokens)
+		}
+	}
+	return nil
+}
+
+// mergeConsecutiveContents folds adjacent turns of the same role into one,
+// gemini insists on user and model taking turns
+func mergeConsecutiveContents(contents []ChatContent) []ChatContent {
+	merged := make([]ChatContent, 0, len(contents))
+	for _, content := range contents {
+		if last := len(merged) - 1; last >= 0 && merged[last].Role == content.Role {
+			merged[last].Parts = append(merged[last].Parts, content.Parts...)
+			continue
+		}
+		merged = append(merged, content)
+	}
+	return merged
+}
+
+// joinTextParts folds the text of all system messages into one part in their original order,
+// separated by newlines so that instructions split over several messages do not run together
+func joinTextParts(parts []Part) []Part {
+	var texts []string
+	joined := make([]Part, 0, len(parts))
+	for _, part := range parts {
+		if part.Text != "" && part.InlineData == nil && part.FileData == nil {
+			texts = append(texts, part.Text)
+			continue
+		}
+		joined = append(joined, part)
+	}
+	if len(texts) == 0 {
+		return joined
+	}
+	return append([]Part{{Text: strings.Join(texts, "\n")}}, joined...)
+}
+
+// https://ai.google.dev/gemini-api/docs/function-calling#function_calling_modes
+func convertToolChoice(toolChoice any) *ChatToolConfig {
+	switch choice := toolChoice.(type) {
+	case string:
+		switch choice {
+		case "none":
+			return &ChatToolConfig{FunctionCallingConfig: FunctionCallingConfig{Mode: "NONE"}}
+		case "required":
+			return &ChatToolConfig{FunctionCallingConfig: FunctionCallingConfig{Mode: "ANY"}}
+		case "auto":
+			return &ChatToolConfig{FunctionCallingConfig: FunctionCallingConfig{Mode: "AUTO"}}
+		}
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return &ChatToolConfig{FunctionCallingConfig: FunctionCallingConfig{
+					Mode:                 "ANY",
+					AllowedFunctionNames: []string{name},
+				}}
+			}
+		}
+	}
+	return nil
+}
+
+// convertStopSequences accepts both the string and the array form of OpenAI's stop parameter
+func convertStopSequences(stop any) []string {
+	var stopSequences []string
+	switch stop := stop.(type) {
+	case string:
+		if stop != "" {
+			stopSequences = []string{stop}
+		}
+	case []string:
+		stopSequences = stop
+	case []any:
+		for _, item := range stop {
+			if str, ok := item.(string); ok && str != "" {
+				stopSequences = append(stopSequences, str)
+			}
+		}
+	}
+	if len(stopSequences) > MaxStopSequences {
+		logger.SysErrorf("gemini accepts at most %d stop sequences, got %d, the rest are dropped", MaxStopSequences, len(stopSequences))
+		stopSequences = stopSequences[:MaxStopSequences]
+	}
+	return stopSequences
+}
+
+// ValidateSafetySetting checks GEMINI_SAFETY_SETTING and the safety_setting of channels
+func ValidateSafetySetting(threshold string) error {
+	if !SafetyThresholds[threshold] {
+		return fmt.Errorf("invalid gemini safety setting %q, must be one of BLOCK_NONE, BLOCK_ONLY_HIGH, BLOCK_MEDIUM_AND_ABOVE and BLOCK_LOW_AND_ABOVE", threshold)
+	}
+	return nil
+}
+
+func getSafetySettings(threshold string) []ChatSafetySettings {
+	if err := ValidateSafetySetting(threshold); err != nil {
+		logger.SysErrorf("%s, using %s instead", err.Error(), FallbackSafetyThreshold)
+		threshold = FallbackSafetyThreshold
+	}
+	safetySettings := make([]ChatSafetySettings, 0, len(SafetyCategories))
+	for _, category := range SafetyCategories {
+		safetySettings = append(safetySettings, ChatSafetySettings{
+			Category:  category,
+			Threshold: threshold,
+		})
+	}
+	return safetySettings
+}
+
+// isSystemInstructionSupported reports whether the model accepts a dedicated system
+// instruction, older models only get the system prompt folded into a user turn
+func isSystemInstructionSupported(modelName string) bool {
+	return !isLegacyModel(modelName)
+}
+
+func isLegacyModel(modelName string) bool {
+	legacy, _ := lookupByPrefix(LegacyModels, modelName)
+	return legacy
+}
+
+// https://ai.google.dev/gemini-api/docs/json-mode
+func setResponseFormat(generationConfig *ChatGenerationConfig, modelName string, responseFormat *model.ResponseFormat) error {
+	if responseFormat.Type != "json_object" && responseFormat.Type != "json_schema" {
+		return nil
+	}
+	if !isStructuredOutputSupported(modelName) {
+		logger.SysLogf("model %s does not support structured output, ignoring response_format %s", modelName, responseFormat.Type)
+		return nil
+	}
+	generationConfig.ResponseMimeType = "application/json"
+	if responseFormat.Type == "json_schema" && responseFormat.JsonSchema != nil && responseFormat.JsonSchema.Schema != nil {
+		strict := responseFormat.JsonSchema.Strict != nil && *responseFormat.JsonSchema.Strict
+		responseSchema, err := convertResponseSchema(responseFormat.JsonSchema.Schema, strict, "$")
+		if err != nil {
+			return fmt.Errorf("%w: response_format.json_schema %s", model.ErrInvalidRequest, err.Error())
+		}
+		generationConfig.ResponseSchema = responseSchema
+	}
+	return nil
+}
+
+func isStructuredOutputSupported(modelName string) bool {
+	supported, _ := lookupByPrefix(StructuredOutputModels, modelName)
+	return supported
+}
+
+// ignoredSchemaKeywords carry no constraint gemini could enforce, they are dropped even in strict
+// mode, additionalProperties is always false there as OpenAI requires it for strict schemas
+var ignoredSchemaKeywords = map[string]bool{
+	"$schema":              true,
+	"$id":                  true,
+	"$comment":             true,
+	"title":                true,
+	"default":              true,
+	"examples":             true,
+	"additionalProperties": true,
+}
+
+// convertResponseSchema turns a JSON schema into the OpenAPI subset gemini understands. Keywords
+// gemini does not know about (e.g. patternProperties, $ref) are dropped, unless the client asked
+// for strict mode, then they are rejected since gemini would not honour them.
+func convertResponseSchema(schema map[string]any, strict bool, path string) (map[string]any, error) {
+	result := make(map[string]any)
+	for key, value := range schema {
+		switch key {
+		case "type":
+			switch schemaType := value.(type) {
+			case string:
+				result["type"] = strings.ToUpper(schemaType)
+			case []any:
+				// ["string", "null"] is expressed as a nullable string
+				for _, item := range schemaType {
+					if str, ok := item.(string); ok {
+						if str == "null" {
+							result["nullable"] = true
+						} else {
+							result["type"] = strings.ToUpper(str)
+						}
+					}
+				}
+			}
+		case "format", "description", "nullable", "enum", "required":
+			result[key] = value
+		case "items":
+			if items, ok := value.(map[string]any); ok {
+				convertedItems, err := convertResponseSchema(items, strict, path+"[]")
+				if err != nil {
+					return nil, err
+				}
+				result[key] = convertedItems
+			}
+		case "properties":
+			if properties, ok := value.(map[string]any); ok {
+				convertedProperties := make(map[string]any, len(properties))
+				for name, property := range properties {
+					if property, ok := property.(map[string]any); ok {
+						convertedProperty, err := convertResponseSchema(property, strict, path+"."+name)
+						if err != nil {
+							return nil, err
+						}
+						convertedProperties[name] = convertedProperty
+					}
+				}
+				result[key] = convertedProperties
+			}
+		default:
+			if strict && !ignoredSchemaKeywords[key] {
+				return nil, fmt.Errorf("%s: keyword %q is not supported by gemini", path, key)
+			}
+		}
+	}
+	return result, nil
+}
+
+// getMaxTemperature returns the highest temperature the model accepts,
+// gemini 1.0 models stop at 1.0 while later ones go up to 2.0 like OpenAI
+func getMaxTemperature(modelName string) float64 {
+	if strings.HasPrefix(modelName, "gemini-1.0") || strings.HasPrefix(modelName, "gemini-pro") {
+		return 1.0
+	}
+	return 2.0
+}
+
+// lookupByPrefix looks the model up in a table keyed by name prefix, the longest matching prefix wins
+func lookupByPrefix[T any](table map[string]T, modelName string) (value T, ok bool) {
+	matched := 0
+	for prefix, v := range table {
+		if strings.HasPrefix(modelName, prefix) && len(prefix) > matched {
+			value, ok, matched = v, true, len(prefix)
+		}
+	}
+	return value, ok
+}
+
+// getModelLimit is lookupByPrefix for tables of limits, 0 when the model is unknown
+func getModelLimit(limits map[string]int, modelName string) int {
+	modelLimit, _ := lookupByPrefix(limits, modelName)
+	return modelLimit
+}
+
+// clampMaxOutputTokens keeps max_tokens within the output limit of the model, gemini answers
+// 400 otherwise, models without a known limit get max_tokens as is
+func clampMaxOutputTokens(maxTokens int, modelName string) int {
+	maxOutputTokens := getModelLimit(ModelMaxOutputTokens, modelName)
+	if maxOutputTokens > 0 && maxTokens > maxOutputTokens {
+		logger.SysLogf("max_tokens %d exceeds the output limit of %s, clamped to %d", maxTokens, modelName, maxOutputTokens)
+		return maxOutputTokens
+	}
+	return maxTokens
+}
+
+// clampCandidateCount does the same for n, most models only ever return a single candidate
+func clampCandidateCount(n int, modelName string) int {
+	maxCandidates := getModelLimit(ModelMaxCandidates, modelName)
+	if maxCandidates > 0 && n > maxCandidates {
+		logger.SysLogf("n %d exceeds the candidate limit of %s, clamped to %d", n, modelName, maxCandidates)
+		return maxCandidates
+	}
+	return n
+}
+
+// clampSamplingParameters brings temperature and topP into the range gemini accepts instead of
+// letting upstream answer 400, negative values make no sense and are rejected. Parameters the
+// client left out stay nil so that gemini applies the model's own default rather than 0
+func clampSamplingParameters(generationConfig *ChatGenerationConfig, modelName string) error {
+	if temperature := generationConfig.Temperature; temperature != nil {
+		if *temperature < 0 {
+			return fmt.Errorf("%w: temperature must not be negative", model.ErrInvalidRequest)
+		}
+		if maxTemperature := getMaxTemperature(modelName); *temperature > maxTemperature {
+			logger.SysLogf("temperature %.2f exceeds the maximum of %s, clamped to %.1f", *temperature, modelName, maxTemperature)
+			generationConfig.Temperature = &maxTemperature
+		}
+	}
+	if topP := generationConfig.TopP; topP != nil {
+		if *topP < 0 {
+			return fmt.Errorf("%w: top_p must not be negative", model.ErrInvalidRequest)
+		}
+		if *topP > 1 {
+			logger.SysLogf("top_p %.2f exceeds the maximum of %s, clamped to 1.0", *topP, modelName)
+			maxTopP := 1.0
+			generationConfig.TopP = &maxTopP
+		}
+	}
+	return nil
+}
+
+// isBetaAPIRequired reports whether the model is only fully usable through v1beta
+func isBetaAPIRequired(modelName string) bool {
+	return strings.HasPrefix(modelName, "gemini-1.5") || strings.HasPrefix(modelName, "gemini-2")
+}
+
+// stripBetaFeatures drops what the stable v1 API refuses, the system instruction is folded
+// into the conversation the way older models get it
+func stripBetaFeatures(geminiRequest *ChatRequest) {
+	if geminiRequest.SystemInstruction != nil {
+		geminiRequest.Contents = append([]ChatContent{
+			{Role: "user", Parts: geminiRequest.SystemInstruction.Parts},
+			{Role: "model", Parts: []Part{{Text: "Okay"}}},
+		}, geminiRequest.Contents...)
+		geminiRequest.SystemInstruction = nil
+	}
+	if geminiRequest.Tools != nil {
+		logger.SysLog("tools are not supported by gemini api v1, dropped, use v1beta to enable them")
+		geminiRequest.Tools = nil
+		geminiRequest.ToolConfig = nil
+	}
+	if geminiRequest.GenerationConfig.ResponseMimeType != "" {
+		logger.SysLog("response_format is not supported by gemini api v1, dropped, use v1beta to enable it")
+		geminiRequest.GenerationConfig.ResponseMimeType = ""
+		geminiRequest.GenerationConfig.ResponseSchema = nil
+	}
+	if geminiRequest.GenerationConfig.ResponseModalities != nil {
+		logger.SysLog("image output is not supported by gemini api v1, dropped, use v1beta to enable it")
+		geminiRequest.GenerationConfig.ResponseModalities = nil
+	}
+	if geminiRequest.GenerationConfig.ThinkingConfig != nil {
+		logger.SysLog("thinking_budget is not supported by gemini api v1, dropped, use v1beta to enable it")
+		geminiRequest.GenerationConfig.ThinkingConfig = nil
+	}
+}
+
+// getResponseModalities asks for image output when the client lists "image" in modalities
+// or picks an image generation model (e.g. gemini-2.0-flash-exp-image-generation)
+func getResponseModalities(textRequest model.GeneralOpenAIRequest) []string {
+	imageRequested := strings.Contains(textRequest.Model, "image-generation")
+	for _, modality := range textRequest.Modalities {
+		if strings.EqualFold(modality, "image") {
+			imageRequested = true
+		}
+	}
+	if !imageRequested {
+		return nil
+	}
+	return []string{"TEXT", "IMAGE"}
+}
+
+// getSearchTool returns the tool grounding the answer on google search, requested through
+// web_search_options, gemini 1.5 calls it google_search_retrieval and gemini 2 google_search
+// https://ai.google.dev/gemini-api/docs/grounding
+func getSearchTool(modelName string) *ChatTools {
+	if strings.HasPrefix(modelName, "gemini-1.5") {
+		return &ChatTools{GoogleSearchRetrieval: &GoogleSearchRetrieval{}}
+	}
+	if strings.HasPrefix(modelName, "gemini-2") {
+		return &ChatTools{GoogleSearch: &GoogleSearch{}}
+	}
+	logger.SysLogf("model %s does not support google search, ignoring web_search_options", modelName)
+	return nil
+}
+
+// getPenaltyRange returns the penalty range of the model, ok is false for models that answer 400
+// when presencePenalty or frequencyPenalty is present
+func getPenaltyRange(modelName string) (penaltyRange PenaltyRange, ok bool) {
+	penaltyRange, _ = lookupByPrefix(ModelPenaltyRanges, modelName)
+	return penaltyRange, penaltyRange.Max > penaltyRange.Min
+}
 
-	return &geminiRequest
+// setPenalties forwards presence_penalty and frequency_penalty clamped to the range of the model
+func setPenalties(generationConfig *ChatGenerationConfig, modelName string, presencePenalty float64, frequencyPenalty float64) {
+	if presencePenalty == 0 && frequencyPenalty == 0 {
+		return
+	}
+	penaltyRange, ok := getPenaltyRange(modelName)
+	if !ok {
+		logger.Debugf(context.Background(), "penalties are not supported by %s, dropped", modelName)
+		return
+	}
+	generationConfig.PresencePenalty = penaltyRange.clamp(presencePenalty)
+	generationConfig.FrequencyPenalty = penaltyRange.clamp(frequencyPenalty)
 }
 
-func ConvertEmbeddingRequest(request model.GeneralOpenAIRequest) *BatchEmbeddingRequest {
+// getThinkingConfig checks thinking_budget against the range of the model, models that don't
+// think or don't let the budget be set get no thinkingConfig
+func getThinkingConfig(modelName string, thinkingBudget int) (*ThinkingConfig, error) {
+	budgetRange, ok := lookupByPrefix(ModelThinkingBudgets, modelName)
+	if !ok {
+		logger.SysLogf("thinking_budget is not supported by %s, ignored", modelName)
+		return nil, nil
+	}
+	switch {
+	case thinkingBudget == DynamicThinkingBudget:
+	case thinkingBudget == 0:
+		if !budgetRange.CanDisable {
+			return nil, fmt.Errorf("%w: thinking can not be disabled for %s", model.ErrInvalidRequest, modelName)
+		}
+	case thinkingBudget < budgetRange.Min || thinkingBudget > budgetRange.Max:
+		return nil, fmt.Errorf("%w: thinking_budget of %s must be between %d and %d, got %d",
+			model.ErrInvalidRequest, modelName, budgetRange.Min, budgetRange.Max, thinkingBudget)
+	}
+	return &ThinkingConfig{ThinkingBudget: thinkingBudget}, nil
+}
+
+// isSeedSupported reports whether the model accepts a sampling seed
+func isSeedSupported(modelName string) bool {
+	return !isLegacyModel(modelName)
+}
+
+func isLogprobsSupported(modelName string) bool {
+	return !isLegacyModel(modelName)
+}
+
+func setLogprobs(cfg *ChatGenerationConfig, modelName string, topLogprobs int) {
+	if !isLogprobsSupported(modelName) {
+		logger.SysLogf("logprobs is not supported by %s, ignored", modelName)
+		return
+	}
+	cfg.ResponseLogprobs = true
+	if topLogprobs > MaxTopLogprobs {
+		topLogprobs = MaxTopLogprobs
+	}
+	if topLogprobs > 0 {
+		cfg.Logprobs = topLogprobs
+	}
+}
+
+// GetConvertedRequestBody serializes the gemini request built for the current relay,
+// the original body has been consumed by then, so use this whenever it must be sent again
+func GetConvertedRequestBody(c *gin.Context) ([]byte, error) {
+	convertedRequest, ok := c.Get(ctxkey.ConvertedRequest)
+	if !ok {
+		return nil, errors.New("converted request not found")
+	}
+	return json.Marshal(convertedRequest)
+}
+
+// convertToolResult turns a tool message into the functionResponse gemini expects, the function is
+// looked up by tool_call_id among the calls of earlier assistant turns
+func convertToolResult(message model.Message, toolCallNames map[string]string) (*FunctionResponse, error) {
+	name, ok := toolCallNames[message.ToolCallId]
+	if !ok && message.Name != nil {
+		name = *message.Name
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: tool message references unknown tool_call_id %q", model.ErrInvalidRequest, message.ToolCallId)
+	}
+	// the response has to be a JSON object, anything else is wrapped
+	result := message.StringContent()
+	var response map[string]any
+	if err := json.Unmarshal([]byte(result), &response); err != nil || response == nil {
+		response = map[string]any{"content": result}
+	}
+	return &FunctionResponse{
+		Name:     name,
+		Response: response,
+	}, nil
+}
+
+// there's no assistant role in gemini and API shall vomit if Role is not user or model,
+// so system, tool and function messages are all sent as user turns
+func convertRole(openaiRole string) string {
+	if openaiRole == role.Assistant {
+		return "model"
+	}
+	return "user"
+}
+
+// ConvertEmbeddingRequest maps every input to one request of batchEmbedContents, which keeps the
+// order so that the embeddings can be matched back to the inputs by index
+func ConvertEmbeddingRequest(request model.GeneralOpenAIRequest) (*BatchEmbeddingRequest, error) {
 	inputs := request.ParseInput()
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%w: input must not be empty", model.ErrInvalidRequest)
+	}
+	if len(inputs) > MaxEmbeddingBatchSize {
+		return nil, fmt.Errorf("%w: gemini embeds at most %d inputs per request, got %d", model.ErrInvalidRequest, MaxEmbeddingBatchSize, len(inputs))
+	}
 	requests := make([]EmbeddingRequest, len(inputs))
 	model := fmt.Sprintf("models/%s", request.Model)
 
@@ -150,195 +728,1122 @@ func ConvertEmbeddingRequest(request model.GeneralOpenAIRequest) *BatchEmbedding
 					},
 				},
 			},
+			OutputDimensionality: request.Dimensions,
 		}
 	}
 
 	return &BatchEmbeddingRequest{
 		Requests: requests,
-	}
+	}, nil
 }
 
 type ChatResponse struct {
 	Candidates     []ChatCandidate    `json:"candidates"`
 	PromptFeedback ChatPromptFeedback `json:"promptFeedback"`
+	UsageMetadata  *UsageMetadata     `json:"usageMetadata,omitempty"`
+	ModelVersion   string             `json:"modelVersion,omitempty"`
+	// only set on a stream that fails after it has started
+	Error *Error `json:"error,omitempty"`
+}
+
+// responseModel prefers the exact version gemini reports having served over the requested name
+func (g *ChatResponse) responseModel(modelName string) string {
+	if g.ModelVersion != "" {
+		return g.ModelVersion
+	}
+	return modelName
+}
+
+type UsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount,omitempty"` // part of promptTokenCount
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount,omitempty"`      // not part of candidatesTokenCount
+}
+
+// ToUsage bills thinking as completion tokens, gemini charges them at the output rate
+func (u *UsageMetadata) ToUsage() model.Usage {
+	usage := model.Usage{
+		PromptTokens:     u.PromptTokenCount,
+		CompletionTokens: u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		TotalTokens:      u.TotalTokenCount,
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	if u.CachedContentTokenCount > 0 {
+		usage.PromptTokensDetails = &model.PromptTokensDetails{CachedTokens: u.CachedContentTokenCount}
+	}
+	return usage
+}
+
+// candidateIndex returns the index gemini assigned to the i-th candidate, the field is
+// omitted when zero, so the loop position is only used when no candidate carries one
+func (g *ChatResponse) candidateIndex(i int) int {
+	for _, candidate := range g.Candidates {
+		if candidate.Index != 0 {
+			return int(g.Candidates[i].Index)
+		}
+	}
+	return i
 }
 
 func (g *ChatResponse) GetResponseText() string {
 	if g == nil {
 		return ""
 	}
-	if len(g.Candidates) > 0 && len(g.Candidates[0].Content.Parts) > 0 {
-		return g.Candidates[0].Content.Parts[0].Text
+	if len(g.Candidates) > 0 {
+		return g.Candidates[0].GetReasoning() + g.Candidates[0].GetText()
 	}
 	return ""
 }
 
 type ChatCandidate struct {
-	Content       ChatContent        `json:"content"`
-	FinishReason  string             `json:"finishReason"`
-	Index         int64              `json:"index"`
-	SafetyRatings []ChatSafetyRating `json:"safetyRatings"`
+	Content           ChatContent        `json:"content"`
+	FinishReason      string             `json:"finishReason"`
+	FinishMessage     string             `json:"finishMessage,omitempty"`
+	Index             int64              `json:"index"`
+	SafetyRatings     []ChatSafetyRating `json:"safetyRatings"`
+	CitationMetadata  *CitationMetadata  `json:"citationMetadata,omitempty"`
+	GroundingMetadata *GroundingMetadata `json:"groundingMetadata,omitempty"`
+	AvgLogprobs       float64            `json:"avgLogprobs,omitempty"`
+	LogprobsResult    *LogprobsResult    `json:"logprobsResult,omitempty"`
+}
+
+// https://ai.google.dev/api/generate-content#LogprobsResult
+type LogprobsResult struct {
+	TopCandidates    []LogprobsTopCandidates `json:"topCandidates"`
+	ChosenCandidates []LogprobsCandidate     `json:"chosenCandidates"`
+}
+
+type LogprobsTopCandidates struct {
+	Candidates []LogprobsCandidate `json:"candidates"`
+}
+
+type LogprobsCandidate struct {
+	Token          string  `json:"token"`
+	TokenId        int     `json:"tokenId"`
+	LogProbability float64 `json:"logProbability"`
+}
+
+// getLogprobs maps the chosen tokens and their alternatives to the OpenAI layout,
+// topCandidates[i] holds the alternatives of chosenCandidates[i]
+func (c *ChatCandidate) getLogprobs() *openai.Logprobs {
+	if c.LogprobsResult == nil {
+		return nil
+	}
+	logprobs := &openai.Logprobs{
+		Content: make([]openai.TokenLogprob, 0, len(c.LogprobsResult.ChosenCandidates)),
+	}
+	for i, chosen := range c.LogprobsResult.ChosenCandidates {
+		tokenLogprob := openai.TokenLogprob{
+			Token:       chosen.Token,
+			Logprob:     chosen.LogProbability,
+			Bytes:       tokenBytes(chosen.Token),
+			TopLogprobs: []openai.TopLogprob{},
+		}
+		if i < len(c.LogprobsResult.TopCandidates) {
+			for _, candidate := range c.LogprobsResult.TopCandidates[i].Candidates {
+				tokenLogprob.TopLogprobs = append(tokenLogprob.TopLogprobs, openai.TopLogprob{
+					Token:   candidate.Token,
+					Logprob: candidate.LogProbability,
+					Bytes:   tokenBytes(candidate.Token),
+				})
+			}
+		}
+		logprobs.Content = append(logprobs.Content, tokenLogprob)
+	}
+	return logprobs
+}
+
+func tokenBytes(token string) []int {
+	bytes := make([]int, 0, len(token))
+	for _, b := range []byte(token) {
+		bytes = append(bytes, int(b))
+	}
+	return bytes
+}
+
+// https://ai.google.dev/api/generate-content#citationmetadata
+type CitationMetadata struct {
+	CitationSources []CitationSource `json:"citationSources"`
+}
+
+type CitationSource struct {
+	StartIndex int    `json:"startIndex,omitempty"`
+	EndIndex   int    `json:"endIndex,omitempty"`
+	URI        string `json:"uri,omitempty"`
+	License    string `json:"license,omitempty"`
+}
+
+// getCitations returns the sources gemini quoted, only when config.GeminiCitationsEnabled is on
+// as clients strictly following the OpenAI schema may choke on the extra field
+func (c *ChatCandidate) getCitations() []openai.Citation {
+	if !config.GeminiCitationsEnabled || c.CitationMetadata == nil {
+		return nil
+	}
+	citations := make([]openai.Citation, 0, len(c.CitationMetadata.CitationSources))
+	for _, source := range c.CitationMetadata.CitationSources {
+		citations = append(citations, openai.Citation{
+			StartIndex: source.StartIndex,
+			EndIndex:   source.EndIndex,
+			URL:        source.URI,
+			License:    source.License,
+		})
+	}
+	return citations
+}
+
+// https://ai.google.dev/api/generate-content#GroundingMetadata
+type GroundingMetadata struct {
+	WebSearchQueries  []string           `json:"webSearchQueries,omitempty"`
+	GroundingChunks   []GroundingChunk   `json:"groundingChunks,omitempty"`
+	GroundingSupports []GroundingSupport `json:"groundingSupports,omitempty"`
+}
+
+type GroundingChunk struct {
+	Web *GroundingChunkWeb `json:"web,omitempty"`
+}
+
+type GroundingChunkWeb struct {
+	URI   string `json:"uri"`
+	Title string `json:"title,omitempty"`
+}
+
+type GroundingSupport struct {
+	Segment               GroundingSegment `json:"segment"`
+	GroundingChunkIndices []int            `json:"groundingChunkIndices"`
+}
+
+type GroundingSegment struct {
+	StartIndex int    `json:"startIndex,omitempty"`
+	EndIndex   int    `json:"endIndex,omitempty"`
+	Text       string `json:"text,omitempty"`
+}
+
+// getAnnotations maps the search results backing the answer to OpenAI url_citation annotations,
+// one per supported segment and source, the offsets are gemini's, counted in bytes
+func (c *ChatCandidate) getAnnotations() []model.Annotation {
+	if c.GroundingMetadata == nil {
+		return nil
+	}
+	var annotations []model.Annotation
+	for _, support := range c.GroundingMetadata.GroundingSupports {
+		for _, chunkIndex := range support.GroundingChunkIndices {
+			if chunkIndex < 0 || chunkIndex >= len(c.GroundingMetadata.GroundingChunks) {
+				continue
+			}
+			web := c.GroundingMetadata.GroundingChunks[chunkIndex].Web
+			if web == nil {
+				continue
+			}
+			annotations = append(annotations, model.Annotation{
+				Type: model.AnnotationTypeURLCitation,
+				URLCitation: &model.URLCitation{
+					StartIndex: support.Segment.StartIndex,
+					EndIndex:   support.Segment.EndIndex,
+					Title:      web.Title,
+					URL:        web.URI,
+				},
+			})
+		}
+	}
+	return annotations
+}
+
+// getSafetyRatings returns how gemini graded the candidate, only when config.GeminiSafetyRatingsEnabled
+// is on, for the same reason as getCitations
+func (c *ChatCandidate) getSafetyRatings() []openai.SafetyRating {
+	if !config.GeminiSafetyRatingsEnabled || len(c.SafetyRatings) == 0 {
+		return nil
+	}
+	ratings := make([]openai.SafetyRating, 0, len(c.SafetyRatings))
+	for _, rating := range c.SafetyRatings {
+		ratings = append(ratings, openai.SafetyRating{
+			Category:    rating.Category,
+			Probability: rating.Probability,
+			Blocked:     rating.Blocked,
+		})
+	}
+	return ratings
+}
+
+// getAvgLogprob returns the mean log probability of the candidate's tokens, a cheap confidence
+// signal gemini reports even without logprobs, only when config.GeminiAvgLogprobsEnabled is on
+func (c *ChatCandidate) getAvgLogprob() *float64 {
+	if !config.GeminiAvgLogprobsEnabled || c.AvgLogprobs == 0 {
+		return nil
+	}
+	avgLogprob := c.AvgLogprobs
+	return &avgLogprob
+}
+
+// getFinishMessage returns gemini's explanation of why the candidate stopped early, a regular
+// stop needs no explanation and any message that comes with it is left out
+func (c *ChatCandidate) getFinishMessage() string {
+	if c.FinishReason == "" || c.FinishReason == "STOP" {
+		return ""
+	}
+	return c.FinishMessage
+}
+
+// GetText joins the text of all parts, long answers are often split over several of them
+func (c *ChatCandidate) GetText() string {
+	var builder strings.Builder
+	for _, part := range c.Content.Parts {
+		if !part.Thought {
+			builder.WriteString(part.Text)
+		}
+	}
+	return builder.String()
+}
+
+// GetContent returns the answer as plain text, or as a list of text and image_url items
+// when gemini generated images, those are passed on as data URLs
+func (c *ChatCandidate) GetContent() any {
+	hasImage := false
+	for _, part := range c.Content.Parts {
+		if part.InlineData != nil {
+			hasImage = true
+			break
+		}
+	}
+	if !hasImage {
+		return c.GetText()
+	}
+	contents := make([]model.MessageContent, 0, len(c.Content.Parts))
+	for _, part := range c.Content.Parts {
+		switch {
+		case part.Thought:
+		case part.InlineData != nil:
+			contents = append(contents, model.MessageContent{
+				Type: model.ContentTypeImageURL,
+				ImageURL: &model.ImageURL{
+					Url: fmt.Sprintf("data:%s;base64,%s", part.InlineData.MimeType, part.InlineData.Data),
+				},
+			})
+		case part.Text != "":
+			contents = append(contents, model.MessageContent{
+				Type: model.ContentTypeText,
+				Text: part.Text,
+			})
+		}
+	}
+	return contents
+}
+
+// GetReasoning joins the thought parts thinking models (e.g. gemini-2.0-flash-thinking-exp)
+// send ahead of the answer, it is empty when config.GeminiReasoningContentEnabled is off
+func (c *ChatCandidate) GetReasoning() string {
+	if !config.GeminiReasoningContentEnabled {
+		return ""
+	}
+	var builder strings.Builder
+	for _, part := range c.Content.Parts {
+		if part.Thought {
+			builder.WriteString(part.Text)
+		}
+	}
+	return builder.String()
 }
 
 type ChatSafetyRating struct {
 	Category    string `json:"category"`
 	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
 }
 
 type ChatPromptFeedback struct {
+	BlockReason   string             `json:"blockReason,omitempty"`
 	SafetyRatings []ChatSafetyRating `json:"safetyRatings"`
 }
 
-func getToolCalls(candidate *ChatCandidate) []model.Tool {
-	var toolCalls []model.Tool
+// blockedCategory returns the safety category that caused the prompt to be blocked,
+// falling back to the first rating that is not NEGLIGIBLE
+func (f *ChatPromptFeedback) blockedCategory() string {
+	for _, rating := range f.SafetyRatings {
+		if rating.Blocked {
+			return rating.Category
+		}
+	}
+	for _, rating := range f.SafetyRatings {
+		if rating.Probability != "" && rating.Probability != "NEGLIGIBLE" {
+			return rating.Category
+		}
+	}
+	return ""
+}
 
-	item := candidate.Content.Parts[0]
-	if item.FunctionCall == nil {
-		return toolCalls
+// https://ai.google.dev/api/generate-content#BlockReason
+func promptBlockedError(feedback *ChatPromptFeedback) *model.ErrorWithStatusCode {
+	message := fmt.Sprintf("prompt was blocked by gemini, block reason: %s", feedback.BlockReason)
+	// OTHER and reasons gemini may add later say nothing about the content, the client gets a plain invalid request
+	code := "invalid_request"
+	if ContentFilterBlockReasons[feedback.BlockReason] {
+		code = finishreason.ContentFilter
+		if category := feedback.blockedCategory(); category != "" {
+			message += fmt.Sprintf(", category: %s", category)
+		}
 	}
-	argsBytes, err := json.Marshal(item.FunctionCall.Arguments)
-	if err != nil {
-		logger.FatalLog("getToolCalls failed: " + err.Error())
-		return toolCalls
-	}
-	toolCall := model.Tool{
-		Id:   fmt.Sprintf("call_%s", random.GetUUID()),
-		Type: "function",
-		Function: model.Function{
-			Arguments: string(argsBytes),
-			Name:      item.FunctionCall.FunctionName,
+	return &model.ErrorWithStatusCode{
+		Error: model.Error{
+			Message: message,
+			Type:    "invalid_request_error",
+			Param:   "prompt",
+			Code:    code,
 		},
+		StatusCode: http.StatusBadRequest,
+		Billed:     true,
+	}
+}
+
+// RecitationFinishReason is reported instead of content_filter when GEMINI_RECITATION_FINISH_REASON_ENABLED
+// is set, so clients can tell a recitation stop, which keeps the partial text, from a safety block
+const RecitationFinishReason = "recitation"
+
+// https://ai.google.dev/api/generate-content#FinishReason
+func finishReasonGemini2OpenAI(reason string) string {
+	switch reason {
+	case "STOP":
+		return finishreason.Stop
+	case "MAX_TOKENS":
+		return finishreason.Length
+	case "RECITATION":
+		if config.GeminiRecitationFinishReasonEnabled {
+			return RecitationFinishReason
+		}
+		return finishreason.ContentFilter
+	case "SAFETY", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return finishreason.ContentFilter
+	default:
+		return reason
+	}
+}
+
+// getToolCalls collects every functionCall part of the candidate, wherever it sits among the text parts
+func getToolCalls(candidate *ChatCandidate) []model.Tool {
+	var toolCalls []model.Tool
+	for _, part := range candidate.Content.Parts {
+		if part.FunctionCall == nil {
+			continue
+		}
+		argsBytes, err := json.Marshal(part.FunctionCall.Arguments)
+		if err != nil {
+			logger.SysError("getToolCalls failed: " + err.Error())
+			continue
+		}
+		toolCalls = append(toolCalls, model.Tool{
+			Id:   fmt.Sprintf("call_%s", random.GetUUID()),
+			Type: "function",
+			Function: model.Function{
+				Arguments: string(argsBytes),
+				Name:      part.FunctionCall.FunctionName,
+			},
+		})
 	}
-	toolCalls = append(toolCalls, toolCall)
 	return toolCalls
 }
 
-func responseGeminiChat2OpenAI(response *ChatResponse) *openai.TextResponse {
+func responseGeminiChat2OpenAI(response *ChatResponse, modelName string) *openai.TextResponse {
 	fullTextResponse := openai.TextResponse{
 		Id:      fmt.Sprintf("chatcmpl-%s", random.GetUUID()),
+		Model:   response.responseModel(modelName),
 		Object:  "chat.completion",
 		Created: helper.GetTimestamp(),
-		Choices: make([]openai.TextResponseChoice, 0, len(response.Candidates)),
+		// modelVersion pins down the exact model build, which is what system_fingerprint stands for
+		SystemFingerprint: response.ModelVersion,
+		Choices:           make([]openai.TextResponseChoice, 0, len(response.Candidates)),
 	}
 	for i, candidate := range response.Candidates {
 		choice := openai.TextResponseChoice{
-			Index: i,
+			Index: response.candidateIndex(i),
 			Message: model.Message{
 				Role: "assistant",
 			},
 			FinishReason: constant.StopFinishReason,
 		}
+		if candidate.FinishReason != "" {
+			choice.FinishReason = finishReasonGemini2OpenAI(candidate.FinishReason)
+		}
 		if len(candidate.Content.Parts) > 0 {
-			if candidate.Content.Parts[0].FunctionCall != nil {
-				choice.Message.ToolCalls = getToolCalls(&candidate)
-			} else {
-				choice.Message.Content = candidate.Content.Parts[0].Text
+			choice.Message.ToolCalls = getToolCalls(&candidate)
+			if len(choice.Message.ToolCalls) > 0 {
+				choice.FinishReason = finishreason.ToolCalls
+			}
+			// gemini may narrate before calling a tool, that text stays the content of the same choice
+			if len(choice.Message.ToolCalls) == 0 || candidate.GetText() != "" {
+				choice.Message.Content = candidate.GetContent()
 			}
+			choice.Message.ReasoningContent = candidate.GetReasoning()
 		} else {
 			choice.Message.Content = ""
-			choice.FinishReason = candidate.FinishReason
 		}
+		choice.Message.Annotations = candidate.getAnnotations()
+		choice.FinishMessage = candidate.getFinishMessage()
+		choice.Citations = candidate.getCitations()
+		choice.SafetyRatings = candidate.getSafetyRatings()
+		choice.Logprobs = candidate.getLogprobs()
+		choice.AvgLogprob = candidate.getAvgLogprob()
 		fullTextResponse.Choices = append(fullTextResponse.Choices, choice)
 	}
 	return &fullTextResponse
 }
 
-func streamResponseGeminiChat2OpenAI(geminiResponse *ChatResponse) *openai.ChatCompletionsStreamResponse {
-	var choice openai.ChatCompletionsStreamResponseChoice
-	choice.Delta.Content = geminiResponse.GetResponseText()
-	//choice.FinishReason = &constant.StopFinishReason
+// streamResponseGeminiChat2OpenAI converts one upstream chunk, id and created
+// are fixed per stream so that every chunk of a completion carries the same values
+func streamResponseGeminiChat2OpenAI(geminiResponse *ChatResponse, id string, created int64, modelName string) *openai.ChatCompletionsStreamResponse {
 	var response openai.ChatCompletionsStreamResponse
-	response.Id = fmt.Sprintf("chatcmpl-%s", random.GetUUID())
-	response.Created = helper.GetTimestamp()
+	response.Id = id
+	response.Created = created
 	response.Object = "chat.completion.chunk"
-	response.Model = "gemini"
-	response.Choices = []openai.ChatCompletionsStreamResponseChoice{choice}
+	response.Model = geminiResponse.responseModel(modelName)
+	response.Choices = make([]openai.ChatCompletionsStreamResponseChoice, 0, len(geminiResponse.Candidates))
+	for i, candidate := range geminiResponse.Candidates {
+		var choice openai.ChatCompletionsStreamResponseChoice
+		choice.Index = geminiResponse.candidateIndex(i)
+		// a terminal chunk may carry no parts at all, it still has to deliver the finish reason
+		choice.Delta.Content = candidate.GetContent()
+		choice.Delta.ReasoningContent = candidate.GetReasoning()
+		if candidate.FinishReason != "" {
+			finishReason := finishReasonGemini2OpenAI(candidate.FinishReason)
+			choice.FinishReason = &finishReason
+		}
+		// gemini streams every functionCall whole, so each tool call is complete in one delta
+		choice.Delta.ToolCalls = getToolCalls(&candidate)
+		for j := range choice.Delta.ToolCalls {
+			index := j
+			choice.Delta.ToolCalls[j].Index = &index
+		}
+		choice.Delta.Annotations = candidate.getAnnotations()
+		choice.FinishMessage = candidate.getFinishMessage()
+		choice.Citations = candidate.getCitations()
+		choice.SafetyRatings = candidate.getSafetyRatings()
+		choice.Logprobs = candidate.getLogprobs()
+		choice.AvgLogprob = candidate.getAvgLogprob()
+		response.Choices = append(response.Choices, choice)
+	}
 	return &response
 }
 
-func embeddingResponseGemini2OpenAI(response *EmbeddingResponse) *openai.EmbeddingResponse {
+// dropEmptyChoices removes the choices of a chunk that carry nothing, gemini sometimes sends
+// parts with an empty text mid-stream and some clients render those as blank messages.
+// Both stream handlers use it, so a fake stream looks like a real one.
+func dropEmptyChoices(response *openai.ChatCompletionsStreamResponse) {
+	choices := response.Choices[:0]
+	for _, choice := range response.Choices {
+		if !isEmptyChoice(&choice) {
+			choices = append(choices, choice)
+		}
+	}
+	response.Choices = choices
+}
+
+// isEmptyChoice checks every field a stream choice can surface, whitespace is content and so is
+// anything ending the choice
+func isEmptyChoice(choice *openai.ChatCompletionsStreamResponseChoice) bool {
+	return choice.FinishReason == nil && choice.FinishMessage == "" &&
+		(choice.Delta.Content == nil || choice.Delta.Content == "") && choice.Delta.ReasoningContent == "" &&
+		len(choice.Delta.ToolCalls) == 0 && len(choice.Delta.Annotations) == 0 && len(choice.Citations) == 0 &&
+		len(choice.SafetyRatings) == 0 && choice.Logprobs == nil && choice.AvgLogprob == nil
+}
+
+// numberToolCalls continues the tool call indexes of every choice across the chunks of a stream,
+// a choice that called tools finishes with tool_calls although gemini says STOP
+func numberToolCalls(response *openai.ChatCompletionsStreamResponse, toolCallCounts map[int]int) {
+	for i := range response.Choices {
+		choice := &response.Choices[i]
+		for j := range choice.Delta.ToolCalls {
+			index := toolCallCounts[choice.Index]
+			choice.Delta.ToolCalls[j].Index = &index
+			toolCallCounts[choice.Index]++
+		}
+		if choice.FinishReason != nil && *choice.FinishReason == constant.StopFinishReason && toolCallCounts[choice.Index] > 0 {
+			finishReason := finishreason.ToolCalls
+			choice.FinishReason = &finishReason
+		}
+	}
+}
+
+// streamedText is what a stream chunk delivered, tool calls included, for the usage estimate
+func streamedText(response *openai.ChatCompletionsStreamResponse) string {
+	var text strings.Builder
+	for _, choice := range response.Choices {
+		text.WriteString(choice.Delta.ReasoningContent + choice.Delta.StringContent())
+		for _, toolCall := range choice.Delta.ToolCalls {
+			arguments, _ := toolCall.Function.Arguments.(string)
+			text.WriteString(toolCall.Function.Name + arguments)
+		}
+	}
+	return text.String()
+}
+
+// embeddingResponseGemini2OpenAI bills the locally counted prompt tokens since gemini does not
+// report usage for embeddings
+func embeddingResponseGemini2OpenAI(response *EmbeddingResponse, promptTokens int, modelName string) *openai.EmbeddingResponse {
 	openAIEmbeddingResponse := openai.EmbeddingResponse{
 		Object: "list",
 		Data:   make([]openai.EmbeddingResponseItem, 0, len(response.Embeddings)),
-		Model:  "gemini-embedding",
-		Usage:  model.Usage{TotalTokens: 0},
+		Model:  modelName,
+		Usage:  model.Usage{PromptTokens: promptTokens, TotalTokens: promptTokens},
 	}
-	for _, item := range response.Embeddings {
+	for i, item := range response.Embeddings {
 		openAIEmbeddingResponse.Data = append(openAIEmbeddingResponse.Data, openai.EmbeddingResponseItem{
 			Object:    `embedding`,
-			Index:     0,
+			Index:     i,
 			Embedding: item.Values,
 		})
 	}
 	return &openAIEmbeddingResponse
 }
 
-func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, string) {
+func StreamHandler(c *gin.Context, resp *http.Response, modelName string, includeUsage bool) (*model.ErrorWithStatusCode, string, *model.Usage) {
+	if resp.StatusCode != http.StatusOK {
+		return ErrorHandler(c, resp, modelName), "", nil
+	}
 	responseText := ""
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Split(bufio.ScanLines)
+	var usage *model.Usage
+	var lastResponse *openai.ChatCompletionsStreamResponse
+	nextChunk := newStreamChunkReader(resp)
+
+	// closing the body is the only way to unblock the reader, do it when the
+	// client goes away or upstream stays silent for too long
+	var closeOnce sync.Once
+	var closeErr error
+	closeBody := func() error {
+		closeOnce.Do(func() {
+			closeErr = resp.Body.Close()
+		})
+		return closeErr
+	}
+	var timedOut atomic.Bool
+	streamTimeout := time.Duration(config.GeminiStreamTimeout) * time.Second
+	watchdog := time.AfterFunc(streamTimeout, func() {
+		timedOut.Store(true)
+		_ = closeBody()
+	})
+	defer watchdog.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			_ = closeBody()
+		case <-done:
+		}
+	}()
 
 	common.SetEventStreamHeaders(c)
 
-	for scanner.Scan() {
-		data := scanner.Text()
-		data = strings.TrimSpace(data)
-		if !strings.HasPrefix(data, "data: ") {
-			continue
+	stopKeepalive := startKeepalive(c, time.Duration(config.GeminiStreamKeepaliveInterval)*time.Second)
+	defer stopKeepalive()
+
+	responseId := fmt.Sprintf("chatcmpl-%s", random.GetUUID())
+	createdTime := helper.GetTimestamp()
+	tooLarge := false
+	finishReason := ""
+	toolCallCounts := make(map[int]int)
+	// what broke the stream before gemini finished it, sent to the client as an error event
+	var streamErr *model.ErrorWithStatusCode
+	for {
+		data, err := nextChunk()
+		if err != nil {
+			if err != io.EOF {
+				logErrorf(c, modelName, "error reading stream: %s", err.Error())
+				streamErr = openai.ErrorWrapper(fmt.Errorf("error reading upstream stream: %w", err), "upstream_stream_error", http.StatusBadGateway)
+			}
+			break
 		}
-		data = strings.TrimPrefix(data, "data: ")
-		data = strings.TrimSuffix(data, "\"")
+		watchdog.Reset(streamTimeout)
+		stopKeepalive()
 
 		var geminiResponse ChatResponse
-		err := json.Unmarshal([]byte(data), &geminiResponse)
+		err = json.Unmarshal(data, &geminiResponse)
 		if err != nil {
-			logger.SysError("error unmarshalling stream response: " + err.Error())
+			logErrorf(c, modelName, "error unmarshalling stream response: %s", err.Error())
 			continue
 		}
+		if geminiResponse.Error != nil {
+			logErrorf(c, modelName, "gemini stream failed, code: %d, status: %s, message: %s", geminiResponse.Error.Code, geminiResponse.Error.Status, geminiResponse.Error.Message)
+			streamErr = embeddedError(geminiResponse.Error)
+			break
+		}
+		for _, candidate := range geminiResponse.Candidates {
+			if candidate.FinishReason != "" {
+				finishReason = candidate.FinishReason
+			}
+		}
+		var chunkUsage *model.Usage
+		if geminiResponse.UsageMetadata != nil {
+			streamUsage := geminiResponse.UsageMetadata.ToUsage()
+			chunkUsage = &streamUsage
+		}
 
-		response := streamResponseGeminiChat2OpenAI(&geminiResponse)
-		if response == nil {
+		response := streamResponseGeminiChat2OpenAI(&geminiResponse, responseId, createdTime, modelName)
+		dropEmptyChoices(response)
+		numberToolCalls(response, toolCallCounts)
+		if len(response.Choices) == 0 {
+			if chunkUsage != nil {
+				usage = chunkUsage
+			}
 			continue
 		}
 
-		responseText += response.Choices[0].Delta.StringContent()
-
+		// only what actually reached the client is billed
+		if c.Request.Context().Err() != nil {
+			break
+		}
+		if lastResponse == nil {
+			response.SystemFingerprint = geminiResponse.ModelVersion
+		}
 		err = render.ObjectData(c, response)
 		if err != nil {
-			logger.SysError(err.Error())
+			logErrorf(c, modelName, "error rendering stream response: %s", err.Error())
+			break
+		}
+		lastResponse = response
+		if chunkUsage != nil {
+			usage = chunkUsage
+		}
+		responseText += streamedText(response)
+		if int64(len(responseText)) > maxResponseSize() {
+			tooLarge = true
+			break
+		}
+	}
+	// the keepalive writer must be gone before anything else is written, the stream may have
+	// ended before its first chunk
+	stopKeepalive()
+
+	if tooLarge {
+		logErrorf(c, modelName, "stream exceeds %d MB, aborting", config.GeminiMaxResponseSize)
+		_ = closeBody()
+		tooLargeErr := openai.ErrorWrapper(fmt.Errorf("upstream response exceeds %d MB", config.GeminiMaxResponseSize), "response_too_large", http.StatusBadGateway)
+		return renderStreamError(c, modelName, tooLargeErr), responseText, usage
+	}
+
+	if timedOut.Load() {
+		logErrorf(c, modelName, "no data received from upstream in %s, aborting stream", streamTimeout)
+		timeoutErr := openai.ErrorWrapper(fmt.Errorf("no data received from upstream in %s", streamTimeout), "upstream_timeout", http.StatusGatewayTimeout)
+		return renderStreamError(c, modelName, timeoutErr), responseText, usage
+	}
+
+	// a read error is expected when the client went away, there is nobody to tell then
+	if streamErr != nil && c.Request.Context().Err() == nil {
+		_ = closeBody()
+		return renderStreamError(c, modelName, streamErr), responseText, usage
+	}
+
+	if usage != nil {
+		warnEarlyTruncation(c, modelName, finishReason, usage.CompletionTokens)
+	}
+
+	if c.Request.Context().Err() != nil {
+		logger.Warnf(c.Request.Context(), "client disconnected from gemini stream of %s, billing delivered content only", modelName)
+	} else {
+		if includeUsage && usage != nil && lastResponse != nil {
+			renderUsage(c, modelName, lastResponse, usage)
+		}
+		render.Done(c)
+	}
+
+	err := closeBody()
+	if err != nil {
+		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), "", nil
+	}
+
+	return nil, responseText, usage
+}
+
+// newStreamChunkReader returns a func yielding the raw JSON of one upstream response at a time,
+// io.EOF marks the end of the stream. With alt=sse gemini sends one response per data line,
+// without it the body is a single JSON array whose elements arrive as they are generated.
+func newStreamChunkReader(resp *http.Response) func() ([]byte, error) {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return newJSONArrayChunkReader(resp.Body)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), streamMaxLineSize)
+	scanner.Split(bufio.ScanLines)
+	return func() ([]byte, error) {
+		for scanner.Scan() {
+			data := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(data, "data: ") {
+				continue
+			}
+			return []byte(strings.TrimPrefix(data, "data: ")), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+func newJSONArrayChunkReader(body io.Reader) func() ([]byte, error) {
+	decoder := json.NewDecoder(body)
+	started := false
+	return func() ([]byte, error) {
+		if !started {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			if delim, ok := token.(json.Delim); !ok || delim != '[' {
+				return nil, fmt.Errorf("expected a JSON array, got %v", token)
+			}
+			started = true
+		}
+		if !decoder.More() {
+			// consume the closing bracket, anything after it is ignored
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err != nil {
+			return nil, err
 		}
+		return data, nil
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		logger.SysError("error reading stream: " + err.Error())
+// startKeepalive writes SSE comments until the returned func is called, so that proxies
+// don't drop the connection while the model is still thinking about its first chunk.
+// The returned func waits for the writer to exit and may be called more than once.
+func startKeepalive(c *gin.Context, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := c.Writer.Write([]byte(": keepalive\n\n"))
+				if err != nil {
+					return
+				}
+				c.Writer.Flush()
+			case <-stop:
+				return
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}()
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() {
+			close(stop)
+			<-exited
+		})
 	}
+}
 
+// renderStreamError hands err back to the caller as long as nothing has been sent, so it goes out
+// as a regular JSON error with its status code. Once the stream has started the status can't be
+// changed any more, so err is sent as a final SSE event followed by [DONE] and nil is returned.
+func renderStreamError(c *gin.Context, modelName string, err *model.ErrorWithStatusCode) *model.ErrorWithStatusCode {
+	if !c.Writer.Written() {
+		for _, header := range []string{"Content-Type", "Cache-Control", "Connection", "Transfer-Encoding", "X-Accel-Buffering"} {
+			c.Writer.Header().Del(header)
+		}
+		return err
+	}
+	renderErr := render.ObjectData(c, gin.H{"error": err.Error})
+	if renderErr != nil {
+		logErrorf(c, modelName, "error rendering stream error: %s", renderErr.Error())
+	}
 	render.Done(c)
+	return nil
+}
+
+// logErrorf tags the log line with the model and the end user the client reported,
+// the request id comes from the request context
+func logErrorf(c *gin.Context, modelName string, format string, a ...any) {
+	tag := modelName
+	if user := c.GetString(ctxkey.EndUser); user != "" {
+		tag += ", user " + user
+	}
+	logger.Errorf(c.Request.Context(), "[gemini %s] %s", tag, fmt.Sprintf(format, a...))
+}
 
-	err := resp.Body.Close()
+// isEarlyTruncation tells whether gemini stopped at MAX_TOKENS well before the max_tokens of the
+// request, which it sometimes does because of internal budgeting. GEMINI_EARLY_TRUNCATION_RATIO sets
+// what "well before" means, 0 turns the check off.
+func isEarlyTruncation(c *gin.Context, finishReason string, completionTokens int) (bool, int) {
+	if config.GeminiEarlyTruncationRatio <= 0 || finishReason != "MAX_TOKENS" {
+		return false, 0
+	}
+	convertedRequest, _ := c.Get(ctxkey.ConvertedRequest)
+	request, ok := convertedRequest.(*ChatRequest)
+	if !ok || request.GenerationConfig.MaxOutputTokens <= 0 {
+		return false, 0
+	}
+	maxTokens := request.GenerationConfig.MaxOutputTokens
+	return float64(completionTokens) < config.GeminiEarlyTruncationRatio*float64(maxTokens), maxTokens
+}
+
+// warnEarlyTruncation only surfaces an early truncation, gemini has no continuation token so the
+// answer can't be resumed, the client still gets finish_reason length and may continue the conversation
+func warnEarlyTruncation(c *gin.Context, modelName string, finishReason string, completionTokens int) {
+	if early, maxTokens := isEarlyTruncation(c, finishReason, completionTokens); early {
+		logger.Warnf(c.Request.Context(), "[gemini %s] stopped at MAX_TOKENS after %d of %d tokens", modelName, completionTokens, maxTokens)
+	}
+}
+
+// renderUsage sends the trailing chunk OpenAI clients get with stream_options.include_usage
+func renderUsage(c *gin.Context, modelName string, lastResponse *openai.ChatCompletionsStreamResponse, usage *model.Usage) {
+	usageResponse := *lastResponse
+	usageResponse.SystemFingerprint = ""
+	usageResponse.Choices = []openai.ChatCompletionsStreamResponseChoice{}
+	usageResponse.Usage = usage
+	err := render.ObjectData(c, usageResponse)
 	if err != nil {
-		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), ""
+		logErrorf(c, modelName, "error rendering stream response: %s", err.Error())
 	}
+}
 
-	return nil, responseText
+// isStreamUnsupported reports whether upstream refused streamGenerateContent for the model,
+// the body is left for the caller to read
+func isStreamUnsupported(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+		return false
+	}
+	geminiError := peekError(resp)
+	return geminiError != nil && strings.Contains(strings.ToLower(geminiError.Message), "streamgeneratecontent")
 }
 
-func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
-	responseBody, err := io.ReadAll(resp.Body)
+// FakeStreamHandler relays a generateContent response to a client that asked for a stream,
+// the whole completion is sent as a single chunk
+func FakeStreamHandler(c *gin.Context, resp *http.Response, modelName string, includeUsage bool) (*model.ErrorWithStatusCode, string, *model.Usage) {
+	if resp.StatusCode != http.StatusOK {
+		return ErrorHandler(c, resp, modelName), "", nil
+	}
+	responseBody, errWithStatusCode := readResponseBody(resp)
+	if errWithStatusCode != nil {
+		return errWithStatusCode, "", nil
+	}
+	var geminiResponse ChatResponse
+	err := json.Unmarshal(responseBody, &geminiResponse)
+	if err != nil {
+		return unmarshalResponseError(c, modelName, err, responseBody), "", nil
+	}
+	if geminiResponse.Error != nil {
+		logErrorf(c, modelName, "gemini answered 200 with an error, code: %d, status: %s, message: %s", geminiResponse.Error.Code, geminiResponse.Error.Status, geminiResponse.Error.Message)
+		return embeddedError(geminiResponse.Error), "", nil
+	}
+	if len(geminiResponse.Candidates) == 0 && geminiResponse.PromptFeedback.BlockReason != "" {
+		return promptBlockedError(&geminiResponse.PromptFeedback), "", blockedPromptUsage(&geminiResponse, 0)
+	}
+	var usage *model.Usage
+	if geminiResponse.UsageMetadata != nil {
+		fakeStreamUsage := geminiResponse.UsageMetadata.ToUsage()
+		usage = &fakeStreamUsage
+	}
+	response := streamResponseGeminiChat2OpenAI(&geminiResponse, fmt.Sprintf("chatcmpl-%s", random.GetUUID()), helper.GetTimestamp(), modelName)
+	response.SystemFingerprint = geminiResponse.ModelVersion
+	dropEmptyChoices(response)
+	numberToolCalls(response, make(map[int]int))
+	responseText := streamedText(response)
+
+	common.SetEventStreamHeaders(c)
+	if len(response.Choices) > 0 {
+		err = render.ObjectData(c, response)
+		if err != nil {
+			logErrorf(c, modelName, "error rendering stream response: %s", err.Error())
+		}
+	}
+	if includeUsage && usage != nil {
+		renderUsage(c, modelName, response, usage)
+	}
+	render.Done(c)
+	return nil, responseText, usage
+}
+
+// https://ai.google.dev/gemini-api/docs/troubleshooting#error-codes
+func errorGemini2OpenAI(geminiError *Error, statusCode int) *model.ErrorWithStatusCode {
+	if isAPIKeyError(geminiError) {
+		return &model.ErrorWithStatusCode{
+			Error: model.Error{
+				Message: geminiError.Message,
+				Type:    "invalid_request_error",
+				Param:   "",
+				Code:    "invalid_api_key",
+			},
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+	var code any = geminiError.Status
+	if geminiError.Status == "" {
+		code = geminiError.Code
+	}
+	message := geminiError.Message
+	if message == "" {
+		message = fmt.Sprintf("bad response status code %d", statusCode)
+	}
+	return &model.ErrorWithStatusCode{
+		Error: model.Error{
+			Message: message,
+			Type:    "gemini_error",
+			Param:   "",
+			Code:    code,
+		},
+		StatusCode: statusCode,
+	}
+}
+
+// embeddedError maps an error gemini sent along with a 200 status, in a stream frame or as the
+// whole body, the status code is taken from the error itself since the HTTP one says nothing
+func embeddedError(geminiError *Error) *model.ErrorWithStatusCode {
+	statusCode := geminiError.Code
+	if statusCode < http.StatusBadRequest {
+		statusCode = http.StatusInternalServerError
+	}
+	return errorGemini2OpenAI(geminiError, statusCode)
+}
+
+// isAPIKeyError reports whether gemini refused the key itself, it answers 400 INVALID_ARGUMENT
+// for malformed keys and 403 PERMISSION_DENIED for revoked or suspended ones, other errors
+// with these statuses are about the request and are left alone
+func isAPIKeyError(geminiError *Error) bool {
+	switch geminiError.Status {
+	case "UNAUTHENTICATED":
+		return true
+	case "INVALID_ARGUMENT", "PERMISSION_DENIED":
+		for _, detail := range geminiError.Details {
+			if strings.HasPrefix(detail.Reason, "API_KEY_") {
+				return true
+			}
+		}
+		message := strings.ToLower(geminiError.Message)
+		return strings.Contains(message, "api key") || strings.Contains(message, "api_key")
+	}
+	return false
+}
+
+func maxResponseSize() int64 {
+	return int64(config.GeminiMaxResponseSize) * 1024 * 1024
+}
+
+// readResponseBody reads and closes the body, refusing to buffer more than GEMINI_MAX_RESPONSE_SIZE
+// so that a broken upstream can't exhaust the memory of the process
+func readResponseBody(resp *http.Response) ([]byte, *model.ErrorWithStatusCode) {
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize()+1))
 	if err != nil {
-		return openai.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+		_ = resp.Body.Close()
+		return nil, openai.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return nil, openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+	}
+	if int64(len(responseBody)) > maxResponseSize() {
+		return nil, openai.ErrorWrapper(fmt.Errorf("upstream response exceeds %d MB", config.GeminiMaxResponseSize), "response_too_large", http.StatusBadGateway)
+	}
+	return responseBody, nil
+}
+
+// bodySnippetSize bounds how much of an unparsable body ends up in errors and logs
+const bodySnippetSize = 256
+
+// bodySnippet quotes the start of a body for error messages, control characters and invalid
+// UTF-8 are escaped so that an HTML page or a binary body can't mangle the log line
+func bodySnippet(body []byte) string {
+	if len(body) <= bodySnippetSize {
+		return strconv.Quote(string(body))
+	}
+	return strconv.Quote(string(body[:bodySnippetSize])) + "..."
+}
+
+// unmarshalResponseError reports a body that is not the JSON gemini sends, usually the HTML
+// error page of a proxy in between or a plain text rate limit message
+func unmarshalResponseError(c *gin.Context, modelName string, err error, responseBody []byte) *model.ErrorWithStatusCode {
+	snippet := bodySnippet(responseBody)
+	logErrorf(c, modelName, "error unmarshalling response body: %s, body: %s", err.Error(), snippet)
+	return openai.ErrorWrapper(fmt.Errorf("%s, body: %s", err.Error(), snippet), "unmarshal_response_body_failed", http.StatusInternalServerError)
+}
+
+func ErrorHandler(c *gin.Context, resp *http.Response, modelName string) *model.ErrorWithStatusCode {
+	responseBody, errWithStatusCode := readResponseBody(resp)
+	if errWithStatusCode != nil {
+		return errWithStatusCode
+	}
+	var errorResponse struct {
+		Error Error `json:"error"`
+	}
+	err := json.Unmarshal(responseBody, &errorResponse)
+	if err != nil {
+		logErrorf(c, modelName, "error unmarshalling gemini error response, status code: %d, body: %s", resp.StatusCode, bodySnippet(responseBody))
+	} else {
+		logErrorf(c, modelName, "gemini upstream error, status code: %d, status: %s, message: %s", resp.StatusCode, errorResponse.Error.Status, errorResponse.Error.Message)
+	}
+	return errorGemini2OpenAI(&errorResponse.Error, resp.StatusCode)
+}
+
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
+	geminiResponse, errWithStatusCode := parseResponse(c, resp, modelName)
+	if errWithStatusCode != nil {
+		return errWithStatusCode, blockedPromptUsage(geminiResponse, promptTokens)
+	}
+	usage := responseUsage(geminiResponse, promptTokens)
+	return renderResponse(c, geminiResponse, modelName, usage), &usage
+}
+
+// RawHandler passes the generateContent response on verbatim, the usage is still read from it
+// so that the request is billed as usual. Upstream errors keep the OpenAI shape.
+func RawHandler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
+	if resp.StatusCode != http.StatusOK {
+		return ErrorHandler(c, resp, modelName), nil
+	}
+	responseBody, errWithStatusCode := readResponseBody(resp)
+	if errWithStatusCode != nil {
+		return errWithStatusCode, nil
 	}
 	var geminiResponse ChatResponse
-	err = json.Unmarshal(responseBody, &geminiResponse)
+	err := json.Unmarshal(responseBody, &geminiResponse)
 	if err != nil {
-		return openai.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return unmarshalResponseError(c, modelName, err, responseBody), nil
+	}
+	if geminiResponse.Error != nil {
+		logErrorf(c, modelName, "gemini answered 200 with an error, code: %d, status: %s, message: %s", geminiResponse.Error.Code, geminiResponse.Error.Status, geminiResponse.Error.Message)
+		return embeddedError(geminiResponse.Error), nil
+	}
+	usage := responseUsage(&geminiResponse, promptTokens)
+	c.Data(http.StatusOK, "application/json", responseBody)
+	return nil, &usage
+}
+
+// parseResponse reads a generateContent response, turning upstream errors and empty answers into errors
+func parseResponse(c *gin.Context, resp *http.Response, modelName string) (*ChatResponse, *model.ErrorWithStatusCode) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrorHandler(c, resp, modelName)
+	}
+	responseBody, errWithStatusCode := readResponseBody(resp)
+	if errWithStatusCode != nil {
+		return nil, errWithStatusCode
+	}
+	var geminiResponse ChatResponse
+	err := json.Unmarshal(responseBody, &geminiResponse)
+	if err != nil {
+		return nil, unmarshalResponseError(c, modelName, err, responseBody)
+	}
+	if geminiResponse.Error != nil {
+		logErrorf(c, modelName, "gemini answered 200 with an error, code: %d, status: %s, message: %s", geminiResponse.Error.Code, geminiResponse.Error.Status, geminiResponse.Error.Message)
+		return nil, embeddedError(geminiResponse.Error)
+	}
+	// the blocked response comes back along with the error, the prompt is billed all the same
+	if len(geminiResponse.Candidates) == 0 && geminiResponse.PromptFeedback.BlockReason != "" {
+		return &geminiResponse, promptBlockedError(&geminiResponse.PromptFeedback)
 	}
 	if len(geminiResponse.Candidates) == 0 {
-		return &model.ErrorWithStatusCode{
+		return nil, &model.ErrorWithStatusCode{
 			Error: model.Error{
 				Message: "No candidates returned",
 				Type:    "server_error",
@@ -346,53 +1851,74 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName st
 				Code:    500,
 			},
 			StatusCode: resp.StatusCode,
-		}, nil
+		}
 	}
-	fullTextResponse := responseGeminiChat2OpenAI(&geminiResponse)
-	fullTextResponse.Model = modelName
-	completionTokens := openai.CountTokenText(geminiResponse.GetResponseText(), modelName)
-	usage := model.Usage{
+	return &geminiResponse, nil
+}
+
+// blockedPromptUsage is the usage of a prompt gemini refused to answer, nil for any other failure,
+// gemini has processed the prompt and reports it in usageMetadata, otherwise promptTokens is used
+func blockedPromptUsage(geminiResponse *ChatResponse, promptTokens int) *model.Usage {
+	if geminiResponse == nil || geminiResponse.PromptFeedback.BlockReason == "" {
+		return nil
+	}
+	if geminiResponse.UsageMetadata != nil {
+		usage := geminiResponse.UsageMetadata.ToUsage()
+		return &usage
+	}
+	return &model.Usage{PromptTokens: promptTokens, TotalTokens: promptTokens}
+}
+
+func responseUsage(geminiResponse *ChatResponse, promptTokens int) model.Usage {
+	if geminiResponse.UsageMetadata != nil {
+		return geminiResponse.UsageMetadata.ToUsage()
+	}
+	// with n > 1 every candidate is a completion of its own and is billed
+	completionTokens := 0
+	for _, candidate := range geminiResponse.Candidates {
+		completionTokens += openai.CountTokenText(candidate.GetReasoning()+candidate.GetText(), TokenizerModel)
+	}
+	return model.Usage{
 		PromptTokens:     promptTokens,
 		CompletionTokens: completionTokens,
 		TotalTokens:      promptTokens + completionTokens,
 	}
+}
+
+func renderResponse(c *gin.Context, geminiResponse *ChatResponse, modelName string, usage model.Usage) *model.ErrorWithStatusCode {
+	for _, candidate := range geminiResponse.Candidates {
+		warnEarlyTruncation(c, modelName, candidate.FinishReason, usage.CompletionTokens)
+	}
+	fullTextResponse := responseGeminiChat2OpenAI(geminiResponse, modelName)
 	fullTextResponse.Usage = usage
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
-		return openai.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return openai.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError)
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
-	c.Writer.WriteHeader(resp.StatusCode)
-	_, err = c.Writer.Write(jsonResponse)
-	return nil, &usage
+	c.Writer.WriteHeader(http.StatusOK)
+	_, _ = c.Writer.Write(jsonResponse)
+	return nil
 }
 
-func EmbeddingHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, *model.Usage) {
-	var geminiEmbeddingResponse EmbeddingResponse
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return openai.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+func EmbeddingHandler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
+	if resp.StatusCode != http.StatusOK {
+		return ErrorHandler(c, resp, modelName), nil
 	}
-	err = resp.Body.Close()
-	if err != nil {
-		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	var geminiEmbeddingResponse EmbeddingResponse
+	responseBody, errWithStatusCode := readResponseBody(resp)
+	if errWithStatusCode != nil {
+		return errWithStatusCode, nil
 	}
-	err = json.Unmarshal(responseBody, &geminiEmbeddingResponse)
+	err := json.Unmarshal(responseBody, &geminiEmbeddingResponse)
 	if err != nil {
-		return openai.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return unmarshalResponseError(c, modelName, err, responseBody), nil
 	}
 	if geminiEmbeddingResponse.Error != nil {
-		return &model.ErrorWithStatusCode{
-			Error: model.Error{
-				Message: geminiEmbeddingResponse.Error.Message,
-				Type:    "gemini_error",
-				Param:   "",
-				Code:    geminiEmbeddingResponse.Error.Code,
-			},
-			StatusCode: resp.StatusCode,
-		}, nil
+		logErrorf(c, modelName, "gemini answered 200 with an error, code: %d, status: %s, message: %s", geminiEmbeddingResponse.Error.Code, geminiEmbeddingResponse.Error.Status, geminiEmbeddingResponse.Error.Message)
+		return embeddedError(geminiEmbeddingResponse.Error), nil
 	}
-	fullTextResponse := embeddingResponseGemini2OpenAI(&geminiEmbeddingResponse)
+	fullTextResponse := embeddingResponseGemini2OpenAI(&geminiEmbeddingResponse, promptTokens, modelName)
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
 		return openai.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
@@ -0,0 +1,2219 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertRequestRoles(t *testing.T) {
+	request := model.GeneralOpenAIRequest{
+		Model: "gemini-pro",
+		Messages: []model.Message{
+			{Role: "system", Content: "You are a helpful assistant."},
+			{Role: "user", Content: "Hello"},
+			{Role: "assistant", Content: "Hi, how can I help?"},
+			{Role: "user", Content: "Tell me a joke"},
+		},
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+
+	roles := make([]string, 0, len(geminiRequest.Contents))
+	for _, content := range geminiRequest.Contents {
+		roles = append(roles, content.Role)
+	}
+	assert.Equal(t, []string{"user", "model", "user", "model", "user"}, roles)
+	for i := 1; i < len(roles); i++ {
+		assert.NotEqual(t, roles[i-1], roles[i], "roles must alternate")
+	}
+}
+
+func TestConvertRequestMergesConsecutiveRoles(t *testing.T) {
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model: "gemini-pro",
+		Messages: []model.Message{
+			{Role: "user", Content: "Hello"},
+			{Role: "user", Content: "Are you there?"},
+			{Role: "assistant", Content: "Yes."},
+			{Role: "assistant", Content: "How can I help?"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 2)
+	assert.Equal(t, "user", geminiRequest.Contents[0].Role)
+	assert.Equal(t, []Part{{Text: "Hello"}, {Text: "Are you there?"}}, geminiRequest.Contents[0].Parts)
+	assert.Equal(t, "model", geminiRequest.Contents[1].Role)
+	assert.Equal(t, []Part{{Text: "Yes."}, {Text: "How can I help?"}}, geminiRequest.Contents[1].Parts)
+
+	// the system prompt of older models is still answered by the dummy model turn
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model: "gemini-pro",
+		Messages: []model.Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Hello"},
+			{Role: "user", Content: "Anyone?"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 3)
+	assert.Equal(t, "user", geminiRequest.Contents[0].Role)
+	assert.Equal(t, "model", geminiRequest.Contents[1].Role)
+	assert.Len(t, geminiRequest.Contents[2].Parts, 2)
+}
+
+func TestConvertRequestSystemInstruction(t *testing.T) {
+	messages := []model.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello"},
+	}
+
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-1.5-pro", Messages: messages})
+	require.NoError(t, err)
+	require.NotNil(t, geminiRequest.SystemInstruction)
+	assert.Equal(t, "You are a helpful assistant.", geminiRequest.SystemInstruction.Parts[0].Text)
+	require.Len(t, geminiRequest.Contents, 1)
+	assert.Equal(t, "user", geminiRequest.Contents[0].Role)
+
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-2.5-flash", Messages: messages})
+	require.NoError(t, err)
+	require.NotNil(t, geminiRequest.SystemInstruction)
+	assert.Len(t, geminiRequest.Contents, 1)
+
+	for _, modelName := range []string{"gemini-pro", "gemini-1.0-pro-001"} {
+		geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: modelName, Messages: messages})
+		require.NoError(t, err)
+		assert.Nil(t, geminiRequest.SystemInstruction, modelName)
+		assert.Len(t, geminiRequest.Contents, 3, modelName)
+	}
+}
+
+func TestConvertRequestMultipleSystemMessages(t *testing.T) {
+	messages := []model.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello"},
+		{Role: "system", Content: []any{
+			map[string]any{"type": "text", "text": "Answer in French."},
+			map[string]any{"type": "text", "text": "Keep it short."},
+		}},
+	}
+
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-1.5-pro", Messages: messages})
+	require.NoError(t, err)
+	require.NotNil(t, geminiRequest.SystemInstruction)
+	require.Len(t, geminiRequest.SystemInstruction.Parts, 1)
+	assert.Equal(t, "You are a helpful assistant.\nAnswer in French.\nKeep it short.", geminiRequest.SystemInstruction.Parts[0].Text)
+	require.Len(t, geminiRequest.Contents, 1)
+	assert.Equal(t, "Hello", geminiRequest.Contents[0].Parts[0].Text)
+}
+
+func TestConvertRequestMaxMessages(t *testing.T) {
+	defer func(limit int) { config.GeminiMaxMessages = limit }(config.GeminiMaxMessages)
+	config.GeminiMaxMessages = 3
+	messages := []model.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello"},
+		{Role: "assistant", Content: "Hi, how can I help?"},
+	}
+	_, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-1.5-pro", Messages: messages})
+	require.NoError(t, err)
+
+	messages = append(messages, model.Message{Role: "user", Content: "Tell me a joke"})
+	_, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-1.5-pro", Messages: messages})
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.Contains(t, err.Error(), "at most 3 are allowed")
+
+	config.GeminiMaxMessages = 0
+	_, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-1.5-pro", Messages: messages})
+	assert.NoError(t, err)
+}
+
+func TestConvertRequestMaxPromptTokens(t *testing.T) {
+	defer func(limit int, approximate bool) {
+		config.GeminiMaxPromptTokens, config.ApproximateTokenEnabled = limit, approximate
+	}(config.GeminiMaxPromptTokens, config.ApproximateTokenEnabled)
+	config.GeminiMaxPromptTokens, config.ApproximateTokenEnabled = 100, true
+
+	_, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-1.5-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hello there"}},
+	})
+	require.NoError(t, err)
+
+	// the text parts of every message add up
+	_, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model: "gemini-1.5-pro",
+		Messages: []model.Message{
+			{Role: "system", Content: strings.Repeat("word ", 40)},
+			{Role: "user", Content: []any{
+				map[string]any{"type": "text", "text": strings.Repeat("word ", 40)},
+			}},
+		},
+	})
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.Contains(t, err.Error(), "limit of 100 tokens")
+}
+
+func TestConvertRequestLogitBias(t *testing.T) {
+	defer func(strict bool) { config.GeminiLogitBiasStrict = strict }(config.GeminiLogitBiasStrict)
+	request := model.GeneralOpenAIRequest{
+		Model:     "gemini-1.5-pro",
+		Messages:  []model.Message{{Role: "user", Content: "Hello"}},
+		LogitBias: map[string]float64{"50256": -100},
+	}
+
+	config.GeminiLogitBiasStrict = false
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	body, err := json.Marshal(geminiRequest)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "50256")
+
+	config.GeminiLogitBiasStrict = true
+	_, err = ConvertRequest(context.Background(), request)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.ErrorContains(t, err, "logit_bias")
+
+	// an empty logit_bias asks for nothing gemini lacks
+	request.LogitBias = map[string]float64{}
+	_, err = ConvertRequest(context.Background(), request)
+	assert.NoError(t, err)
+}
+
+func TestConvertRequestGenerationConfig(t *testing.T) {
+	request := model.GeneralOpenAIRequest{
+		Model:     "gemini-pro",
+		Messages:  []model.Message{{Role: "user", Content: "Hello"}},
+		MaxTokens: 2048,
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 2048, geminiRequest.GenerationConfig.MaxOutputTokens)
+	assert.Nil(t, geminiRequest.GenerationConfig.TopK)
+
+	request.TopK = intPtr(40)
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	require.NotNil(t, geminiRequest.GenerationConfig.TopK)
+	assert.Equal(t, 40, *geminiRequest.GenerationConfig.TopK)
+	assert.NotEqual(t, geminiRequest.GenerationConfig.MaxOutputTokens, *geminiRequest.GenerationConfig.TopK)
+}
+
+func TestConvertRequestTopKFromJSON(t *testing.T) {
+	convert := func(body string) string {
+		var request model.GeneralOpenAIRequest
+		require.NoError(t, json.Unmarshal([]byte(body), &request))
+		geminiRequest, err := ConvertRequest(context.Background(), request)
+		require.NoError(t, err)
+		data, err := json.Marshal(geminiRequest.GenerationConfig)
+		require.NoError(t, err)
+		return string(data)
+	}
+	generationConfig := convert(`{"model": "gemini-1.5-pro", "max_tokens": 100, "top_k": 40, "messages": [{"role": "user", "content": "Hi"}]}`)
+	assert.Contains(t, generationConfig, `"topK":40`)
+	assert.Contains(t, generationConfig, `"maxOutputTokens":100`)
+
+	generationConfig = convert(`{"model": "gemini-1.5-pro", "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`)
+	assert.NotContains(t, generationConfig, "topK")
+
+	// an explicit 0 is the client's choice, not an absent value
+	generationConfig = convert(`{"model": "gemini-1.5-pro", "top_k": 0, "messages": [{"role": "user", "content": "Hi"}]}`)
+	assert.Contains(t, generationConfig, `"topK":0`)
+}
+
+func TestConvertRequestOmitsZeroMaxTokens(t *testing.T) {
+	for _, maxTokens := range []int{0, -1} {
+		geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+			Model:     "gemini-pro",
+			Messages:  []model.Message{{Role: "user", Content: "Hello"}},
+			MaxTokens: maxTokens,
+		})
+		require.NoError(t, err)
+		body, err := json.Marshal(geminiRequest)
+		require.NoError(t, err)
+		assert.NotContains(t, string(body), "maxOutputTokens")
+	}
+}
+
+func TestConvertRequestStopSequences(t *testing.T) {
+	var request model.GeneralOpenAIRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"model": "gemini-pro", "messages": [{"role": "user", "content": "Hi"}], "stop": "END"}`), &request))
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"END"}, geminiRequest.GenerationConfig.StopSequences)
+
+	request = model.GeneralOpenAIRequest{}
+	require.NoError(t, json.Unmarshal([]byte(`{"model": "gemini-pro", "messages": [{"role": "user", "content": "Hi"}], "stop": ["a", "b", "c", "d", "e", "f"]}`), &request))
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, geminiRequest.GenerationConfig.StopSequences)
+
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-pro", Messages: []model.Message{{Role: "user", Content: "Hi"}}})
+	require.NoError(t, err)
+	assert.Nil(t, geminiRequest.GenerationConfig.StopSequences)
+}
+
+func TestConvertRequestRejectsEmptyMessages(t *testing.T) {
+	_, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{Model: "gemini-pro", Messages: []model.Message{}})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.Contains(t, err.Error(), "messages must not be empty")
+
+	// a system prompt alone leaves nothing to answer
+	_, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-1.5-pro",
+		Messages: []model.Message{{Role: "system", Content: "Be brief."}},
+	})
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func TestConvertRequestClampsSamplingParameters(t *testing.T) {
+	request := model.GeneralOpenAIRequest{
+		Model:       "gemini-pro",
+		Messages:    []model.Message{{Role: "user", Content: "Hello"}},
+		Temperature: float64Ptr(1.8),
+		TopP:        float64Ptr(1.5),
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *geminiRequest.GenerationConfig.Temperature)
+	assert.Equal(t, 1.0, *geminiRequest.GenerationConfig.TopP)
+	// clamping must not change what the client sent
+	assert.Equal(t, 1.8, *request.Temperature)
+
+	request.Model = "gemini-1.5-pro"
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 1.8, *geminiRequest.GenerationConfig.Temperature)
+
+	request.Temperature = float64Ptr(2.5)
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *geminiRequest.GenerationConfig.Temperature)
+
+	request.Temperature = float64Ptr(-0.5)
+	_, err = ConvertRequest(context.Background(), request)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+
+	request.Temperature, request.TopP = float64Ptr(0.5), float64Ptr(-1)
+	_, err = ConvertRequest(context.Background(), request)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+}
+
+func TestConvertRequestOmittedSamplingParameters(t *testing.T) {
+	var request model.GeneralOpenAIRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"model": "gemini-1.5-pro", "messages": [{"role": "user", "content": "Hello"}]}`), &request))
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	body, err := json.Marshal(geminiRequest.GenerationConfig)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "temperature")
+	assert.NotContains(t, string(body), "topP")
+
+	require.NoError(t, json.Unmarshal([]byte(`{"model": "gemini-1.5-pro", "messages": [{"role": "user", "content": "Hello"}], "temperature": 0, "top_p": 0}`), &request))
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	body, err = json.Marshal(geminiRequest.GenerationConfig)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"temperature":0`)
+	assert.Contains(t, string(body), `"topP":0`)
+}
+
+func TestConvertRequestPenalties(t *testing.T) {
+	request := model.GeneralOpenAIRequest{
+		Model:            "gemini-1.5-pro",
+		Messages:         []model.Message{{Role: "user", Content: "Hello"}},
+		PresencePenalty:  0.5,
+		FrequencyPenalty: 3,
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, geminiRequest.GenerationConfig.PresencePenalty)
+	assert.Equal(t, MaxPenalty, geminiRequest.GenerationConfig.FrequencyPenalty)
+
+	request.Model, request.PresencePenalty = "gemini-2.0-flash-001", -5
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, MinPenalty, geminiRequest.GenerationConfig.PresencePenalty)
+	assert.Equal(t, MaxPenalty, geminiRequest.GenerationConfig.FrequencyPenalty)
+
+	for _, modelName := range []string{"gemini-pro", "gemini-2.0-flash-thinking-exp-01-21", "gemini-2.5-pro", "unknown-model"} {
+		request.Model = modelName
+		geminiRequest, err = ConvertRequest(context.Background(), request)
+		require.NoError(t, err)
+		data, err := json.Marshal(geminiRequest.GenerationConfig)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "presencePenalty", modelName)
+		assert.NotContains(t, string(data), "frequencyPenalty", modelName)
+	}
+}
+
+func TestConvertRequestThinkingBudget(t *testing.T) {
+	convert := func(modelName string, thinkingBudget int) (*ChatRequest, error) {
+		return ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+			Model:          modelName,
+			Messages:       []model.Message{{Role: "user", Content: "Prove that there are infinitely many primes"}},
+			ThinkingBudget: &thinkingBudget,
+		})
+	}
+	geminiRequest, err := convert("gemini-2.5-flash-preview-04-17", 1024)
+	require.NoError(t, err)
+	data, err := json.Marshal(geminiRequest.GenerationConfig)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"thinkingConfig":{"thinkingBudget":1024}`)
+
+	geminiRequest, err = convert("gemini-2.5-flash", 0)
+	require.NoError(t, err)
+	assert.Equal(t, &ThinkingConfig{ThinkingBudget: 0}, geminiRequest.GenerationConfig.ThinkingConfig)
+	geminiRequest, err = convert("gemini-2.5-pro", DynamicThinkingBudget)
+	require.NoError(t, err)
+	assert.Equal(t, &ThinkingConfig{ThinkingBudget: -1}, geminiRequest.GenerationConfig.ThinkingConfig)
+
+	_, err = convert("gemini-2.5-pro", 0)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	_, err = convert("gemini-2.5-pro", 64)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	_, err = convert("gemini-2.5-flash-lite", 100000)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+
+	for _, modelName := range []string{"gemini-1.5-pro", "gemini-2.0-flash-thinking-exp"} {
+		geminiRequest, err = convert(modelName, 1024)
+		require.NoError(t, err)
+		data, err = json.Marshal(geminiRequest.GenerationConfig)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "thinkingConfig", modelName)
+	}
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, geminiRequest.GenerationConfig.ThinkingConfig)
+}
+
+func TestConvertRequestResponseFormat(t *testing.T) {
+	var request model.GeneralOpenAIRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gemini-1.5-pro",
+		"messages": [{"role": "user", "content": "Hello"}],
+		"response_format": {"type": "json_object"}
+	}`), &request))
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+	assert.Nil(t, geminiRequest.GenerationConfig.ResponseSchema)
+
+	request = model.GeneralOpenAIRequest{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gemini-1.5-pro",
+		"messages": [{"role": "user", "content": "Hello"}],
+		"response_format": {"type": "json_schema", "json_schema": {"name": "recipe", "schema": {
+			"$schema": "http://json-schema.org/draft-07/schema#",
+			"type": "object",
+			"additionalProperties": false,
+			"properties": {
+				"name": {"type": "string"},
+				"tags": {"type": "array", "items": {"type": "string"}},
+				"rating": {"type": ["integer", "null"]}
+			},
+			"required": ["name"]
+		}}}
+	}`), &request))
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+	data, err := json.Marshal(geminiRequest.GenerationConfig.ResponseSchema)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "OBJECT",
+		"properties": {
+			"name": {"type": "STRING"},
+			"tags": {"type": "ARRAY", "items": {"type": "STRING"}},
+			"rating": {"type": "INTEGER", "nullable": true}
+		},
+		"required": ["name"]
+	}`, string(data))
+
+	for _, modelName := range []string{"gemini-2.0-flash", "gemini-2.5-pro", "gemini-2.5-flash-lite"} {
+		request.Model = modelName
+		geminiRequest, err = ConvertRequest(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType, modelName)
+		assert.NotNil(t, geminiRequest.GenerationConfig.ResponseSchema, modelName)
+	}
+
+	for _, modelName := range []string{"gemini-pro", "gemini-1.0-pro-001", "gemini-2.0-flash-thinking-exp"} {
+		request.Model = modelName
+		geminiRequest, err = ConvertRequest(context.Background(), request)
+		require.NoError(t, err)
+		assert.Empty(t, geminiRequest.GenerationConfig.ResponseMimeType, modelName)
+		assert.Nil(t, geminiRequest.GenerationConfig.ResponseSchema, modelName)
+	}
+}
+
+func TestConvertRequestStrictResponseSchema(t *testing.T) {
+	convert := func(schema string) (*ChatRequest, error) {
+		var request model.GeneralOpenAIRequest
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"model": "gemini-1.5-pro",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"response_format": {"type": "json_schema", "json_schema": {"name": "order", "strict": true, "schema": `+schema+`}}
+		}`), &request))
+		return ConvertRequest(context.Background(), request)
+	}
+
+	geminiRequest, err := convert(`{
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "string", "description": "order id"},
+			"status": {"type": "string", "enum": ["open", "shipped"]},
+			"customer": {
+				"type": "object",
+				"additionalProperties": false,
+				"properties": {"name": {"type": "string"}, "email": {"type": ["string", "null"]}},
+				"required": ["name", "email"]
+			},
+			"items": {"type": "array", "items": {
+				"type": "object",
+				"additionalProperties": false,
+				"properties": {"sku": {"type": "string"}, "quantity": {"type": "integer"}},
+				"required": ["sku", "quantity"]
+			}}
+		},
+		"required": ["id", "status", "customer", "items"]
+	}`)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+	data, err := json.Marshal(geminiRequest.GenerationConfig.ResponseSchema)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "OBJECT",
+		"properties": {
+			"id": {"type": "STRING", "description": "order id"},
+			"status": {"type": "STRING", "enum": ["open", "shipped"]},
+			"customer": {
+				"type": "OBJECT",
+				"properties": {"name": {"type": "STRING"}, "email": {"type": "STRING", "nullable": true}},
+				"required": ["name", "email"]
+			},
+			"items": {"type": "ARRAY", "items": {
+				"type": "OBJECT",
+				"properties": {"sku": {"type": "STRING"}, "quantity": {"type": "INTEGER"}},
+				"required": ["sku", "quantity"]
+			}}
+		},
+		"required": ["id", "status", "customer", "items"]
+	}`, string(data))
+
+	const unsupported = `{
+		"type": "object",
+		"properties": {"metadata": {"type": "object", "patternProperties": {"^x-": {"type": "string"}}}}
+	}`
+	_, err = convert(unsupported)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.ErrorContains(t, err, `$.metadata: keyword "patternProperties" is not supported by gemini`)
+
+	// without strict the keyword is dropped
+	var request model.GeneralOpenAIRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gemini-1.5-pro",
+		"messages": [{"role": "user", "content": "Hello"}],
+		"response_format": {"type": "json_schema", "json_schema": {"name": "order", "schema": `+unsupported+`}}
+	}`), &request))
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	data, err = json.Marshal(geminiRequest.GenerationConfig.ResponseSchema)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "patternProperties")
+}
+
+func TestGetSafetySettings(t *testing.T) {
+	safetySettings := getSafetySettings("BLOCK_ONLY_HIGH")
+	require.Len(t, safetySettings, len(SafetyCategories))
+	for _, setting := range safetySettings {
+		assert.Equal(t, "BLOCK_ONLY_HIGH", setting.Threshold)
+	}
+
+	// a typo never turns the filters off
+	safetySettings = getSafetySettings("BLOCK_LOW_AND_ABOV")
+	for _, setting := range safetySettings {
+		assert.Equal(t, "BLOCK_ONLY_HIGH", setting.Threshold)
+	}
+	assert.Error(t, ValidateSafetySetting("BLOCK_LOW_AND_ABOV"))
+	assert.Error(t, ValidateSafetySetting(""))
+	assert.NoError(t, ValidateSafetySetting("BLOCK_LOW_AND_ABOVE"))
+}
+
+func TestFinishReasonGemini2OpenAI(t *testing.T) {
+	assert.Equal(t, "stop", finishReasonGemini2OpenAI("STOP"))
+	assert.Equal(t, "length", finishReasonGemini2OpenAI("MAX_TOKENS"))
+	assert.Equal(t, "content_filter", finishReasonGemini2OpenAI("SAFETY"))
+	assert.Equal(t, "content_filter", finishReasonGemini2OpenAI("RECITATION"))
+}
+
+func TestResponseGeminiChat2OpenAIRecitation(t *testing.T) {
+	defer func(enabled bool) { config.GeminiRecitationFinishReasonEnabled = enabled }(config.GeminiRecitationFinishReasonEnabled)
+	response := ChatResponse{
+		Candidates: []ChatCandidate{
+			{Content: ChatContent{Role: "model", Parts: []Part{{Text: "It was the best of times,"}}}, FinishReason: "RECITATION"},
+		},
+	}
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	require.Len(t, fullTextResponse.Choices, 1)
+	assert.Equal(t, "content_filter", fullTextResponse.Choices[0].FinishReason)
+	assert.Equal(t, "It was the best of times,", fullTextResponse.Choices[0].Message.Content)
+
+	config.GeminiRecitationFinishReasonEnabled = true
+	fullTextResponse = responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, "recitation", fullTextResponse.Choices[0].FinishReason)
+	assert.Equal(t, "It was the best of times,", fullTextResponse.Choices[0].Message.Content)
+
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	require.Len(t, streamResponse.Choices, 1)
+	require.NotNil(t, streamResponse.Choices[0].FinishReason)
+	assert.Equal(t, "recitation", *streamResponse.Choices[0].FinishReason)
+	assert.Equal(t, "It was the best of times,", streamResponse.Choices[0].Delta.Content)
+}
+
+func TestHandlerMaxTokens(t *testing.T) {
+	defer func(ratio float64) { config.GeminiEarlyTruncationRatio = ratio }(config.GeminiEarlyTruncationRatio)
+	const body = `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Once upon a"}]}, "finishReason": "MAX_TOKENS"}],
+		"usageMetadata": {"promptTokenCount": 5, "candidatesTokenCount": 3, "totalTokenCount": 8}
+	}`
+	c, w := newTestContext()
+	c.Set(ctxkey.ConvertedRequest, &ChatRequest{GenerationConfig: ChatGenerationConfig{MaxOutputTokens: 1000}})
+	errWithStatusCode, usage := Handler(c, newTestResponse(http.StatusOK, body), 0, "gemini-pro")
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, 3, usage.CompletionTokens)
+	assert.Contains(t, w.Body.String(), `"finish_reason":"length"`)
+	assert.Contains(t, w.Body.String(), `Once upon a`)
+
+	early, _ := isEarlyTruncation(c, "MAX_TOKENS", 3)
+	assert.False(t, early)
+	config.GeminiEarlyTruncationRatio = 0.5
+	early, maxTokens := isEarlyTruncation(c, "MAX_TOKENS", 3)
+	assert.True(t, early)
+	assert.Equal(t, 1000, maxTokens)
+	early, _ = isEarlyTruncation(c, "MAX_TOKENS", 800)
+	assert.False(t, early)
+	early, _ = isEarlyTruncation(c, "STOP", 3)
+	assert.False(t, early)
+}
+
+func TestConvertRequestClampsMaxTokens(t *testing.T) {
+	newRequest := func(modelName string, maxTokens int) model.GeneralOpenAIRequest {
+		return model.GeneralOpenAIRequest{
+			Model:     modelName,
+			Messages:  []model.Message{{Role: "user", Content: "Write a novel"}},
+			MaxTokens: maxTokens,
+		}
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), newRequest("gemini-1.5-pro-002", 100000))
+	require.NoError(t, err)
+	assert.Equal(t, 8192, geminiRequest.GenerationConfig.MaxOutputTokens)
+
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-pro-vision", 100000))
+	require.NoError(t, err)
+	assert.Equal(t, 4096, geminiRequest.GenerationConfig.MaxOutputTokens)
+
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-1.5-pro", 1000))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, geminiRequest.GenerationConfig.MaxOutputTokens)
+
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-exp-1206", 100000))
+	require.NoError(t, err)
+	assert.Equal(t, 100000, geminiRequest.GenerationConfig.MaxOutputTokens)
+}
+
+func TestConvertRequestClampsCandidateCount(t *testing.T) {
+	newRequest := func(modelName string, n int) model.GeneralOpenAIRequest {
+		return model.GeneralOpenAIRequest{
+			Model:    modelName,
+			Messages: []model.Message{{Role: "user", Content: "Name a color"}},
+			N:        n,
+		}
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), newRequest("gemini-1.5-flash", 10))
+	require.NoError(t, err)
+	assert.Equal(t, 8, geminiRequest.GenerationConfig.CandidateCount)
+
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-pro", 10))
+	require.NoError(t, err)
+	assert.Equal(t, 1, geminiRequest.GenerationConfig.CandidateCount)
+
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-1.5-flash", 3))
+	require.NoError(t, err)
+	assert.Equal(t, 3, geminiRequest.GenerationConfig.CandidateCount)
+
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-exp-1206", 10))
+	require.NoError(t, err)
+	assert.Equal(t, 10, geminiRequest.GenerationConfig.CandidateCount)
+}
+
+func TestResponseGeminiChat2OpenAIBlockedCandidate(t *testing.T) {
+	response := ChatResponse{
+		Candidates: []ChatCandidate{
+			{FinishReason: "SAFETY"},
+		},
+	}
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	require.Len(t, fullTextResponse.Choices, 1)
+	assert.Equal(t, "content_filter", fullTextResponse.Choices[0].FinishReason)
+	assert.Equal(t, "", fullTextResponse.Choices[0].Message.Content)
+
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	require.Len(t, streamResponse.Choices, 1)
+	require.NotNil(t, streamResponse.Choices[0].FinishReason)
+	assert.Equal(t, "content_filter", *streamResponse.Choices[0].FinishReason)
+}
+
+func TestFinishMessage(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": "Here is"}]}, "finishReason": "PROHIBITED_CONTENT", "finishMessage": "The response was blocked because it may contain prohibited content.", "index": 0},
+		{"content": {"role": "model", "parts": [{"text": "Done"}]}, "finishReason": "STOP", "finishMessage": "Model generated function call(s).", "index": 1}
+	]}`), &response))
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-1.5-pro")
+	require.Len(t, fullTextResponse.Choices, 2)
+	assert.Equal(t, "content_filter", fullTextResponse.Choices[0].FinishReason)
+	assert.Equal(t, "The response was blocked because it may contain prohibited content.", fullTextResponse.Choices[0].FinishMessage)
+	assert.Empty(t, fullTextResponse.Choices[1].FinishMessage)
+
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-1.5-pro")
+	require.Len(t, streamResponse.Choices, 2)
+	assert.Equal(t, "The response was blocked because it may contain prohibited content.", streamResponse.Choices[0].FinishMessage)
+	body, err := json.Marshal(streamResponse.Choices[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"finish_message":"The response was blocked because it may contain prohibited content."`)
+	assert.Empty(t, streamResponse.Choices[1].FinishMessage)
+}
+
+const blockedResponseFixture = `{
+  "candidates": [
+    {
+      "finishReason": "SAFETY",
+      "index": 0,
+      "safetyRatings": [
+        {"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "probability": "NEGLIGIBLE"},
+        {"category": "HARM_CATEGORY_HATE_SPEECH", "probability": "HIGH"},
+        {"category": "HARM_CATEGORY_HARASSMENT", "probability": "NEGLIGIBLE"},
+        {"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "probability": "NEGLIGIBLE"}
+      ]
+    }
+  ],
+  "promptFeedback": {
+    "safetyRatings": [
+      {"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "probability": "NEGLIGIBLE"}
+    ]
+  }
+}`
+
+func TestResponseGeminiChat2OpenAIKeepsCandidateIndex(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": "second"}]}, "finishReason": "STOP", "index": 1},
+		{"content": {"role": "model", "parts": [{"text": "first"}]}, "finishReason": "STOP"}
+	]}`), &response))
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	require.Len(t, fullTextResponse.Choices, 2)
+	assert.Equal(t, 1, fullTextResponse.Choices[0].Index)
+	assert.Equal(t, "second", fullTextResponse.Choices[0].Message.Content)
+	assert.Equal(t, 0, fullTextResponse.Choices[1].Index)
+	assert.Equal(t, "first", fullTextResponse.Choices[1].Message.Content)
+
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	require.Len(t, streamResponse.Choices, 2)
+	assert.Equal(t, 1, streamResponse.Choices[0].Index)
+	assert.Equal(t, 0, streamResponse.Choices[1].Index)
+}
+
+func TestResponseGeminiChat2OpenAIJoinsParts(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": "Hello"}, {"text": ", "}, {"text": "world"}]}, "finishReason": "STOP"}
+	]}`), &response))
+	assert.Equal(t, "Hello, world", response.GetResponseText())
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, "Hello, world", fullTextResponse.Choices[0].Message.Content)
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	assert.Equal(t, "Hello, world", streamResponse.Choices[0].Delta.Content)
+}
+
+func TestResponseModel(t *testing.T) {
+	c, w := newTestContext()
+	body := `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 1, "candidatesTokenCount": 1, "totalTokenCount": 2}}`
+	errWithStatusCode, _ := Handler(c, newTestResponse(http.StatusOK, body), 0, "gemini-1.5-pro")
+	require.Nil(t, errWithStatusCode)
+	var textResponse openai.TextResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &textResponse))
+	assert.Equal(t, "gemini-1.5-pro", textResponse.Model)
+
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}}],
+		"modelVersion": "gemini-1.5-pro-002"}`), &response))
+	assert.Equal(t, "gemini-1.5-pro-002", responseGeminiChat2OpenAI(&response, "gemini-1.5-pro").Model)
+	assert.Equal(t, "gemini-1.5-pro-002", streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-1.5-pro").Model)
+}
+
+func TestSystemFingerprint(t *testing.T) {
+	c, w := newTestContext()
+	body := `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 1, "candidatesTokenCount": 1, "totalTokenCount": 2}, "modelVersion": "gemini-1.5-pro-002"}`
+	errWithStatusCode, _ := Handler(c, newTestResponse(http.StatusOK, body), 0, "gemini-1.5-pro")
+	require.Nil(t, errWithStatusCode)
+	var textResponse openai.TextResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &textResponse))
+	assert.Equal(t, "gemini-1.5-pro-002", textResponse.SystemFingerprint)
+
+	// left out when gemini does not report a version
+	c, w = newTestContext()
+	body = `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 1, "candidatesTokenCount": 1, "totalTokenCount": 2}}`
+	errWithStatusCode, _ = Handler(c, newTestResponse(http.StatusOK, body), 0, "gemini-1.5-pro")
+	require.Nil(t, errWithStatusCode)
+	assert.NotContains(t, w.Body.String(), "system_fingerprint")
+
+	c, w = newTestContext()
+	streamBody := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}], \"modelVersion\": \"gemini-1.5-pro-002\"}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \" world\"}]}, \"finishReason\": \"STOP\"}], \"modelVersion\": \"gemini-1.5-pro-002\"," +
+		" \"usageMetadata\": {\"promptTokenCount\": 1, \"candidatesTokenCount\": 2, \"totalTokenCount\": 3}}\n\n"
+	errWithStatusCode, _, _ = StreamHandler(c, newTestResponse(http.StatusOK, streamBody), "gemini-1.5-pro", true)
+	require.Nil(t, errWithStatusCode)
+	var fingerprints []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk openai.ChatCompletionsStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		fingerprints = append(fingerprints, chunk.SystemFingerprint)
+	}
+	assert.Equal(t, []string{"gemini-1.5-pro-002", "", ""}, fingerprints)
+}
+
+func TestStreamHandlerFinishReasonOnlyChunk(t *testing.T) {
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}, {\"text\": \" world\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": []}, \"finishReason\": \"STOP\"}]}\n\n" +
+		"data: {\"candidates\": [{\"finishReason\": \"MAX_TOKENS\", \"index\": 0}]}\n\n"
+
+	c, w := newTestContext()
+	errWithStatusCode, responseText, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello world", responseText)
+
+	var chunks []openai.ChatCompletionsStreamResponse
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk openai.ChatCompletionsStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+	require.Len(t, chunks, 3)
+	assert.Equal(t, "Hello world", chunks[0].Choices[0].Delta.StringContent())
+	assert.Nil(t, chunks[0].Choices[0].FinishReason)
+	for i, finishReason := range []string{"stop", "length"} {
+		choice := chunks[i+1].Choices[0]
+		assert.Empty(t, choice.Delta.StringContent())
+		require.NotNil(t, choice.FinishReason)
+		assert.Equal(t, finishReason, *choice.FinishReason)
+	}
+}
+
+func TestStreamHandlerSkipsEmptyChunks(t *testing.T) {
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"\"}, {\"text\": \"\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \" \"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"world\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"\"}]}, \"finishReason\": \"STOP\"}]}\n\n"
+
+	c, w := newTestContext()
+	errWithStatusCode, responseText, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello world", responseText)
+
+	var contents []string
+	var finishReason *string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk openai.ChatCompletionsStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		contents = append(contents, chunk.Choices[0].Delta.StringContent())
+		finishReason = chunk.Choices[0].FinishReason
+	}
+	assert.Equal(t, []string{"Hello", " ", "world", ""}, contents)
+	require.NotNil(t, finishReason)
+	assert.Equal(t, "stop", *finishReason)
+}
+
+func TestEmptyChunksKeepSafetyRatingsAndLogprobs(t *testing.T) {
+	defer func(safetyRatings, avgLogprobs bool) {
+		config.GeminiSafetyRatingsEnabled, config.GeminiAvgLogprobsEnabled = safetyRatings, avgLogprobs
+	}(config.GeminiSafetyRatingsEnabled, config.GeminiAvgLogprobsEnabled)
+	config.GeminiSafetyRatingsEnabled, config.GeminiAvgLogprobsEnabled = true, true
+	const empty = `{"candidates": [{"content": {"role": "model", "parts": [{"text": ""}]}}]}`
+	const rated = `{"candidates": [{"content": {"role": "model", "parts": [{"text": ""}]},
+		"safetyRatings": [{"category": "HARM_CATEGORY_HARASSMENT", "probability": "LOW"}]}]}`
+	const scored = `{"candidates": [{"content": {"role": "model", "parts": [{"text": ""}]}, "avgLogprobs": -0.25}]}`
+	chunks := func(body string) []openai.ChatCompletionsStreamResponse {
+		var chunks []openai.ChatCompletionsStreamResponse
+		for _, line := range strings.Split(body, "\n") {
+			data := strings.TrimPrefix(line, "data: ")
+			if data == line || data == "[DONE]" {
+				continue
+			}
+			var chunk openai.ChatCompletionsStreamResponse
+			require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+			chunks = append(chunks, chunk)
+		}
+		return chunks
+	}
+
+	c, w := newTestContext()
+	body := "data: " + strings.ReplaceAll(empty, "\n", "") + "\n\n" +
+		"data: " + strings.ReplaceAll(rated, "\n", "") + "\n\n" +
+		"data: " + strings.ReplaceAll(scored, "\n", "") + "\n\n"
+	errWithStatusCode, _, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-1.5-pro", false)
+	require.Nil(t, errWithStatusCode)
+	streamed := chunks(w.Body.String())
+	require.Len(t, streamed, 2)
+	require.Len(t, streamed[0].Choices[0].SafetyRatings, 1)
+	assert.Equal(t, "HARM_CATEGORY_HARASSMENT", streamed[0].Choices[0].SafetyRatings[0].Category)
+	require.NotNil(t, streamed[1].Choices[0].AvgLogprob)
+	assert.Equal(t, -0.25, *streamed[1].Choices[0].AvgLogprob)
+
+	// the fake stream filters its single chunk the same way
+	for _, test := range []struct {
+		body   string
+		chunks int
+	}{{empty, 0}, {rated, 1}, {scored, 1}} {
+		c, w = newTestContext()
+		errWithStatusCode, _, _ = FakeStreamHandler(c, newTestResponse(http.StatusOK, test.body), "gemini-1.5-pro", false)
+		require.Nil(t, errWithStatusCode)
+		assert.Len(t, chunks(w.Body.String()), test.chunks, test.body)
+		assert.Contains(t, w.Body.String(), "data: [DONE]")
+	}
+}
+
+func TestImageOutput(t *testing.T) {
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:      "gemini-2.0-flash-exp",
+		Messages:   []model.Message{{Role: "user", Content: "Draw a cat"}},
+		Modalities: []string{"text", "image"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TEXT", "IMAGE"}, geminiRequest.GenerationConfig.ResponseModalities)
+
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-2.0-flash-exp-image-generation",
+		Messages: []model.Message{{Role: "user", Content: "Draw a cat"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TEXT", "IMAGE"}, geminiRequest.GenerationConfig.ResponseModalities)
+
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-2.0-flash-exp",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, geminiRequest.GenerationConfig.ResponseModalities)
+
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{"content": {"role": "model", "parts": [
+		{"text": "Here is your cat:"},
+		{"inlineData": {"mimeType": "image/png", "data": "iVBORw0KGgo="}}
+	]}, "finishReason": "STOP"}]}`), &response))
+	expected := []model.MessageContent{
+		{Type: model.ContentTypeText, Text: "Here is your cat:"},
+		{Type: model.ContentTypeImageURL, ImageURL: &model.ImageURL{Url: "data:image/png;base64,iVBORw0KGgo="}},
+	}
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-2.0-flash-exp")
+	assert.Equal(t, expected, fullTextResponse.Choices[0].Message.Content)
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-2.0-flash-exp")
+	assert.Equal(t, expected, streamResponse.Choices[0].Delta.Content)
+
+	// an image-only chunk is not mistaken for an empty one
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{"content": {"role": "model", "parts": [
+		{"inlineData": {"mimeType": "image/png", "data": "iVBORw0KGgo="}}
+	]}}]}`), &response))
+	streamResponse = streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-2.0-flash-exp")
+	dropEmptyChoices(streamResponse)
+	assert.Len(t, streamResponse.Choices, 1)
+}
+
+func TestResponseGeminiChat2OpenAICitations(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{
+		"content": {"role": "model", "parts": [{"text": "To be, or not to be, that is the question."}]},
+		"finishReason": "STOP",
+		"citationMetadata": {"citationSources": [
+			{"startIndex": 0, "endIndex": 18, "uri": "https://example.com/hamlet", "license": "public domain"},
+			{"startIndex": 20, "endIndex": 42, "uri": "https://example.org/quotes"}
+		]}
+	}]}`), &response))
+	require.NotNil(t, response.Candidates[0].CitationMetadata)
+	require.Len(t, response.Candidates[0].CitationMetadata.CitationSources, 2)
+
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Nil(t, fullTextResponse.Choices[0].Citations)
+
+	defer func(enabled bool) { config.GeminiCitationsEnabled = enabled }(config.GeminiCitationsEnabled)
+	config.GeminiCitationsEnabled = true
+	fullTextResponse = responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, []openai.Citation{
+		{StartIndex: 0, EndIndex: 18, URL: "https://example.com/hamlet", License: "public domain"},
+		{StartIndex: 20, EndIndex: 42, URL: "https://example.org/quotes"},
+	}, fullTextResponse.Choices[0].Citations)
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	assert.Len(t, streamResponse.Choices[0].Citations, 2)
+}
+
+func TestGoogleSearchGrounding(t *testing.T) {
+	newRequest := func(modelName string) model.GeneralOpenAIRequest {
+		return model.GeneralOpenAIRequest{
+			Model:            modelName,
+			Messages:         []model.Message{{Role: "user", Content: "Who won the 2024 Euro?"}},
+			WebSearchOptions: &model.WebSearchOptions{},
+		}
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), newRequest("gemini-1.5-flash"))
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Tools, 1)
+	assert.NotNil(t, geminiRequest.Tools[0].GoogleSearchRetrieval)
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-2.0-flash"))
+	require.NoError(t, err)
+	data, err := json.Marshal(geminiRequest.Tools)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"google_search": {}}]`, string(data))
+	geminiRequest, err = ConvertRequest(context.Background(), newRequest("gemini-pro"))
+	require.NoError(t, err)
+	assert.Nil(t, geminiRequest.Tools)
+
+	const body = `{"candidates": [{
+		"content": {"role": "model", "parts": [{"text": "Spain won the 2024 Euro."}]},
+		"finishReason": "STOP",
+		"groundingMetadata": {
+			"webSearchQueries": ["euro 2024 winner"],
+			"groundingChunks": [
+				{"web": {"uri": "https://example.com/euro", "title": "example.com"}},
+				{"web": {"uri": "https://example.org/final", "title": "example.org"}}
+			],
+			"groundingSupports": [{"segment": {"endIndex": 24, "text": "Spain won the 2024 Euro."}, "groundingChunkIndices": [0, 1, 7]}]
+		}
+	}], "usageMetadata": {"promptTokenCount": 8, "candidatesTokenCount": 7, "totalTokenCount": 15}}`
+	expected := []model.Annotation{
+		{Type: "url_citation", URLCitation: &model.URLCitation{EndIndex: 24, Title: "example.com", URL: "https://example.com/euro"}},
+		{Type: "url_citation", URLCitation: &model.URLCitation{EndIndex: 24, Title: "example.org", URL: "https://example.org/final"}},
+	}
+	c, w := newTestContext()
+	errWithStatusCode, _ := Handler(c, newTestResponse(http.StatusOK, body), 0, "gemini-2.0-flash")
+	require.Nil(t, errWithStatusCode)
+	var fullTextResponse openai.TextResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &fullTextResponse))
+	assert.Equal(t, expected, fullTextResponse.Choices[0].Message.Annotations)
+
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &response))
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-2.0-flash")
+	assert.Equal(t, expected, streamResponse.Choices[0].Delta.Annotations)
+}
+
+func TestResponseGeminiChat2OpenAISafetyRatings(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{
+		"content": {"role": "model", "parts": [{"text": "Hello!"}]},
+		"finishReason": "STOP",
+		"safetyRatings": [
+			{"category": "HARM_CATEGORY_HARASSMENT", "probability": "NEGLIGIBLE"},
+			{"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "probability": "LOW"}
+		]
+	}]}`), &response))
+
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Nil(t, fullTextResponse.Choices[0].SafetyRatings)
+	data, err := json.Marshal(fullTextResponse)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "safety_ratings")
+
+	defer func(enabled bool) { config.GeminiSafetyRatingsEnabled = enabled }(config.GeminiSafetyRatingsEnabled)
+	config.GeminiSafetyRatingsEnabled = true
+	fullTextResponse = responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, []openai.SafetyRating{
+		{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE"},
+		{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "LOW"},
+	}, fullTextResponse.Choices[0].SafetyRatings)
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	assert.Len(t, streamResponse.Choices[0].SafetyRatings, 2)
+}
+
+func TestResponseGeminiChat2OpenAIAvgLogprob(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": "Hello!"}]}, "finishReason": "STOP", "avgLogprobs": -0.25},
+		{"content": {"role": "model", "parts": [{"text": "Hi!"}]}, "finishReason": "STOP", "index": 1}
+	]}`), &response))
+
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-1.5-pro")
+	assert.Nil(t, fullTextResponse.Choices[0].AvgLogprob)
+	data, err := json.Marshal(fullTextResponse)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "avg_logprob")
+
+	defer func(enabled bool) { config.GeminiAvgLogprobsEnabled = enabled }(config.GeminiAvgLogprobsEnabled)
+	config.GeminiAvgLogprobsEnabled = true
+	fullTextResponse = responseGeminiChat2OpenAI(&response, "gemini-1.5-pro")
+	require.NotNil(t, fullTextResponse.Choices[0].AvgLogprob)
+	assert.Equal(t, -0.25, *fullTextResponse.Choices[0].AvgLogprob)
+	// a candidate without avgLogprobs gets no field rather than a misleading 0
+	assert.Nil(t, fullTextResponse.Choices[1].AvgLogprob)
+	data, err = json.Marshal(fullTextResponse)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"avg_logprob":-0.25`)
+
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-1.5-pro")
+	require.NotNil(t, streamResponse.Choices[0].AvgLogprob)
+	assert.Equal(t, -0.25, *streamResponse.Choices[0].AvgLogprob)
+}
+
+func TestConvertRequestSeed(t *testing.T) {
+	request := model.GeneralOpenAIRequest{
+		Model:    "gemini-1.5-pro",
+		Messages: []model.Message{{Role: "user", Content: "Pick a number"}},
+		Seed:     42,
+	}
+	first, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	second, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	firstBody, err := json.Marshal(first)
+	require.NoError(t, err)
+	secondBody, err := json.Marshal(second)
+	require.NoError(t, err)
+	assert.Equal(t, string(firstBody), string(secondBody))
+	assert.Contains(t, string(firstBody), `"seed":42`)
+
+	request.Model = "gemini-2.0-flash"
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 42, geminiRequest.GenerationConfig.Seed)
+
+	request.Model = "gemini-pro"
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	body, err := json.Marshal(geminiRequest)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "seed")
+}
+
+func TestLogprobs(t *testing.T) {
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:       "gemini-1.5-flash",
+		Messages:    []model.Message{{Role: "user", Content: "Hi"}},
+		Logprobs:    true,
+		TopLogprobs: 50,
+	})
+	require.NoError(t, err)
+	assert.True(t, geminiRequest.GenerationConfig.ResponseLogprobs)
+	assert.Equal(t, MaxTopLogprobs, geminiRequest.GenerationConfig.Logprobs)
+
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+		Logprobs: true,
+	})
+	require.NoError(t, err)
+	assert.True(t, geminiRequest.GenerationConfig.ResponseLogprobs)
+
+	geminiRequest, err = ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hi"}},
+		Logprobs: true,
+	})
+	require.NoError(t, err)
+	assert.False(t, geminiRequest.GenerationConfig.ResponseLogprobs)
+
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{
+		"content": {"role": "model", "parts": [{"text": "Hello!"}]},
+		"finishReason": "STOP",
+		"avgLogprobs": -0.05,
+		"logprobsResult": {
+			"topCandidates": [
+				{"candidates": [{"token": "Hello", "tokenId": 1, "logProbability": -0.01}, {"token": "Hi", "tokenId": 2, "logProbability": -4.6}]},
+				{"candidates": [{"token": "!", "tokenId": 3, "logProbability": -0.09}]}
+			],
+			"chosenCandidates": [
+				{"token": "Hello", "tokenId": 1, "logProbability": -0.01},
+				{"token": "!", "tokenId": 3, "logProbability": -0.09}
+			]
+		}
+	}]}`), &response))
+
+	expected := &openai.Logprobs{Content: []openai.TokenLogprob{
+		{Token: "Hello", Logprob: -0.01, Bytes: []int{72, 101, 108, 108, 111}, TopLogprobs: []openai.TopLogprob{
+			{Token: "Hello", Logprob: -0.01, Bytes: []int{72, 101, 108, 108, 111}},
+			{Token: "Hi", Logprob: -4.6, Bytes: []int{72, 105}},
+		}},
+		{Token: "!", Logprob: -0.09, Bytes: []int{33}, TopLogprobs: []openai.TopLogprob{
+			{Token: "!", Logprob: -0.09, Bytes: []int{33}},
+		}},
+	}}
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, expected, fullTextResponse.Choices[0].Logprobs)
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-1.5-flash")
+	assert.Equal(t, expected, streamResponse.Choices[0].Logprobs)
+
+	response.Candidates[0].LogprobsResult = nil
+	assert.Nil(t, responseGeminiChat2OpenAI(&response, "gemini-pro").Choices[0].Logprobs)
+}
+
+func TestResponseGeminiChat2OpenAIThoughts(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{
+		"content": {"role": "model", "parts": [
+			{"text": "The user greets me, greet back.", "thought": true},
+			{"text": "Hello!"}
+		]},
+		"finishReason": "STOP"
+	}]}`), &response))
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, "Hello!", fullTextResponse.Choices[0].Message.Content)
+	assert.Equal(t, "The user greets me, greet back.", fullTextResponse.Choices[0].Message.ReasoningContent)
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	assert.Equal(t, "Hello!", streamResponse.Choices[0].Delta.Content)
+	assert.Equal(t, "The user greets me, greet back.", streamResponse.Choices[0].Delta.ReasoningContent)
+
+	defer func(enabled bool) { config.GeminiReasoningContentEnabled = enabled }(config.GeminiReasoningContentEnabled)
+	config.GeminiReasoningContentEnabled = false
+	fullTextResponse = responseGeminiChat2OpenAI(&response, "gemini-pro")
+	assert.Equal(t, "Hello!", fullTextResponse.Choices[0].Message.Content)
+	assert.Empty(t, fullTextResponse.Choices[0].Message.ReasoningContent)
+	data, err := json.Marshal(fullTextResponse)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "reasoning_content")
+}
+
+func TestBlockedResponseDoesNotPanic(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(blockedResponseFixture), &response))
+	require.Len(t, response.Candidates, 1)
+	assert.Nil(t, response.Candidates[0].Content.Parts)
+
+	assert.NotPanics(t, func() {
+		assert.Empty(t, response.GetResponseText())
+		assert.Empty(t, getToolCalls(&response.Candidates[0]))
+		fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+		assert.Equal(t, "content_filter", fullTextResponse.Choices[0].FinishReason)
+		streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+		assert.Equal(t, "", streamResponse.Choices[0].Delta.Content)
+	})
+}
+
+func TestToolCallRoundTrip(t *testing.T) {
+	weatherTool := model.Tool{
+		Type: "function",
+		Function: model.Function{
+			Name:        "get_current_weather",
+			Description: "Get the current weather in a given location",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"location": map[string]any{"type": "string"},
+				},
+				"required": []any{"location"},
+			},
+		},
+	}
+	request := model.GeneralOpenAIRequest{
+		Model:      "gemini-1.5-pro",
+		Messages:   []model.Message{{Role: "user", Content: "What's the weather like in Boston?"}},
+		Tools:      []model.Tool{weatherTool},
+		ToolChoice: "auto",
+	}
+	geminiRequest, err := ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Tools, 1)
+	assert.Equal(t, []model.Function{weatherTool.Function}, geminiRequest.Tools[0].FunctionDeclarations)
+	require.NotNil(t, geminiRequest.ToolConfig)
+	assert.Equal(t, "AUTO", geminiRequest.ToolConfig.FunctionCallingConfig.Mode)
+
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[
+		{"functionCall":{"name":"get_current_weather","args":{"location":"Boston"}}}
+	]},"finishReason":"STOP","index":0}]}`), &response))
+	fullTextResponse := responseGeminiChat2OpenAI(&response, "gemini-pro")
+	require.Len(t, fullTextResponse.Choices, 1)
+	choice := fullTextResponse.Choices[0]
+	assert.Equal(t, "tool_calls", choice.FinishReason)
+	require.Len(t, choice.Message.ToolCalls, 1)
+	toolCall := choice.Message.ToolCalls[0]
+	assert.Equal(t, "function", toolCall.Type)
+	assert.Equal(t, "get_current_weather", toolCall.Function.Name)
+	assert.JSONEq(t, `{"location":"Boston"}`, toolCall.Function.Arguments.(string))
+
+	// the assistant tool call is sent back to gemini as a functionCall part
+	request.Messages = append(request.Messages, model.Message{Role: "assistant", ToolCalls: choice.Message.ToolCalls})
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 2)
+	assert.Equal(t, "model", geminiRequest.Contents[1].Role)
+	functionCall := geminiRequest.Contents[1].Parts[0].FunctionCall
+	require.NotNil(t, functionCall)
+	assert.Equal(t, "get_current_weather", functionCall.FunctionName)
+	assert.Equal(t, map[string]any{"location": "Boston"}, functionCall.Arguments)
+
+	// the tool result goes back as a functionResponse named after the call it answers
+	request.Messages = append(request.Messages, model.Message{Role: "tool", ToolCallId: toolCall.Id, Content: `{"temperature": 22, "unit": "celsius"}`})
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 3)
+	assert.Equal(t, "user", geminiRequest.Contents[2].Role)
+	require.Len(t, geminiRequest.Contents[2].Parts, 1)
+	functionResponse := geminiRequest.Contents[2].Parts[0].FunctionResponse
+	require.NotNil(t, functionResponse)
+	assert.Equal(t, "get_current_weather", functionResponse.Name)
+	assert.Equal(t, map[string]any{"temperature": float64(22), "unit": "celsius"}, functionResponse.Response)
+	assert.Empty(t, geminiRequest.Contents[2].Parts[0].Text)
+
+	// plain text results are wrapped in an object
+	request.Messages[len(request.Messages)-1].Content = "22 degrees and sunny"
+	geminiRequest, err = ConvertRequest(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"content": "22 degrees and sunny"}, geminiRequest.Contents[2].Parts[0].FunctionResponse.Response)
+
+	// a result for a call that was never made can't be named
+	request.Messages[len(request.Messages)-1].ToolCallId = "call_unknown"
+	_, err = ConvertRequest(context.Background(), request)
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.ErrorContains(t, err, "call_unknown")
+}
+
+func newTestContext() (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	return c, w
+}
+
+func newTestResponse(statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestResponseGeminiChat2OpenAITextAndFunctionCall(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [{
+		"content": {"role": "model", "parts": [
+			{"text": "Let me check the weather in both cities."},
+			{"functionCall": {"name": "get_current_weather", "args": {"location": "Boston"}}},
+			{"functionCall": {"name": "get_current_weather", "args": {"location": "Paris"}}}
+		]},
+		"finishReason": "STOP"
+	}]}`), &response))
+
+	choice := responseGeminiChat2OpenAI(&response, "gemini-1.5-pro").Choices[0]
+	assert.Equal(t, "Let me check the weather in both cities.", choice.Message.Content)
+	require.Len(t, choice.Message.ToolCalls, 2)
+	assert.Equal(t, `{"location":"Boston"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, `{"location":"Paris"}`, choice.Message.ToolCalls[1].Function.Arguments)
+	assert.Equal(t, "tool_calls", choice.FinishReason)
+
+	// without any text the content stays null, as with OpenAI
+	response.Candidates[0].Content.Parts = response.Candidates[0].Content.Parts[1:]
+	choice = responseGeminiChat2OpenAI(&response, "gemini-1.5-pro").Choices[0]
+	assert.Nil(t, choice.Message.Content)
+	assert.Len(t, choice.Message.ToolCalls, 2)
+}
+
+func TestHandlerUsesUsageMetadata(t *testing.T) {
+	c, w := newTestContext()
+	resp := newTestResponse(http.StatusOK, `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello there"}]}, "finishReason": "STOP", "index": 0}],
+		"usageMetadata": {"promptTokenCount": 7, "candidatesTokenCount": 3, "totalTokenCount": 10}
+	}`)
+	errWithStatusCode, usage := Handler(c, resp, 100, "gemini-pro")
+	require.Nil(t, errWithStatusCode)
+	require.NotNil(t, usage)
+	assert.Equal(t, model.Usage{PromptTokens: 7, CompletionTokens: 3, TotalTokens: 10}, *usage)
+	assert.Contains(t, w.Body.String(), `"prompt_tokens":7`)
+}
+
+func TestHandlerCachedTokens(t *testing.T) {
+	c, w := newTestContext()
+	resp := newTestResponse(http.StatusOK, `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello there"}]}, "finishReason": "STOP", "index": 0}],
+		"usageMetadata": {"promptTokenCount": 40000, "candidatesTokenCount": 3, "totalTokenCount": 40003, "cachedContentTokenCount": 32768}
+	}`)
+	errWithStatusCode, usage := Handler(c, resp, 100, "gemini-1.5-pro")
+	require.Nil(t, errWithStatusCode)
+	require.NotNil(t, usage)
+	require.NotNil(t, usage.PromptTokensDetails)
+	assert.Equal(t, 32768, usage.PromptTokensDetails.CachedTokens)
+	assert.Equal(t, 40000, usage.PromptTokens)
+	assert.Contains(t, w.Body.String(), `"prompt_tokens_details":{"cached_tokens":32768}`)
+
+	// without a cache the details are left out
+	c, w = newTestContext()
+	resp = newTestResponse(http.StatusOK, `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello there"}]}, "finishReason": "STOP", "index": 0}],
+		"usageMetadata": {"promptTokenCount": 7, "candidatesTokenCount": 3, "totalTokenCount": 10}
+	}`)
+	errWithStatusCode, usage = Handler(c, resp, 100, "gemini-1.5-pro")
+	require.Nil(t, errWithStatusCode)
+	assert.Nil(t, usage.PromptTokensDetails)
+	assert.NotContains(t, w.Body.String(), "prompt_tokens_details")
+}
+
+func TestHandlerBillsThoughtsTokens(t *testing.T) {
+	const usageMetadata = `"usageMetadata": {"promptTokenCount": 12, "candidatesTokenCount": 5, "thoughtsTokenCount": 240, "totalTokenCount": 257}`
+	expected := model.Usage{PromptTokens: 12, CompletionTokens: 245, TotalTokens: 257}
+
+	c, w := newTestContext()
+	resp := newTestResponse(http.StatusOK, `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Paris"}]}, "finishReason": "STOP", "index": 0}],
+		`+usageMetadata+`, "modelVersion": "gemini-2.5-flash"
+	}`)
+	errWithStatusCode, usage := Handler(c, resp, 100, "gemini-2.5-flash")
+	require.Nil(t, errWithStatusCode)
+	require.NotNil(t, usage)
+	assert.Equal(t, expected, *usage)
+	assert.Contains(t, w.Body.String(), `"completion_tokens":245`)
+
+	c, _ = newTestContext()
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Par\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"is\"}]}, \"finishReason\": \"STOP\"}], " + usageMetadata + "}\n\n"
+	errWithStatusCode, _, usage = StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-2.5-flash", false)
+	require.Nil(t, errWithStatusCode)
+	require.NotNil(t, usage)
+	assert.Equal(t, expected, *usage)
+}
+
+func TestHandlerMultipleCandidatesUsage(t *testing.T) {
+	defer func(enabled bool) { config.ApproximateTokenEnabled = enabled }(config.ApproximateTokenEnabled)
+	config.ApproximateTokenEnabled = true
+	const first, second = "The quick brown fox jumps over the lazy dog.", "A journey of a thousand miles begins with a single step."
+	body := fmt.Sprintf(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": %q}]}, "finishReason": "STOP", "index": 0},
+		{"content": {"role": "model", "parts": [{"text": %q}]}, "finishReason": "STOP", "index": 1}
+	]}`, first, second)
+	c, _ := newTestContext()
+	errWithStatusCode, usage := Handler(c, newTestResponse(http.StatusOK, body), 10, "gemini-1.5-flash")
+	require.Nil(t, errWithStatusCode)
+	completionTokens := openai.CountTokenText(first, TokenizerModel) + openai.CountTokenText(second, TokenizerModel)
+	assert.Greater(t, openai.CountTokenText(second, TokenizerModel), 0)
+	assert.Equal(t, completionTokens, usage.CompletionTokens)
+	assert.Equal(t, 10+completionTokens, usage.TotalTokens)
+
+	// usageMetadata already sums up all candidates
+	body = fmt.Sprintf(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": %q}]}, "finishReason": "STOP", "index": 0},
+		{"content": {"role": "model", "parts": [{"text": %q}]}, "finishReason": "STOP", "index": 1}
+	], "usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 23, "totalTokenCount": 33}}`, first, second)
+	c, _ = newTestContext()
+	errWithStatusCode, usage = Handler(c, newTestResponse(http.StatusOK, body), 10, "gemini-1.5-flash")
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, 23, usage.CompletionTokens)
+}
+
+func TestHandlerEstimatesUsageForUnknownModel(t *testing.T) {
+	// real encoders are downloaded on init, the approximation keeps this test offline
+	defer func(enabled bool) { config.ApproximateTokenEnabled = enabled }(config.ApproximateTokenEnabled)
+	config.ApproximateTokenEnabled = true
+
+	c, _ := newTestContext()
+	resp := newTestResponse(http.StatusOK, `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello there, how can I help you today?"}]}, "finishReason": "STOP"}]
+	}`)
+	errWithStatusCode, usage := Handler(c, resp, 5, "gemini-some-future-model")
+	require.Nil(t, errWithStatusCode)
+	require.NotNil(t, usage)
+	assert.Equal(t, 5, usage.PromptTokens)
+	assert.Greater(t, usage.CompletionTokens, 0)
+	assert.Equal(t, usage.PromptTokens+usage.CompletionTokens, usage.TotalTokens)
+}
+
+func TestHandlerUnparsableBody(t *testing.T) {
+	c, _ := newTestContext()
+	page := "<html>\r\n<head><title>502 Bad Gateway</title></head>\x1b[0m" + strings.Repeat("<p>nginx</p>", 100) + "</html>"
+	errWithStatusCode, usage := Handler(c, newTestResponse(http.StatusOK, page), 0, "gemini-pro")
+	assert.Nil(t, usage)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, "unmarshal_response_body_failed", errWithStatusCode.Code)
+	assert.Contains(t, errWithStatusCode.Message, `body: "<html>\r\n<head><title>502 Bad Gateway</title></head>\x1b[0m<p>nginx`)
+	assert.True(t, strings.HasSuffix(errWithStatusCode.Message, `"...`))
+	assert.NotContains(t, errWithStatusCode.Message, "\r")
+	assert.Less(t, len(errWithStatusCode.Message), 2*bodySnippetSize)
+
+	assert.Equal(t, `"rate limited"`, bodySnippet([]byte("rate limited")))
+}
+
+func TestHandlerPromptBlocked(t *testing.T) {
+	c, _ := newTestContext()
+	resp := newTestResponse(http.StatusOK, `{
+		"promptFeedback": {
+			"blockReason": "SAFETY",
+			"safetyRatings": [
+				{"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "probability": "NEGLIGIBLE"},
+				{"category": "HARM_CATEGORY_HARASSMENT", "probability": "HIGH", "blocked": true}
+			]
+		}
+	}`)
+	errWithStatusCode, usage := Handler(c, resp, 12, "gemini-pro")
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusBadRequest, errWithStatusCode.StatusCode)
+	assert.Equal(t, "content_filter", errWithStatusCode.Code)
+	assert.Contains(t, errWithStatusCode.Message, "SAFETY")
+	assert.Contains(t, errWithStatusCode.Message, "HARM_CATEGORY_HARASSMENT")
+	// gemini processed the prompt, it is billed with the local estimate
+	assert.True(t, errWithStatusCode.Billed)
+	assert.Equal(t, &model.Usage{PromptTokens: 12, TotalTokens: 12}, usage)
+
+	c, _ = newTestContext()
+	resp = newTestResponse(http.StatusOK, `{
+		"promptFeedback": {"blockReason": "PROHIBITED_CONTENT"},
+		"usageMetadata": {"promptTokenCount": 9, "totalTokenCount": 9}
+	}`)
+	errWithStatusCode, usage = Handler(c, resp, 12, "gemini-pro")
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, &model.Usage{PromptTokens: 9, TotalTokens: 9}, usage)
+
+	// any other failure is not billed
+	c, _ = newTestContext()
+	errWithStatusCode, usage = Handler(c, newTestResponse(http.StatusOK, `{"candidates": []}`), 12, "gemini-pro")
+	require.NotNil(t, errWithStatusCode)
+	assert.False(t, errWithStatusCode.Billed)
+	assert.Nil(t, usage)
+}
+
+func TestHandlerPromptBlockReasons(t *testing.T) {
+	for _, test := range []struct {
+		blockReason string
+		code        string
+	}{
+		{"SAFETY", "content_filter"},
+		{"BLOCKLIST", "content_filter"},
+		{"PROHIBITED_CONTENT", "content_filter"},
+		{"OTHER", "invalid_request"},
+		{"BLOCK_REASON_UNSPECIFIED", "invalid_request"},
+	} {
+		c, _ := newTestContext()
+		resp := newTestResponse(http.StatusOK, fmt.Sprintf(`{"promptFeedback": {"blockReason": %q,
+			"safetyRatings": [{"category": "HARM_CATEGORY_HATE_SPEECH", "probability": "HIGH", "blocked": true}]}}`, test.blockReason))
+		errWithStatusCode, _ := Handler(c, resp, 5, "gemini-1.5-pro")
+		require.NotNil(t, errWithStatusCode, test.blockReason)
+		assert.Equal(t, http.StatusBadRequest, errWithStatusCode.StatusCode, test.blockReason)
+		assert.Equal(t, "invalid_request_error", errWithStatusCode.Type, test.blockReason)
+		assert.Equal(t, test.code, errWithStatusCode.Code, test.blockReason)
+		assert.Contains(t, errWithStatusCode.Message, "block reason: "+test.blockReason)
+		// the category only explains content filtering
+		if test.code == "content_filter" {
+			assert.Contains(t, errWithStatusCode.Message, "HARM_CATEGORY_HATE_SPEECH", test.blockReason)
+		} else {
+			assert.NotContains(t, errWithStatusCode.Message, "HARM_CATEGORY_HATE_SPEECH", test.blockReason)
+		}
+	}
+}
+
+func TestHandlerPropagatesUpstreamError(t *testing.T) {
+	c, _ := newTestContext()
+	resp := newTestResponse(http.StatusTooManyRequests, `{
+		"error": {"code": 429, "message": "Resource has been exhausted (e.g. check quota).", "status": "RESOURCE_EXHAUSTED"}
+	}`)
+	errWithStatusCode, usage := Handler(c, resp, 0, "gemini-pro")
+	assert.Nil(t, usage)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, errWithStatusCode.StatusCode)
+	assert.Equal(t, "Resource has been exhausted (e.g. check quota).", errWithStatusCode.Message)
+	assert.Equal(t, "RESOURCE_EXHAUSTED", errWithStatusCode.Code)
+}
+
+func TestHandlerErrorInSuccessfulResponse(t *testing.T) {
+	const body = `{"error": {"code": 503, "message": "The model is overloaded. Please try again later.", "status": "UNAVAILABLE"}}`
+	c, recorder := newTestContext()
+	errWithStatusCode, usage := Handler(c, newTestResponse(http.StatusOK, body), 10, "gemini-1.5-pro")
+	assert.Nil(t, usage)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, errWithStatusCode.StatusCode)
+	assert.Equal(t, "The model is overloaded. Please try again later.", errWithStatusCode.Message)
+	assert.Equal(t, "UNAVAILABLE", errWithStatusCode.Code)
+	assert.Empty(t, recorder.Body.String())
+
+	// an error without a usable code is still an error, never a 200
+	c, _ = newTestContext()
+	errWithStatusCode, _, _ = FakeStreamHandler(c, newTestResponse(http.StatusOK, `{"error": {"message": "Internal error"}}`), "gemini-1.5-pro", false)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusInternalServerError, errWithStatusCode.StatusCode)
+
+	c, _ = newTestContext()
+	errWithStatusCode, _ = EmbeddingHandler(c, newTestResponse(http.StatusOK, body), 10, "text-embedding-004")
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, errWithStatusCode.StatusCode)
+}
+
+func TestStreamResponseMultipleCandidates(t *testing.T) {
+	var response ChatResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"candidates": [
+		{"content": {"role": "model", "parts": [{"text": "Hello"}]}},
+		{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "index": 1}
+	]}`), &response))
+	streamResponse := streamResponseGeminiChat2OpenAI(&response, "chatcmpl-test", 0, "gemini-pro")
+	require.Len(t, streamResponse.Choices, 2)
+	assert.Equal(t, 0, streamResponse.Choices[0].Index)
+	assert.Equal(t, "Hello", streamResponse.Choices[0].Delta.Content)
+	assert.Equal(t, 1, streamResponse.Choices[1].Index)
+	assert.Equal(t, "Hi", streamResponse.Choices[1].Delta.Content)
+
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model:    "gemini-1.5-pro",
+		Messages: []model.Message{{Role: "user", Content: "Hello"}},
+		N:        2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, geminiRequest.GenerationConfig.CandidateCount)
+}
+
+func TestStreamHandlerIncludeUsage(t *testing.T) {
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \" world\"}]}, \"finishReason\": \"STOP\"}], " +
+		"\"usageMetadata\": {\"promptTokenCount\": 4, \"candidatesTokenCount\": 2, \"totalTokenCount\": 6}}\n\n"
+
+	c, w := newTestContext()
+	errWithStatusCode, responseText, usage := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-pro", true)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello world", responseText)
+	require.NotNil(t, usage)
+	assert.Equal(t, 4, usage.PromptTokens)
+	assert.Equal(t, 2, usage.CompletionTokens)
+	assert.Contains(t, w.Body.String(), `"usage":{"prompt_tokens":4,"completion_tokens":2,"total_tokens":6}`)
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(w.Body.String()), "data: [DONE]"))
+
+	c, w = newTestContext()
+	_, _, usage = StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-pro", false)
+	require.NotNil(t, usage)
+	assert.NotContains(t, w.Body.String(), `"usage"`)
+}
+
+// flushRecorder keeps what had been written at every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.ResponseRecorder.Flush()
+	r.flushed = append(r.flushed, r.Body.String())
+}
+
+func TestStreamHandlerDisablesBuffering(t *testing.T) {
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \" world\"}]}, \"finishReason\": \"STOP\"}]}\n\n"
+
+	gin.SetMode(gin.TestMode)
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	errWithStatusCode, _, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "keep-alive", w.Header().Get("Connection"))
+	assert.Equal(t, "no", w.Header().Get("X-Accel-Buffering"))
+	// every chunk is flushed on its own, [DONE] included
+	require.Len(t, w.flushed, 3)
+	assert.Contains(t, w.flushed[0], "Hello")
+	assert.NotContains(t, w.flushed[0], "world")
+	assert.Contains(t, w.flushed[1], "world")
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(w.flushed[2]), "data: [DONE]"))
+}
+
+func TestStreamHandlerSharesIdAcrossChunks(t *testing.T) {
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \" world\"}]}, \"finishReason\": \"STOP\"}], " +
+		"\"usageMetadata\": {\"promptTokenCount\": 4, \"candidatesTokenCount\": 2, \"totalTokenCount\": 6}}\n\n"
+
+	c, w := newTestContext()
+	errWithStatusCode, _, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-1.5-flash", true)
+	require.Nil(t, errWithStatusCode)
+
+	var chunks []openai.ChatCompletionsStreamResponse
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk openai.ChatCompletionsStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+	require.Len(t, chunks, 3)
+	for _, chunk := range chunks {
+		assert.Equal(t, chunks[0].Id, chunk.Id)
+		assert.Equal(t, chunks[0].Created, chunk.Created)
+		assert.Equal(t, "gemini-1.5-flash", chunk.Model)
+	}
+	assert.True(t, strings.HasPrefix(chunks[0].Id, "chatcmpl-"))
+}
+
+func TestStreamHandlerToolCallDeltas(t *testing.T) {
+	body := "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Let me check.\"}, " +
+		"{\"functionCall\": {\"name\": \"get_weather\", \"args\": {\"city\": \"Paris\"}}}]}}]}\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"functionCall\": {\"name\": \"get_time\", \"args\": {\"zone\": \"CET\"}}}]}, " +
+		"\"finishReason\": \"STOP\"}], \"usageMetadata\": {\"promptTokenCount\": 20, \"candidatesTokenCount\": 12, \"totalTokenCount\": 32}}\n\n"
+
+	c, w := newTestContext()
+	errWithStatusCode, _, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-1.5-pro", false)
+	require.Nil(t, errWithStatusCode)
+
+	var toolCalls []model.Tool
+	var finishReasons []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		// OpenAI clients rely on every tool call delta carrying its index
+		assert.NotContains(t, data, `"tool_calls":[{"id"`)
+		var chunk openai.ChatCompletionsStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		require.Len(t, chunk.Choices, 1)
+		toolCalls = append(toolCalls, chunk.Choices[0].Delta.ToolCalls...)
+		if chunk.Choices[0].FinishReason != nil {
+			finishReasons = append(finishReasons, *chunk.Choices[0].FinishReason)
+		}
+	}
+	require.Len(t, toolCalls, 2)
+	for i, toolCall := range toolCalls {
+		require.NotNil(t, toolCall.Index)
+		assert.Equal(t, i, *toolCall.Index)
+		assert.True(t, strings.HasPrefix(toolCall.Id, "call_"))
+		assert.Equal(t, "function", toolCall.Type)
+	}
+	assert.NotEqual(t, toolCalls[0].Id, toolCalls[1].Id)
+	assert.Equal(t, "get_weather", toolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"Paris"}`, toolCalls[0].Function.Arguments)
+	assert.Equal(t, "get_time", toolCalls[1].Function.Name)
+	assert.Equal(t, `{"zone":"CET"}`, toolCalls[1].Function.Arguments)
+	assert.Equal(t, []string{"tool_calls"}, finishReasons)
+}
+
+func TestStreamHandlerJSONArray(t *testing.T) {
+	// element boundaries deliberately fall in the middle of the writes
+	pieces := []string{
+		`[{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hel`,
+		`lo"}]}}]}` + "\r\n,\r\n" + `{"candidates": [{"content": {"role": "model", "parts": [{"text": " wor`,
+		`ld"}]}, "finishReason": "STOP"}], "usageMetadata": {"promptTokenCount": 4, "candidatesTokenCount": 2, "totalTokenCount": 6}}` + "\r\n]",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		for _, piece := range pieces {
+			_, _ = w.Write([]byte(piece))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	c, w := newTestContext()
+	errWithStatusCode, responseText, usage := StreamHandler(c, resp, "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello world", responseText)
+	require.NotNil(t, usage)
+	assert.Equal(t, 6, usage.TotalTokens)
+
+	var contents []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+		var chunk openai.ChatCompletionsStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		contents = append(contents, chunk.Choices[0].Delta.StringContent())
+	}
+	assert.Equal(t, []string{"Hello", " world"}, contents)
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(w.Body.String()), "data: [DONE]"))
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	maxResponseSize := config.GeminiMaxResponseSize
+	config.GeminiMaxResponseSize = 1
+	defer func() { config.GeminiMaxResponseSize = maxResponseSize }()
+
+	text := strings.Repeat("a", 600*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := `{"candidates": [{"content": {"role": "model", "parts": [{"text": "` + text + `"}]}}]}`
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 4; i++ {
+				_, _ = w.Write([]byte("data: " + chunk + "\n\n"))
+			}
+			return
+		}
+		// an endless body, reading it all would never finish
+		for r.Context().Err() == nil {
+			if _, err := w.Write([]byte(chunk)); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	c, _ := newTestContext()
+	errWithStatusCode, _ := Handler(c, resp, 0, "gemini-pro")
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusBadGateway, errWithStatusCode.StatusCode)
+	assert.Equal(t, "response_too_large", errWithStatusCode.Code)
+
+	resp, err = http.Get(server.URL + "/stream")
+	require.NoError(t, err)
+	c, w := newTestContext()
+	errWithStatusCode, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Len(t, responseText, 2*len(text))
+	assert.Contains(t, w.Body.String(), `"code":"response_too_large"`)
+	assert.Equal(t, 2, strings.Count(w.Body.String(), text))
+}
+
+func TestStreamHandlerKeepalive(t *testing.T) {
+	keepaliveInterval := config.GeminiStreamKeepaliveInterval
+	config.GeminiStreamKeepaliveInterval = 1
+	defer func() { config.GeminiStreamKeepaliveInterval = keepaliveInterval }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		time.Sleep(1500 * time.Millisecond)
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hello\"}]},\"finishReason\":\"STOP\"}]}\n\n"))
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	c, w := newTestContext()
+	errWithStatusCode, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello", responseText)
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, ": keepalive\n\n"))
+	assert.Equal(t, 1, strings.Count(body, ": keepalive"))
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(body), "data: [DONE]"))
+}
+
+// newBlockingServer writes one SSE chunk and then hangs until the test ends
+func newBlockingServer(t *testing.T) *httptest.Server {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hello\"}]}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		server.Close()
+	})
+	return server
+}
+
+func TestStreamHandlerStopsOnClientDisconnect(t *testing.T) {
+	server := newBlockingServer(t)
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	c, _ := newTestContext()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = c.Request.WithContext(ctx)
+
+	finished := make(chan string)
+	go func() {
+		_, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+		finished <- responseText
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case responseText := <-finished:
+		assert.Equal(t, "Hello", responseText)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler did not return after the client disconnected")
+	}
+}
+
+func TestStreamHandlerDoesNotLeakOnEarlyReturn(t *testing.T) {
+	// upstream keeps producing for as long as someone reads
+	reader, writer := io.Pipe()
+	producerDone := make(chan struct{})
+	go func() {
+		defer close(producerDone)
+		chunk := []byte("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hello\"}]}}]}\n\n")
+		for {
+			if _, err := writer.Write(chunk); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: reader}
+
+	c, _ := newTestContext()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = c.Request.WithContext(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	errWithStatusCode, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.True(t, strings.HasPrefix(responseText, "Hello"))
+	select {
+	case <-producerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream writer is still blocked after the stream handler returned")
+	}
+	// the watchers StreamHandler starts must be gone as well
+	assert.Eventually(t, func() bool {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return !strings.Contains(stacks, "gemini.StreamHandler.func") && !strings.Contains(stacks, "gemini.startKeepalive.func")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamHandlerMidStreamError(t *testing.T) {
+	const firstChunk = "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}]}\n\n"
+	// lastEvent returns the error event, which has to come right before [DONE]
+	lastEvent := func(body string) map[string]map[string]any {
+		events := strings.Split(strings.TrimSpace(body), "\n\n")
+		require.GreaterOrEqual(t, len(events), 3)
+		assert.Equal(t, "data: [DONE]", events[len(events)-1])
+		var event map[string]map[string]any
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-2], "data: ")), &event))
+		return event
+	}
+
+	c, w := newTestContext()
+	body := firstChunk + "data: {\"error\": {\"code\": 500, \"message\": \"An internal error has occurred.\", \"status\": \"INTERNAL\"}}\n\n"
+	errWithStatusCode, responseText, _ := StreamHandler(c, newTestResponse(http.StatusOK, body), "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello", responseText)
+	event := lastEvent(w.Body.String())
+	require.Contains(t, event, "error")
+	assert.Equal(t, "An internal error has occurred.", event["error"]["message"])
+	assert.Equal(t, "gemini_error", event["error"]["type"])
+	assert.Equal(t, "INTERNAL", event["error"]["code"])
+
+	c, w = newTestContext()
+	resp := newTestResponse(http.StatusOK, "")
+	resp.Body = io.NopCloser(io.MultiReader(strings.NewReader(firstChunk), iotest.ErrReader(errors.New("connection reset by peer"))))
+	errWithStatusCode, responseText, _ = StreamHandler(c, resp, "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello", responseText)
+	event = lastEvent(w.Body.String())
+	assert.Contains(t, event["error"]["message"], "connection reset by peer")
+	assert.Equal(t, "upstream_stream_error", event["error"]["code"])
+	assert.NotEmpty(t, event["error"]["type"])
+
+	// a clean end has no error event
+	c, w = newTestContext()
+	errWithStatusCode, _, _ = StreamHandler(c, newTestResponse(http.StatusOK, firstChunk), "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.NotContains(t, w.Body.String(), `"error"`)
+}
+
+func TestStreamHandlerTimeout(t *testing.T) {
+	streamTimeout := config.GeminiStreamTimeout
+	config.GeminiStreamTimeout = 1
+	defer func() { config.GeminiStreamTimeout = streamTimeout }()
+
+	server := newBlockingServer(t)
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	// the stream has started, the error is the last event
+	c, w := newTestContext()
+	errWithStatusCode, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello", responseText)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"code":"upstream_timeout"`)
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(w.Body.String()), "data: [DONE]"))
+}
+
+func TestStreamHandlerTimeoutBeforeFirstChunk(t *testing.T) {
+	streamTimeout := config.GeminiStreamTimeout
+	config.GeminiStreamTimeout = 1
+	defer func() { config.GeminiStreamTimeout = streamTimeout }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	// nothing was sent yet, the caller answers with a plain JSON error
+	c, w := newTestContext()
+	errWithStatusCode, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, http.StatusGatewayTimeout, errWithStatusCode.StatusCode)
+	assert.Empty(t, responseText)
+	assert.False(t, c.Writer.Written())
+	assert.Empty(t, w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Body.String())
+}
+
+func TestStreamHandlerTimeoutWithKeepalive(t *testing.T) {
+	defer func(streamTimeout, keepaliveInterval int) {
+		config.GeminiStreamTimeout, config.GeminiStreamKeepaliveInterval = streamTimeout, keepaliveInterval
+	}(config.GeminiStreamTimeout, config.GeminiStreamKeepaliveInterval)
+	config.GeminiStreamTimeout, config.GeminiStreamKeepaliveInterval = 1, 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	// the keepalive writer races the timeout, whoever wins the error reaches the client
+	// and go test -race finds no concurrent writes
+	c, w := newTestContext()
+	errWithStatusCode, _, _ := StreamHandler(c, resp, "gemini-pro", false)
+	if errWithStatusCode != nil {
+		assert.Equal(t, http.StatusGatewayTimeout, errWithStatusCode.StatusCode)
+		assert.False(t, c.Writer.Written())
+		return
+	}
+	assert.True(t, strings.HasPrefix(w.Body.String(), ": keepalive\n\n"))
+	assert.Contains(t, w.Body.String(), `"code":"upstream_timeout"`)
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(w.Body.String()), "data: [DONE]"))
+}
+
+// strictBody fails on every Close after the first one
+type strictBody struct {
+	io.Reader
+	closeCount int
+}
+
+func (b *strictBody) Close() error {
+	b.closeCount++
+	if b.closeCount > 1 {
+		return errors.New("body closed twice")
+	}
+	return nil
+}
+
+func TestStreamHandlerClosesBodyOnce(t *testing.T) {
+	body := &strictBody{Reader: strings.NewReader("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hello\"}]},\"finishReason\":\"STOP\"}]}\n\n")}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: body}
+
+	c, w := newTestContext()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	errWithStatusCode, responseText, _ := StreamHandler(c, resp, "gemini-pro", false)
+	assert.Nil(t, errWithStatusCode)
+	assert.Equal(t, 1, body.closeCount)
+	// the client was gone before anything was sent
+	assert.Empty(t, responseText)
+	assert.Empty(t, w.Body.String())
+
+	body = &strictBody{Reader: strings.NewReader("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hello\"}]},\"finishReason\":\"STOP\"}]}\n\n")}
+	resp = &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: body}
+	c, w = newTestContext()
+	errWithStatusCode, responseText, _ = StreamHandler(c, resp, "gemini-pro", false)
+	assert.Nil(t, errWithStatusCode)
+	assert.Equal(t, "Hello", responseText)
+	assert.Equal(t, 1, body.closeCount)
+	assert.Contains(t, w.Body.String(), "data: [DONE]")
+}
+
+// notifyingRecorder signals the first write that reaches the client
+type notifyingRecorder struct {
+	*httptest.ResponseRecorder
+	once    sync.Once
+	written chan struct{}
+}
+
+func (r *notifyingRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseRecorder.Write(data)
+	r.once.Do(func() { close(r.written) })
+	return n, err
+}
+
+func TestStreamHandlerBillsDeliveredContentOnly(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hello\"}]}}],\"usageMetadata\":{\"promptTokenCount\":3,\"candidatesTokenCount\":1}}\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\" world, this was never delivered\"}]},\"finishReason\":\"STOP\"}],\"usageMetadata\":{\"promptTokenCount\":3,\"candidatesTokenCount\":8}}\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	w := &notifyingRecorder{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{})}
+	c, _ := gin.CreateTestContext(w)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+
+	type result struct {
+		responseText string
+		usage        *model.Usage
+	}
+	finished := make(chan result)
+	go func() {
+		_, responseText, usage := StreamHandler(c, resp, "gemini-pro", false)
+		finished <- result{responseText, usage}
+	}()
+	<-w.written
+	cancel()
+	close(release)
+	select {
+	case r := <-finished:
+		assert.Equal(t, "Hello", r.responseText)
+		require.NotNil(t, r.usage)
+		assert.Equal(t, 1, r.usage.CompletionTokens)
+		assert.NotContains(t, w.Body.String(), "never delivered")
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler did not return after the client disconnected")
+	}
+}
+
+func TestErrorHandlerAPIKeyErrors(t *testing.T) {
+	for name, testCase := range map[string]struct {
+		statusCode   int
+		body         string
+		unauthorized bool
+	}{
+		"malformed key": {http.StatusBadRequest, `{"error": {"code": 400, "message": "API key not valid. Please pass a valid API key.", "status": "INVALID_ARGUMENT",
+			"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "API_KEY_INVALID", "domain": "googleapis.com"}]}}`, true},
+		"revoked key": {http.StatusForbidden, `{"error": {"code": 403, "message": "Permission denied: Consumer 'api_key:AIza' has been suspended.", "status": "PERMISSION_DENIED"}}`, true},
+		"bad request": {http.StatusBadRequest, `{"error": {"code": 400, "message": "* GenerateContentRequest.contents: contents is not specified", "status": "INVALID_ARGUMENT"}}`, false},
+		"tuned model": {http.StatusForbidden, `{"error": {"code": 403, "message": "You do not have permission to access tuned model tunedModels/abc", "status": "PERMISSION_DENIED"}}`, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, _ := newTestContext()
+			errWithStatusCode := ErrorHandler(c, newTestResponse(testCase.statusCode, testCase.body), "gemini-pro")
+			require.NotNil(t, errWithStatusCode)
+			if testCase.unauthorized {
+				assert.Equal(t, http.StatusUnauthorized, errWithStatusCode.StatusCode)
+				assert.Equal(t, "invalid_api_key", errWithStatusCode.Code)
+				assert.Equal(t, "invalid_request_error", errWithStatusCode.Type)
+			} else {
+				assert.Equal(t, testCase.statusCode, errWithStatusCode.StatusCode)
+				assert.Equal(t, "gemini_error", errWithStatusCode.Type)
+			}
+		})
+	}
+}
+
+func TestConvertEmbeddingRequest(t *testing.T) {
+	geminiRequest, err := ConvertEmbeddingRequest(model.GeneralOpenAIRequest{Model: "text-embedding-004", Input: "Hello"})
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Requests, 1)
+	assert.Equal(t, "models/text-embedding-004", geminiRequest.Requests[0].Model)
+	assert.Equal(t, "Hello", geminiRequest.Requests[0].Content.Parts[0].Text)
+
+	geminiRequest, err = ConvertEmbeddingRequest(model.GeneralOpenAIRequest{
+		Model:      "text-embedding-004",
+		Input:      []any{"first", "second", "third"},
+		Dimensions: 256,
+	})
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Requests, 3)
+	for i, text := range []string{"first", "second", "third"} {
+		assert.Equal(t, text, geminiRequest.Requests[i].Content.Parts[0].Text)
+		assert.Equal(t, 256, geminiRequest.Requests[i].OutputDimensionality)
+	}
+
+	_, err = ConvertEmbeddingRequest(model.GeneralOpenAIRequest{Model: "text-embedding-004", Input: []any{}})
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+
+	inputs := make([]any, MaxEmbeddingBatchSize+1)
+	for i := range inputs {
+		inputs[i] = "Hello"
+	}
+	_, err = ConvertEmbeddingRequest(model.GeneralOpenAIRequest{Model: "text-embedding-004", Input: inputs})
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+}
+
+func TestEmbeddingHandler(t *testing.T) {
+	c, recorder := newTestContext()
+	errWithStatusCode, usage := EmbeddingHandler(c, newTestResponse(http.StatusOK, `{"embeddings": [{"values": [0.1, 0.2]}]}`), 3, "text-embedding-004")
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, 3, usage.PromptTokens)
+	assert.Equal(t, 3, usage.TotalTokens)
+	var response openai.EmbeddingResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "list", response.Object)
+	assert.Equal(t, "text-embedding-004", response.Model)
+	require.Len(t, response.Data, 1)
+	assert.Equal(t, []float64{0.1, 0.2}, response.Data[0].Embedding)
+
+	c, recorder = newTestContext()
+	errWithStatusCode, usage = EmbeddingHandler(c, newTestResponse(http.StatusOK,
+		`{"embeddings": [{"values": [0.1]}, {"values": [0.2]}, {"values": [0.3]}]}`), 9, "text-embedding-004")
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, 9, usage.PromptTokens)
+	response = openai.EmbeddingResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Data, 3)
+	for i, values := range [][]float64{{0.1}, {0.2}, {0.3}} {
+		assert.Equal(t, i, response.Data[i].Index)
+		assert.Equal(t, values, response.Data[i].Embedding)
+	}
+}
@@ -0,0 +1,68 @@
+package gemini
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "one_api_gemini_request_duration_seconds",
+		Help:    "Time from sending a request to gemini until its response has been relayed.",
+		Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
+	}, []string{"model", "stream"})
+	streamFirstByte = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "one_api_gemini_stream_first_byte_seconds",
+		Help:    "Time from sending a stream request to gemini until the first byte of its body arrives.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40},
+	}, []string{"model"})
+	promptTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "one_api_gemini_prompt_tokens_total",
+		Help: "Prompt tokens billed for gemini requests.",
+	}, []string{"model"})
+	completionTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "one_api_gemini_completion_tokens_total",
+		Help: "Completion tokens billed for gemini requests.",
+	}, []string{"model"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "one_api_gemini_errors_total",
+		Help: "Failed gemini requests by the status code returned to the client.",
+	}, []string{"model", "status"})
+)
+
+// recordMetrics is called once per relayed request, start is when the first attempt was sent
+func recordMetrics(modelName string, isStream bool, start time.Time, usage *model.Usage, err *model.ErrorWithStatusCode) {
+	requestDuration.WithLabelValues(modelName, strconv.FormatBool(isStream)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requestErrors.WithLabelValues(modelName, strconv.Itoa(err.StatusCode)).Inc()
+		return
+	}
+	if usage != nil {
+		promptTokens.WithLabelValues(modelName).Add(float64(usage.PromptTokens))
+		completionTokens.WithLabelValues(modelName).Add(float64(usage.CompletionTokens))
+	}
+}
+
+// firstByteReader observes the time to first byte of a stream as soon as the stream handler reads it
+type firstByteReader struct {
+	io.ReadCloser
+	modelName string
+	start     time.Time
+	once      sync.Once
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.once.Do(func() {
+			streamFirstByte.WithLabelValues(r.modelName).Observe(time.Since(r.start).Seconds())
+		})
+	}
+	return n, err
+}
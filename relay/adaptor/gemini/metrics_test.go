@@ -0,0 +1,43 @@
+package gemini
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoResponseRecordsMetrics(t *testing.T) {
+	const modelName = "gemini-metrics-test"
+	prompt := testutil.ToFloat64(promptTokens.WithLabelValues(modelName))
+	completion := testutil.ToFloat64(completionTokens.WithLabelValues(modelName))
+	errors := testutil.ToFloat64(requestErrors.WithLabelValues(modelName, "400"))
+
+	c, _ := newTestContext()
+	_, errWithStatusCode := (&Adaptor{}).DoResponse(c, newTestResponse(http.StatusOK, `{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 1, "totalTokenCount": 4}
+	}`), &meta.Meta{Mode: relaymode.ChatCompletions, ActualModelName: modelName})
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, prompt+3, testutil.ToFloat64(promptTokens.WithLabelValues(modelName)))
+	assert.Equal(t, completion+1, testutil.ToFloat64(completionTokens.WithLabelValues(modelName)))
+
+	c, _ = newTestContext()
+	_, errWithStatusCode = (&Adaptor{}).DoResponse(c, newTestResponse(http.StatusBadRequest,
+		`{"error": {"code": 400, "message": "Invalid value", "status": "INVALID_ARGUMENT"}}`),
+		&meta.Meta{Mode: relaymode.ChatCompletions, ActualModelName: modelName})
+	require.NotNil(t, errWithStatusCode)
+	assert.Equal(t, errors+1, testutil.ToFloat64(requestErrors.WithLabelValues(modelName, "400")))
+
+	c, _ = newTestContext()
+	resp := newTestResponse(http.StatusOK, "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hi\"}]}, \"finishReason\": \"STOP\"}], "+
+		"\"usageMetadata\": {\"promptTokenCount\": 2, \"candidatesTokenCount\": 1, \"totalTokenCount\": 3}}\n\n")
+	_, errWithStatusCode = (&Adaptor{}).DoResponse(c, resp, &meta.Meta{Mode: relaymode.ChatCompletions, ActualModelName: modelName, IsStream: true})
+	require.Nil(t, errWithStatusCode)
+	assert.Equal(t, prompt+5, testutil.ToFloat64(promptTokens.WithLabelValues(modelName)))
+	assert.NotZero(t, testutil.CollectAndCount(streamFirstByte))
+}
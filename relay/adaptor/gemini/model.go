@@ -1,10 +1,13 @@
 package gemini
 
 type ChatRequest struct {
-	Contents         []ChatContent        `json:"contents"`
-	SafetySettings   []ChatSafetySettings `json:"safety_settings,omitempty"`
-	GenerationConfig ChatGenerationConfig `json:"generation_config,omitempty"`
-	Tools            []ChatTools          `json:"tools,omitempty"`
+	Contents          []ChatContent        `json:"contents"`
+	SystemInstruction *ChatContent         `json:"system_instruction,omitempty"`
+	SafetySettings    []ChatSafetySettings `json:"safety_settings,omitempty"`
+	GenerationConfig  ChatGenerationConfig `json:"generation_config,omitempty"`
+	Tools             []ChatTools          `json:"tools,omitempty"`
+	ToolConfig        *ChatToolConfig      `json:"tool_config,omitempty"`
+	CachedContent     string               `json:"cached_content,omitempty"`
 }
 
 type EmbeddingRequest struct {
@@ -29,9 +32,15 @@ type EmbeddingResponse struct {
 }
 
 type Error struct {
-	Code    int    `json:"code,omitempty"`
-	Message string `json:"message,omitempty"`
-	Status  string `json:"status,omitempty"`
+	Code    int           `json:"code,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Status  string        `json:"status,omitempty"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+type ErrorDetail struct {
+	Type   string `json:"@type,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type InlineData struct {
@@ -44,10 +53,31 @@ type FunctionCall struct {
 	Arguments    any    `json:"args"`
 }
 
+type FunctionResponse struct {
+	Name     string `json:"name"`
+	Response any    `json:"response"`
+}
+
+type FileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileUri  string `json:"fileUri"`
+}
+
+// https://ai.google.dev/api/caching#VideoMetadata
+type VideoMetadata struct {
+	StartOffset string  `json:"startOffset,omitempty"`
+	EndOffset   string  `json:"endOffset,omitempty"`
+	Fps         float64 `json:"fps,omitempty"`
+}
+
 type Part struct {
-	Text         string        `json:"text,omitempty"`
-	InlineData   *InlineData   `json:"inlineData,omitempty"`
-	FunctionCall *FunctionCall `json:"functionCall,omitempty"`
+	Text             string            `json:"text,omitempty"`
+	Thought          bool              `json:"thought,omitempty"`
+	InlineData       *InlineData       `json:"inlineData,omitempty"`
+	FileData         *FileData         `json:"fileData,omitempty"`
+	VideoMetadata    *VideoMetadata    `json:"videoMetadata,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
 }
 
 type ChatContent struct {
@@ -61,14 +91,51 @@ type ChatSafetySettings struct {
 }
 
 type ChatTools struct {
-	FunctionDeclarations any `json:"function_declarations,omitempty"`
+	FunctionDeclarations  any                    `json:"function_declarations,omitempty"`
+	GoogleSearch          *GoogleSearch          `json:"google_search,omitempty"`
+	GoogleSearchRetrieval *GoogleSearchRetrieval `json:"google_search_retrieval,omitempty"`
+}
+
+// GoogleSearch has no options, an empty object enables it
+type GoogleSearch struct{}
+
+type GoogleSearchRetrieval struct {
+	DynamicRetrievalConfig *DynamicRetrievalConfig `json:"dynamic_retrieval_config,omitempty"`
+}
+
+type DynamicRetrievalConfig struct {
+	Mode             string  `json:"mode,omitempty"`
+	DynamicThreshold float64 `json:"dynamic_threshold,omitempty"`
+}
+
+type ChatToolConfig struct {
+	FunctionCallingConfig FunctionCallingConfig `json:"function_calling_config"`
+}
+
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowed_function_names,omitempty"`
 }
 
 type ChatGenerationConfig struct {
-	Temperature     float64  `json:"temperature,omitempty"`
-	TopP            float64  `json:"topP,omitempty"`
-	TopK            float64  `json:"topK,omitempty"`
-	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
-	CandidateCount  int      `json:"candidateCount,omitempty"`
-	StopSequences   []string `json:"stopSequences,omitempty"`
+	Temperature        *float64        `json:"temperature,omitempty"`
+	TopP               *float64        `json:"topP,omitempty"`
+	TopK               *int            `json:"topK,omitempty"`
+	MaxOutputTokens    int             `json:"maxOutputTokens,omitempty"`
+	CandidateCount     int             `json:"candidateCount,omitempty"`
+	StopSequences      []string        `json:"stopSequences,omitempty"`
+	PresencePenalty    float64         `json:"presencePenalty,omitempty"`
+	FrequencyPenalty   float64         `json:"frequencyPenalty,omitempty"`
+	ResponseMimeType   string          `json:"responseMimeType,omitempty"`
+	ResponseSchema     any             `json:"responseSchema,omitempty"`
+	ResponseLogprobs   bool            `json:"responseLogprobs,omitempty"`
+	Logprobs           int             `json:"logprobs,omitempty"`
+	Seed               int             `json:"seed,omitempty"`
+	ResponseModalities []string        `json:"responseModalities,omitempty"`
+	ThinkingConfig     *ThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+// https://ai.google.dev/gemini-api/docs/thinking#set-budget
+type ThinkingConfig struct {
+	ThinkingBudget int `json:"thinkingBudget"`
 }
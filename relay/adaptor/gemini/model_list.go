@@ -0,0 +1,104 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+)
+
+const modelListCacheTTL = 5 * time.Minute
+
+// https://ai.google.dev/api/models#method:-models.list
+type ModelInfo struct {
+	Name                       string   `json:"name"`
+	DisplayName                string   `json:"displayName"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+type ListModelsResponse struct {
+	Models        []ModelInfo `json:"models"`
+	NextPageToken string      `json:"nextPageToken"`
+	Error         *Error      `json:"error,omitempty"`
+}
+
+type cachedModelList struct {
+	Models    []string
+	ExpiresAt time.Time
+}
+
+var modelListStore sync.Map
+
+// ListModels returns the ids of the models the key can access, a failing call means the
+// key is not usable, results are cached for a few minutes to spare the quota
+func ListModels(baseURL string, apiKey string, version string) ([]string, error) {
+	if version == "" {
+		version = "v1beta"
+	}
+	cacheKey := fmt.Sprintf("%s|%s|%s", baseURL, version, apiKey)
+	if cached, ok := modelListStore.Load(cacheKey); ok {
+		modelList := cached.(cachedModelList)
+		if time.Now().Before(modelList.ExpiresAt) {
+			return modelList.Models, nil
+		}
+	}
+	models := make([]string, 0)
+	pageToken := ""
+	for {
+		response, err := listModelsPage(baseURL, apiKey, version, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, model := range response.Models {
+			models = append(models, strings.TrimPrefix(model.Name, "models/"))
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		pageToken = response.NextPageToken
+	}
+	modelListStore.Store(cacheKey, cachedModelList{
+		Models:    models,
+		ExpiresAt: time.Now().Add(modelListCacheTTL),
+	})
+	return models, nil
+}
+
+func listModelsPage(baseURL string, apiKey string, version string, pageToken string) (*ListModelsResponse, error) {
+	fullRequestURL := fmt.Sprintf("%s/%s/models?pageSize=1000", baseURL, version)
+	if pageToken != "" {
+		fullRequestURL += "&pageToken=" + url.QueryEscape(pageToken)
+	}
+	req, err := http.NewRequest(http.MethodGet, fullRequestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-goog-api-key", apiKey)
+	resp, err := client.ImpatientHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response ListModelsResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal model list failed, status code: %d: %w", resp.StatusCode, err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("list models failed: %s", errorGemini2OpenAI(response.Error, resp.StatusCode).Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list models failed, status code: %d", resp.StatusCode)
+	}
+	return &response, nil
+}
@@ -0,0 +1,48 @@
+package gemini
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListModels(t *testing.T) {
+	if client.ImpatientHTTPClient == nil {
+		client.ImpatientHTTPClient = http.DefaultClient
+		defer func() { client.ImpatientHTTPClient = nil }()
+	}
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/v1beta/models", r.URL.Path)
+		if r.Header.Get("x-goog-api-key") != "valid-key" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "API key not valid. Please pass a valid API key.", "status": "INVALID_ARGUMENT"}}`))
+			return
+		}
+		if r.URL.Query().Get("pageToken") == "" {
+			_, _ = w.Write([]byte(`{"models": [{"name": "models/gemini-pro"}], "nextPageToken": "next"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"models": [{"name": "models/gemini-1.5-pro"}]}`))
+	}))
+	defer server.Close()
+
+	models, err := ListModels(server.URL, "valid-key", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gemini-pro", "gemini-1.5-pro"}, models)
+	assert.Equal(t, 2, calls)
+
+	// served from cache
+	models, err = ListModels(server.URL, "valid-key", "")
+	require.NoError(t, err)
+	assert.Len(t, models, 2)
+	assert.Equal(t, 2, calls)
+
+	_, err = ListModels(server.URL, "invalid-key", "")
+	assert.ErrorContains(t, err, "API key not valid")
+}
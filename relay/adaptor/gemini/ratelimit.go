@@ -0,0 +1,98 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// tokenBucket holds up to rate tokens and refills them at rate per minute, so a channel may
+// spend a whole minute of its quota at once but not more than that
+type tokenBucket struct {
+	mutex   sync.Mutex
+	rate    int
+	tokens  float64
+	updated time.Time
+}
+
+// reserve takes a token and returns how long the caller has to wait until it is actually
+// available, when that is longer than maxWait nothing is taken and ok is false
+func (b *tokenBucket) reserve(now time.Time, rate int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.updated.IsZero() {
+		b.tokens = float64(rate)
+	} else if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += elapsed.Minutes() * float64(rate)
+	}
+	b.updated = now
+	// the rate of a channel can be edited at any time
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait = time.Duration((1 - b.tokens) / float64(rate) * float64(time.Minute))
+	if wait > maxWait {
+		return wait, false
+	}
+	// the token is handed out ahead of time, the next caller waits that much longer
+	b.tokens--
+	return wait, true
+}
+
+type channelRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[int]*tokenBucket
+}
+
+var rateLimiter = channelRateLimiter{buckets: make(map[int]*tokenBucket)}
+
+func (l *channelRateLimiter) bucket(channelId int) *tokenBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, ok := l.buckets[channelId]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.buckets[channelId] = bucket
+	}
+	return bucket
+}
+
+// wait blocks until the channel may send another request to gemini, it fails with
+// model.ErrRateLimited right away when that takes longer than maxWait
+func (l *channelRateLimiter) wait(ctx context.Context, channelId int, rate int, maxWait time.Duration) error {
+	wait, ok := l.bucket(channelId).reserve(time.Now(), rate, maxWait)
+	if !ok {
+		return fmt.Errorf("%w: channel #%d is limited to %d requests per minute, retry in %s",
+			model.ErrRateLimited, channelId, rate, wait.Round(time.Second))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// getRateLimit returns how many requests per minute the channel may send, the rate_limit of
+// the channel config takes precedence over GEMINI_CHANNEL_RATE_LIMIT, 0 means no limit
+func getRateLimit(meta *meta.Meta) int {
+	if meta.Config.RateLimit > 0 {
+		return meta.Config.RateLimit
+	}
+	return config.GeminiChannelRateLimit
+}
@@ -0,0 +1,108 @@
+package gemini
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	var bucket tokenBucket
+	// a fresh bucket allows a whole minute of requests at once
+	for i := 0; i < 2; i++ {
+		wait, ok := bucket.reserve(now, 2, 0)
+		assert.True(t, ok)
+		assert.Zero(t, wait)
+	}
+	wait, ok := bucket.reserve(now, 2, 0)
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	// the denied request took nothing, half a minute later one token is back
+	wait, ok = bucket.reserve(now.Add(30*time.Second), 2, 0)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// callers willing to wait get the next tokens ahead of time
+	now = now.Add(30 * time.Second)
+	wait, ok = bucket.reserve(now, 2, time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+	wait, ok = bucket.reserve(now, 2, time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, wait)
+	_, ok = bucket.reserve(now, 2, time.Minute)
+	assert.False(t, ok)
+
+	// raising the rate of the channel takes effect right away
+	wait, ok = bucket.reserve(now.Add(time.Minute), 60, 0)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestDoRequestRateLimit(t *testing.T) {
+	defer func(rate, maxWait int) {
+		config.GeminiChannelRateLimit, config.GeminiRateLimitMaxWait = rate, maxWait
+	}(config.GeminiChannelRateLimit, config.GeminiRateLimitMaxWait)
+	config.GeminiChannelRateLimit, config.GeminiRateLimitMaxWait = 0, 0
+	const channelId = 86
+	resetBucket := func() {
+		rateLimiter.mutex.Lock()
+		delete(rateLimiter.buckets, channelId)
+		delete(rateLimiter.buckets, channelId+1)
+		rateLimiter.mutex.Unlock()
+	}
+	resetBucket()
+	defer resetBucket()
+	upstreamCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		_, _ = w.Write([]byte(`{"candidates": []}`))
+	}))
+	defer server.Close()
+	if client.GeminiHTTPClient == nil {
+		client.GeminiHTTPClient = http.DefaultClient
+		defer func() { client.GeminiHTTPClient = nil }()
+	}
+
+	send := func(relayMeta *meta.Meta) error {
+		c, _ := newTestContext()
+		resp, err := (&Adaptor{}).DoRequest(c, relayMeta, bytes.NewReader([]byte(`{"contents":[]}`)))
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	relayMeta := &meta.Meta{BaseURL: server.URL, ActualModelName: "gemini-1.5-pro", ChannelId: channelId}
+	relayMeta.Config.RateLimit = 2
+	require.NoError(t, send(relayMeta))
+	require.NoError(t, send(relayMeta))
+	err := send(relayMeta)
+	assert.ErrorIs(t, err, model.ErrRateLimited)
+	assert.Equal(t, 2, upstreamCalls)
+
+	// other channels have buckets of their own
+	otherMeta := &meta.Meta{BaseURL: server.URL, ActualModelName: "gemini-1.5-pro", ChannelId: channelId + 1}
+	otherMeta.Config.RateLimit = 2
+	require.NoError(t, send(otherMeta))
+	assert.Equal(t, 3, upstreamCalls)
+
+	// the channel config takes precedence over GEMINI_CHANNEL_RATE_LIMIT
+	resetBucket()
+	config.GeminiChannelRateLimit = 1
+	require.NoError(t, send(relayMeta))
+	require.NoError(t, send(relayMeta))
+	relayMeta.Config.RateLimit = 0
+	assert.ErrorIs(t, send(relayMeta), model.ErrRateLimited)
+	assert.Equal(t, 5, upstreamCalls)
+}
@@ -0,0 +1,79 @@
+package gemini
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const maxRetryDelay = 30 * time.Second
+
+// isRetryableStatusCode reports whether gemini is just overloaded (429 RESOURCE_EXHAUSTED,
+// 503 UNAVAILABLE) and the same request is likely to succeed a bit later
+func isRetryableStatusCode(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// doRequestWithRetry calls doRequest until it returns a non-retryable response or
+// config.GeminiRetryTimes retries are used up, the last response is returned as is.
+// doRequest must build a fresh request body every time it is called.
+func doRequestWithRetry(ctx context.Context, doRequest func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := doRequest()
+		if err != nil || attempt >= config.GeminiRetryTimes || !isRetryableStatusCode(resp.StatusCode) {
+			return resp, err
+		}
+		delay := getRetryDelay(attempt, resp.Header.Get("Retry-After"))
+		logger.Warnf(ctx, "gemini upstream returned status code %d, retrying in %s (%d/%d)", resp.StatusCode, delay, attempt+1, config.GeminiRetryTimes)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// getRetryDelay honors Retry-After when upstream sends one, otherwise it backs off
+// exponentially from config.GeminiRetryBaseDelay with jitter
+func getRetryDelay(attempt int, retryAfter string) time.Duration {
+	if delay, ok := parseRetryAfter(retryAfter); ok {
+		if delay > maxRetryDelay {
+			return maxRetryDelay
+		}
+		return delay
+	}
+	delay := time.Duration(config.GeminiRetryBaseDelay) * time.Millisecond << attempt
+	if delay < 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	// full delay on average, spread over [delay/2, delay*3/2)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+}
+
+// parseRetryAfter supports both forms of the header, delay-seconds and HTTP-date
+func parseRetryAfter(retryAfter string) (time.Duration, bool) {
+	if retryAfter == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
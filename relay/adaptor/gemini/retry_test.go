@@ -0,0 +1,69 @@
+package gemini
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestWithRetry(t *testing.T) {
+	defer func(retryTimes, baseDelay int) {
+		config.GeminiRetryTimes, config.GeminiRetryBaseDelay = retryTimes, baseDelay
+	}(config.GeminiRetryTimes, config.GeminiRetryBaseDelay)
+	config.GeminiRetryTimes, config.GeminiRetryBaseDelay = 2, 1
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"contents":[]}`, string(body))
+		if attempts == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if attempts == 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	doRequest := func() (*http.Response, error) {
+		return http.Post(server.URL, "application/json", strings.NewReader(`{"contents":[]}`))
+	}
+	resp, err := doRequestWithRetry(context.Background(), doRequest)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, attempts)
+
+	// retries used up, the last response is handed back to the caller
+	config.GeminiRetryTimes = 0
+	attempts = 0
+	resp, err = doRequestWithRetry(context.Background(), doRequest)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestGetRetryDelay(t *testing.T) {
+	assert.Equal(t, 3*time.Second, getRetryDelay(0, "3"))
+	assert.Equal(t, maxRetryDelay, getRetryDelay(0, "3600"))
+	date := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	assert.Equal(t, time.Duration(0), getRetryDelay(0, date))
+
+	defer func(baseDelay int) { config.GeminiRetryBaseDelay = baseDelay }(config.GeminiRetryBaseDelay)
+	config.GeminiRetryBaseDelay = 100
+	delay := getRetryDelay(2, "")
+	assert.GreaterOrEqual(t, delay, 200*time.Millisecond)
+	assert.LessOrEqual(t, delay, 600*time.Millisecond)
+}
@@ -0,0 +1,158 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// validateResponseJSON checks a completion against the json_schema the client asked for
+func validateResponseJSON(text string, schema map[string]any) error {
+	var value any
+	err := json.Unmarshal([]byte(text), &value)
+	if err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	return validateJSONSchema(value, schema, "$")
+}
+
+// validateJSONSchema understands type, enum, required, properties and items, which is what
+// gemini itself honours, every other keyword is accepted without being checked
+func validateJSONSchema(value any, schema map[string]any, path string) error {
+	if schemaType, ok := schema["type"]; ok && !matchesSchemaType(value, schemaType) {
+		return fmt.Errorf("%s: expected %v, got %s", path, schemaType, jsonTypeOf(value))
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, item := range enum {
+			if reflect.DeepEqual(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, key := range required {
+				name, _ := key.(string)
+				if _, ok := v[name]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]any); ok {
+			for name, propertySchema := range properties {
+				propertyValue, ok := v[name]
+				if !ok {
+					continue
+				}
+				if propertySchema, ok := propertySchema.(map[string]any); ok {
+					if err := validateJSONSchema(propertyValue, propertySchema, path+"."+name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchesSchemaType(value any, schemaType any) bool {
+	switch t := schemaType.(type) {
+	case string:
+		return jsonTypeOf(value) == t || (t == "number" && jsonTypeOf(value) == "integer")
+	case []any:
+		for _, item := range t {
+			if matchesSchemaType(value, item) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func jsonTypeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return strings.ToLower(reflect.TypeOf(value).Kind().String())
+}
+
+// stripJSONFences unwraps answers gemini put in a markdown code fence despite JSON mode, the
+// text parts of a fenced candidate are replaced by a single part holding the bare JSON
+func stripJSONFences(response *ChatResponse) {
+	for i := range response.Candidates {
+		candidate := &response.Candidates[i]
+		text := candidate.GetText()
+		stripped := stripJSONFence(text)
+		if stripped == text {
+			continue
+		}
+		parts := make([]Part, 0, len(candidate.Content.Parts))
+		replaced := false
+		for _, part := range candidate.Content.Parts {
+			if part.Thought || part.Text == "" {
+				parts = append(parts, part)
+				continue
+			}
+			if !replaced {
+				parts = append(parts, Part{Text: stripped})
+				replaced = true
+			}
+		}
+		candidate.Content.Parts = parts
+	}
+}
+
+// stripJSONFence turns "```json\n{...}\n```" into "{...}". An answer cut off before the closing
+// fence, or one that only has the closing fence, is unwrapped as well, anything else is left alone.
+func stripJSONFence(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if body, ok := strings.CutPrefix(trimmed, "```"); ok {
+		// the info string runs up to the first line break, only json or none is ours to remove
+		info, rest, found := strings.Cut(body, "\n")
+		if !found {
+			info, rest = "", body
+		}
+		if info = strings.TrimSpace(info); info != "" && !strings.EqualFold(info, "json") {
+			return text
+		}
+		return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "```"))
+	}
+	if body, ok := strings.CutSuffix(trimmed, "```"); ok {
+		body = strings.TrimSpace(body)
+		if strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[") {
+			return body
+		}
+	}
+	return text
+}
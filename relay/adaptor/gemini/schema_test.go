@@ -0,0 +1,58 @@
+package gemini
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateResponseJSON(t *testing.T) {
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"name", "tags"},
+		"properties": map[string]any{
+			"name":  map[string]any{"type": "string"},
+			"age":   map[string]any{"type": []any{"integer", "null"}},
+			"level": map[string]any{"type": "string", "enum": []any{"low", "high"}},
+			"tags":  map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}
+	assert.NoError(t, validateResponseJSON(`{"name": "Ada", "age": 36, "level": "high", "tags": ["math"]}`, schema))
+	assert.NoError(t, validateResponseJSON(`{"name": "Ada", "age": null, "tags": []}`, schema))
+
+	assert.ErrorContains(t, validateResponseJSON(`{"name": "Ada"`, schema), "not valid JSON")
+	assert.ErrorContains(t, validateResponseJSON(`[]`, schema), "$: expected object, got array")
+	assert.ErrorContains(t, validateResponseJSON(`{"name": "Ada"}`, schema), `missing required property "tags"`)
+	assert.ErrorContains(t, validateResponseJSON(`{"name": "Ada", "age": 36.5, "tags": []}`, schema), "$.age: expected")
+	assert.ErrorContains(t, validateResponseJSON(`{"name": "Ada", "level": "mid", "tags": []}`, schema), "$.level: mid is not one of")
+	assert.ErrorContains(t, validateResponseJSON(`{"name": "Ada", "tags": ["a", 1]}`, schema), "$.tags[1]: expected string, got integer")
+}
+
+func TestStripJSONFence(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{"fenced", "```json\n{\"name\": \"Ada\"}\n```", `{"name": "Ada"}`},
+		{"fenced without info", "```\n[1, 2]\n```\n", `[1, 2]`},
+		{"fenced on one line", "```{\"name\": \"Ada\"}```", `{"name": "Ada"}`},
+		{"unfenced", `{"name": "Ada"}`, `{"name": "Ada"}`},
+		{"opening fence only", "```json\n{\"name\": \"Ada\"", `{"name": "Ada"`},
+		{"closing fence only", "{\"name\": \"Ada\"}\n```", `{"name": "Ada"}`},
+		{"other language", "```python\nprint(1)\n```", "```python\nprint(1)\n```"},
+		{"fence inside a string", `{"code": "` + "```" + `"}`, `{"code": "` + "```" + `"}`},
+	} {
+		assert.Equal(t, tc.want, stripJSONFence(tc.text), tc.name)
+	}
+}
+
+func TestStripJSONFences(t *testing.T) {
+	response := ChatResponse{Candidates: []ChatCandidate{
+		{Content: ChatContent{Parts: []Part{{Text: "Thinking about it", Thought: true}, {Text: "```json\n{\"name\":"}, {Text: " \"Ada\"}\n```"}}}},
+		{Content: ChatContent{Parts: []Part{{Text: `{"name": "Grace"}`}}}},
+	}}
+	stripJSONFences(&response)
+	assert.Equal(t, []Part{{Text: "Thinking about it", Thought: true}, {Text: `{"name": "Ada"}`}}, response.Candidates[0].Content.Parts)
+	assert.Equal(t, []Part{{Text: `{"name": "Grace"}`}}, response.Candidates[1].Content.Parts)
+}
@@ -0,0 +1,126 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// https://ai.google.dev/gemini-api/docs/video-understanding#supported-formats
+var SupportedVideoMimeTypes = map[string]bool{
+	"video/mp4":   true,
+	"video/mpeg":  true,
+	"video/mov":   true,
+	"video/avi":   true,
+	"video/x-flv": true,
+	"video/mpg":   true,
+	"video/webm":  true,
+	"video/wmv":   true,
+	"video/3gpp":  true,
+}
+
+// videoMimeTypesByExtension guesses the type of a remote video, file uris of the gemini
+// files API have no extension and are sent without one
+var videoMimeTypesByExtension = map[string]string{
+	".mp4":  "video/mp4",
+	".mpeg": "video/mpeg",
+	".mov":  "video/mov",
+	".avi":  "video/avi",
+	".flv":  "video/x-flv",
+	".mpg":  "video/mpg",
+	".webm": "video/webm",
+	".wmv":  "video/wmv",
+	".3gp":  "video/3gpp",
+}
+
+// MaxVideoFps is the highest sampling rate gemini accepts in videoMetadata
+const MaxVideoFps = 24
+
+func maxVideoSize() int64 {
+	return mediaSizeLimit(config.GeminiMaxVideoSize)
+}
+
+// isVideoFileURI reports whether gemini can read the video at uri itself: a Cloud Storage object
+// or a file of the gemini files API. Other urls are refused, the relay does not have gemini fetch
+// whatever a client points it at.
+func isVideoFileURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	switch parsed.Scheme {
+	case "gs":
+		return true
+	case "https":
+		return parsed.Host == "generativelanguage.googleapis.com" &&
+			(strings.HasPrefix(parsed.Path, "/v1beta/files/") || strings.HasPrefix(parsed.Path, "/v1/files/"))
+	}
+	return false
+}
+
+// convertVideoURL turns a video_url part into a gemini part, a data url is sent inline while
+// a gs:// url or a file uri of the gemini files API is left for gemini to read
+func convertVideoURL(video *model.VideoURL) (*Part, error) {
+	if video == nil || video.Url == "" {
+		return nil, fmt.Errorf("%w: video_url must have a url", model.ErrInvalidRequest)
+	}
+	var part Part
+	if matches := dataURLPattern.FindStringSubmatch(video.Url); matches != nil {
+		mimeType, data := strings.ToLower(matches[1]), matches[2]
+		if !SupportedVideoMimeTypes[mimeType] {
+			return nil, fmt.Errorf("%w: unsupported video type %s", model.ErrInvalidRequest, mimeType)
+		}
+		if int64(base64.StdEncoding.DecodedLen(len(data))) > maxVideoSize() {
+			return nil, fmt.Errorf("%w: video exceeds the %d MB limit", model.ErrInvalidRequest, maxVideoSize()>>20)
+		}
+		part.InlineData = &InlineData{MimeType: mimeType, Data: data}
+	} else if isVideoFileURI(video.Url) {
+		part.FileData = &FileData{
+			MimeType: videoMimeTypesByExtension[strings.ToLower(path.Ext(strings.SplitN(video.Url, "?", 2)[0]))],
+			FileUri:  video.Url,
+		}
+	} else {
+		return nil, fmt.Errorf("%w: video url must be a data url, a gs:// url or a gemini files API uri", model.ErrInvalidRequest)
+	}
+	videoMetadata, err := getVideoMetadata(video)
+	if err != nil {
+		return nil, err
+	}
+	part.VideoMetadata = videoMetadata
+	return &part, nil
+}
+
+// getVideoMetadata returns nil when the whole clip is to be sampled at the default rate
+func getVideoMetadata(video *model.VideoURL) (*VideoMetadata, error) {
+	if video.StartOffset < 0 || video.EndOffset < 0 {
+		return nil, fmt.Errorf("%w: video offsets must not be negative", model.ErrInvalidRequest)
+	}
+	if video.EndOffset > 0 && video.EndOffset <= video.StartOffset {
+		return nil, fmt.Errorf("%w: video end_offset must be after start_offset", model.ErrInvalidRequest)
+	}
+	if video.Fps < 0 || video.Fps > MaxVideoFps {
+		return nil, fmt.Errorf("%w: video fps must be between 0 and %d", model.ErrInvalidRequest, MaxVideoFps)
+	}
+	if video.StartOffset == 0 && video.EndOffset == 0 && video.Fps == 0 {
+		return nil, nil
+	}
+	videoMetadata := VideoMetadata{Fps: video.Fps}
+	if video.StartOffset > 0 {
+		videoMetadata.StartOffset = formatDuration(video.StartOffset)
+	}
+	if video.EndOffset > 0 {
+		videoMetadata.EndOffset = formatDuration(video.EndOffset)
+	}
+	return &videoMetadata, nil
+}
+
+// formatDuration writes seconds the way protobuf encodes a Duration in JSON, e.g. "1.5s"
+func formatDuration(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', -1, 64) + "s"
+}
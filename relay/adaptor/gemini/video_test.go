@@ -0,0 +1,76 @@
+package gemini
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertRequestVideoURL(t *testing.T) {
+	video := base64.StdEncoding.EncodeToString([]byte("\x00\x00\x00\x18ftypmp42"))
+	geminiRequest, err := ConvertRequest(context.Background(), model.GeneralOpenAIRequest{
+		Model: "gemini-1.5-pro",
+		Messages: []model.Message{{Role: "user", Content: []any{
+			map[string]any{"type": "text", "text": "What happens in this part of the clip?"},
+			map[string]any{"type": "video_url", "video_url": map[string]any{
+				"url": "data:video/mp4;base64," + video, "start_offset": 10.0, "end_offset": 20.5, "fps": 2.0,
+			}},
+		}}},
+	})
+	require.NoError(t, err)
+	parts := geminiRequest.Contents[0].Parts
+	require.Len(t, parts, 2)
+	require.NotNil(t, parts[1].InlineData)
+	assert.Equal(t, "video/mp4", parts[1].InlineData.MimeType)
+	assert.Equal(t, video, parts[1].InlineData.Data)
+	body, err := json.Marshal(parts[1].VideoMetadata)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"startOffset": "10s", "endOffset": "20.5s", "fps": 2}`, string(body))
+}
+
+func TestConvertVideoURL(t *testing.T) {
+	defer func(size int) { config.GeminiMaxVideoSize = size }(config.GeminiMaxVideoSize)
+	config.GeminiMaxVideoSize = 1
+
+	part, err := convertVideoURL(&model.VideoURL{Url: "https://generativelanguage.googleapis.com/v1beta/files/abc123"})
+	require.NoError(t, err)
+	require.NotNil(t, part.FileData)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1beta/files/abc123", part.FileData.FileUri)
+	assert.Empty(t, part.FileData.MimeType)
+	assert.Nil(t, part.VideoMetadata)
+
+	part, err = convertVideoURL(&model.VideoURL{Url: "gs://clips/demo.WEBM", EndOffset: 5})
+	require.NoError(t, err)
+	assert.Equal(t, "video/webm", part.FileData.MimeType)
+	assert.Equal(t, &VideoMetadata{EndOffset: "5s"}, part.VideoMetadata)
+
+	for _, video := range []*model.VideoURL{
+		nil,
+		{Url: "data:video/mkv;base64,AAAA"},
+		{Url: "ftp://example.com/demo.mp4"},
+		// gemini is not sent to fetch arbitrary urls
+		{Url: "https://example.com/demo.mp4"},
+		{Url: "http://generativelanguage.googleapis.com/v1beta/files/abc123"},
+		{Url: "https://generativelanguage.googleapis.com.example.com/v1beta/files/abc123"},
+		{Url: "https://generativelanguage.googleapis.com/v1beta/models/gemini-pro"},
+		{Url: "https://www.youtube.com/watch?v=9hE5-98ZeCg"},
+		{Url: "gs://clips/demo.mp4", StartOffset: 20, EndOffset: 10},
+		{Url: "gs://clips/demo.mp4", StartOffset: -1},
+		{Url: "gs://clips/demo.mp4", Fps: 30},
+	} {
+		_, err = convertVideoURL(video)
+		assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	}
+
+	tooLarge := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 1024*1024+1)))
+	_, err = convertVideoURL(&model.VideoURL{Url: "data:video/mp4;base64," + tooLarge})
+	assert.ErrorIs(t, err, model.ErrInvalidRequest)
+	assert.Contains(t, err.Error(), "1 MB")
+}
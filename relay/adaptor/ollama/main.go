@@ -27,8 +27,8 @@ func ConvertRequest(request model.GeneralOpenAIRequest) *ChatRequest {
 		Model: request.Model,
 		Options: &Options{
 			Seed:             int(request.Seed),
-			Temperature:      request.Temperature,
-			TopP:             request.TopP,
+			Temperature:      request.GetTemperature(),
+			TopP:             request.GetTopP(),
 			FrequencyPenalty: request.FrequencyPenalty,
 			PresencePenalty:  request.PresencePenalty,
 		},
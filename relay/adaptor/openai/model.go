@@ -82,19 +82,58 @@ type SlimTextResponse struct {
 	Error       model.Error `json:"error"`
 }
 
+// Citation is not part of the OpenAI API, upstreams that report their sources fill it in
+type Citation struct {
+	StartIndex int    `json:"start_index,omitempty"`
+	EndIndex   int    `json:"end_index,omitempty"`
+	URL        string `json:"url,omitempty"`
+	License    string `json:"license,omitempty"`
+}
+
+// SafetyRating is not part of the OpenAI API either, upstreams that grade their answers fill it in
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+// https://platform.openai.com/docs/api-reference/chat/object#chat/object-choices
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
 type TextResponseChoice struct {
 	Index         int `json:"index"`
 	model.Message `json:"message"`
-	FinishReason  string `json:"finish_reason"`
+	FinishReason  string         `json:"finish_reason"`
+	FinishMessage string         `json:"finish_message,omitempty"`
+	Citations     []Citation     `json:"citations,omitempty"`
+	SafetyRatings []SafetyRating `json:"safety_ratings,omitempty"`
+	Logprobs      *Logprobs      `json:"logprobs,omitempty"`
+	AvgLogprob    *float64       `json:"avg_logprob,omitempty"`
 }
 
 type TextResponse struct {
-	Id          string               `json:"id"`
-	Model       string               `json:"model,omitempty"`
-	Object      string               `json:"object"`
-	Created     int64                `json:"created"`
-	Choices     []TextResponseChoice `json:"choices"`
-	model.Usage `json:"usage"`
+	Id                string               `json:"id"`
+	Model             string               `json:"model,omitempty"`
+	Object            string               `json:"object"`
+	Created           int64                `json:"created"`
+	SystemFingerprint string               `json:"system_fingerprint,omitempty"`
+	Choices           []TextResponseChoice `json:"choices"`
+	model.Usage       `json:"usage"`
 }
 
 type EmbeddingResponseItem struct {
@@ -123,18 +162,24 @@ type ImageResponse struct {
 }
 
 type ChatCompletionsStreamResponseChoice struct {
-	Index        int           `json:"index"`
-	Delta        model.Message `json:"delta"`
-	FinishReason *string       `json:"finish_reason,omitempty"`
+	Index         int            `json:"index"`
+	Delta         model.Message  `json:"delta"`
+	FinishReason  *string        `json:"finish_reason,omitempty"`
+	FinishMessage string         `json:"finish_message,omitempty"`
+	Citations     []Citation     `json:"citations,omitempty"`
+	SafetyRatings []SafetyRating `json:"safety_ratings,omitempty"`
+	Logprobs      *Logprobs      `json:"logprobs,omitempty"`
+	AvgLogprob    *float64       `json:"avg_logprob,omitempty"`
 }
 
 type ChatCompletionsStreamResponse struct {
-	Id      string                                `json:"id"`
-	Object  string                                `json:"object"`
-	Created int64                                 `json:"created"`
-	Model   string                                `json:"model"`
-	Choices []ChatCompletionsStreamResponseChoice `json:"choices"`
-	Usage   *model.Usage                          `json:"usage,omitempty"`
+	Id                string                                `json:"id"`
+	Object            string                                `json:"object"`
+	Created           int64                                 `json:"created"`
+	Model             string                                `json:"model"`
+	SystemFingerprint string                                `json:"system_fingerprint,omitempty"`
+	Choices           []ChatCompletionsStreamResponseChoice `json:"choices"`
+	Usage             *model.Usage                          `json:"usage,omitempty"`
 }
 
 type CompletionsStreamResponse struct {
@@ -1,6 +1,7 @@
 package openai
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/pkoukk/tiktoken-go"
@@ -11,19 +12,24 @@ import (
 	"github.com/songquanpeng/one-api/relay/model"
 	"math"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
-// tokenEncoderMap won't grow after initialization
+// tokenEncoderMap won't grow after initialization, encoders of models that are only known
+// by name are built on first use and kept in lazyTokenEncoderMap, handlers run concurrently
 var tokenEncoderMap = map[string]*tiktoken.Tiktoken{}
+var lazyTokenEncoderMap sync.Map
 var defaultTokenEncoder *tiktoken.Tiktoken
+var defaultTokenEncoderOnce sync.Once
+var missingTokenEncoderOnce sync.Once
 
 func InitTokenEncoders() {
 	logger.SysLog("initializing token encoders")
-	gpt35TokenEncoder, err := tiktoken.EncodingForModel("gpt-3.5-turbo")
-	if err != nil {
-		logger.FatalLog(fmt.Sprintf("failed to get gpt-3.5-turbo token encoder: %s", err.Error()))
+	gpt35TokenEncoder := getDefaultTokenEncoder()
+	if gpt35TokenEncoder == nil {
+		logger.FatalLog("failed to get gpt-3.5-turbo token encoder")
 	}
-	defaultTokenEncoder = gpt35TokenEncoder
 	gpt4oTokenEncoder, err := tiktoken.EncodingForModel("gpt-4o")
 	if err != nil {
 		logger.FatalLog(fmt.Sprintf("failed to get gpt-4o token encoder: %s", err.Error()))
@@ -39,6 +45,9 @@ func InitTokenEncoders() {
 			tokenEncoderMap[model] = gpt4oTokenEncoder
 		} else if strings.HasPrefix(model, "gpt-4") {
 			tokenEncoderMap[model] = gpt4TokenEncoder
+		} else if strings.HasPrefix(model, "gemini") {
+			// no public tokenizer, o200k_base is closest for multilingual output
+			tokenEncoderMap[model] = gpt4oTokenEncoder
 		} else {
 			tokenEncoderMap[model] = nil
 		}
@@ -46,30 +55,80 @@ func InitTokenEncoders() {
 	logger.SysLog("token encoders initialized")
 }
 
+// getDefaultTokenEncoder builds the gpt-3.5-turbo encoder once, also when InitTokenEncoders never ran.
+// It is nil when the encoding could not be loaded, getTokenNum then estimates instead.
+func getDefaultTokenEncoder() *tiktoken.Tiktoken {
+	defaultTokenEncoderOnce.Do(func() {
+		tokenEncoder, err := tiktoken.EncodingForModel("gpt-3.5-turbo")
+		if err != nil {
+			logger.SysError(fmt.Sprintf("failed to get gpt-3.5-turbo token encoder: %s", err.Error()))
+		}
+		defaultTokenEncoder = tokenEncoder
+	})
+	return defaultTokenEncoder
+}
+
 func getTokenEncoder(model string) *tiktoken.Tiktoken {
+	// approximate counting never encodes, there is no point in building an encoder for it
+	if config.ApproximateTokenEnabled {
+		return nil
+	}
 	tokenEncoder, ok := tokenEncoderMap[model]
 	if ok && tokenEncoder != nil {
 		return tokenEncoder
 	}
-	if ok {
-		tokenEncoder, err := tiktoken.EncodingForModel(model)
-		if err != nil {
-			logger.SysError(fmt.Sprintf("failed to get token encoder for model %s: %s, using encoder for gpt-3.5-turbo", model, err.Error()))
-			tokenEncoder = defaultTokenEncoder
-		}
-		tokenEncoderMap[model] = tokenEncoder
-		return tokenEncoder
+	if !ok {
+		return getDefaultTokenEncoder()
 	}
-	return defaultTokenEncoder
+	if cached, ok := lazyTokenEncoderMap.Load(model); ok {
+		return cached.(*tiktoken.Tiktoken)
+	}
+	tokenEncoder, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		logger.SysError(fmt.Sprintf("failed to get token encoder for model %s: %s, using encoder for gpt-3.5-turbo", model, err.Error()))
+		tokenEncoder = getDefaultTokenEncoder()
+	}
+	// a concurrent first use may have stored one already, keep that
+	cached, _ := lazyTokenEncoderMap.LoadOrStore(model, tokenEncoder)
+	return cached.(*tiktoken.Tiktoken)
 }
 
 func getTokenNum(tokenEncoder *tiktoken.Tiktoken, text string) int {
 	if config.ApproximateTokenEnabled {
 		return int(float64(len(text)) * 0.38)
 	}
+	if tokenEncoder == nil {
+		missingTokenEncoderOnce.Do(func() {
+			logger.Warnf(context.Background(), "no token encoder available, estimating tokens from the text length")
+		})
+		return estimateTokenNum(text)
+	}
 	return len(tokenEncoder.Encode(text, nil, nil))
 }
 
+// estimateTokenNum takes about four ASCII characters for a token, while tokenizers rarely merge
+// CJK characters or emoji, each of those counts as a token of its own. Counting bytes instead
+// would undercount non-English text. Non-empty text never counts as zero so that a broken
+// tokenizer does not give completions away for free.
+func estimateTokenNum(text string) int {
+	if text == "" {
+		return 0
+	}
+	asciiNum, tokenNum := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			asciiNum++
+		} else {
+			tokenNum++
+		}
+	}
+	tokenNum += asciiNum / 4
+	if tokenNum == 0 {
+		return 1
+	}
+	return tokenNum
+}
+
 func CountTokenMessages(messages []model.Message, model string) int {
 	tokenEncoder := getTokenEncoder(model)
 	// Reference:
@@ -0,0 +1,74 @@
+package openai
+
+import (
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// the encodings are downloaded on first use, there is nothing to test without them
+func requireTokenizer(tb testing.TB) {
+	if _, err := tiktoken.EncodingForModel("gpt-3.5-turbo"); err != nil {
+		tb.Skipf("tokenizer data unavailable: %s", err.Error())
+	}
+}
+
+func TestCountTokenTextConcurrently(t *testing.T) {
+	requireTokenizer(t)
+	tokenEncoderMap["gpt-3.5-turbo-test"] = nil
+	defer delete(tokenEncoderMap, "gpt-3.5-turbo-test")
+
+	expected := CountTokenText("Hello, world!", "gpt-3.5-turbo-test")
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			assert.Equal(t, expected, CountTokenText("Hello, world!", model))
+		}([]string{"gpt-3.5-turbo-test", "gemini-1.5-pro", "unknown-model"}[i%3])
+	}
+	wg.Wait()
+	assert.Same(t, getTokenEncoder("gpt-3.5-turbo-test"), getTokenEncoder("gpt-3.5-turbo-test"))
+}
+
+func BenchmarkGetTokenEncoder(b *testing.B) {
+	requireTokenizer(b)
+	b.Run("memoized", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			CountTokenText("Hello, world!", "gemini-1.5-pro")
+		}
+	})
+	b.Run("per call", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tokenEncoder, _ := tiktoken.EncodingForModel("gpt-3.5-turbo")
+			getTokenNum(tokenEncoder, "Hello, world!")
+		}
+	})
+}
+
+func TestCountTokenTextWithoutEncoder(t *testing.T) {
+	// an encoding that failed to load leaves the encoder nil
+	assert.Equal(t, 3, getTokenNum(nil, "Hello, world!"))
+	assert.Equal(t, 1, getTokenNum(nil, "Hi"))
+	assert.Zero(t, getTokenNum(nil, ""))
+}
+
+func TestCountTokenTextMultilingual(t *testing.T) {
+	const cjk, emoji = "今天天气很好，我们去公园散步吧。", "🎉👍🚀"
+	// every CJK character and emoji counts, not a quarter of its UTF-8 bytes
+	assert.Equal(t, 16, getTokenNum(nil, cjk))
+	assert.Equal(t, 3, getTokenNum(nil, emoji))
+	assert.Equal(t, 22, getTokenNum(nil, "Hello, world! "+cjk+" "+emoji))
+	assert.Equal(t, 1, getTokenNum(nil, "é"))
+
+	requireTokenizer(t)
+	for _, text := range []string{cjk, emoji, "こんにちは世界", "안녕하세요 세계"} {
+		tokenNum := CountTokenText(text, "gemini-1.5-pro")
+		runeNum := utf8.RuneCountInString(text)
+		assert.GreaterOrEqual(t, tokenNum, runeNum/3, text)
+		assert.LessOrEqual(t, tokenNum, len(text), text)
+	}
+}
@@ -25,10 +25,10 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 		Prompt: Prompt{
 			Messages: make([]ChatMessage, 0, len(textRequest.Messages)),
 		},
-		Temperature:    textRequest.Temperature,
+		Temperature:    textRequest.GetTemperature(),
 		CandidateCount: textRequest.N,
-		TopP:           textRequest.TopP,
-		TopK:           textRequest.MaxTokens,
+		TopP:           textRequest.GetTopP(),
+		TopK:           textRequest.GetTopK(),
 	}
 	for _, message := range textRequest.Messages {
 		palmMessage := ChatMessage{
@@ -35,12 +35,13 @@ func ConvertRequest(request model.GeneralOpenAIRequest) *ChatRequest {
 			Role:    message.Role,
 		})
 	}
+	topP, temperature := request.GetTopP(), request.GetTemperature()
 	return &ChatRequest{
 		Model:       &request.Model,
 		Stream:      &request.Stream,
 		Messages:    messages,
-		TopP:        &request.TopP,
-		Temperature: &request.Temperature,
+		TopP:        &topP,
+		Temperature: &temperature,
 	}
 }
 
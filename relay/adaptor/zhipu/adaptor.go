@@ -66,12 +66,14 @@ func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.G
 		return baiduEmbeddingRequest, err
 	default:
 		// TopP (0.0, 1.0)
-		request.TopP = math.Min(0.99, request.TopP)
-		request.TopP = math.Max(0.01, request.TopP)
+		topP := math.Min(0.99, request.GetTopP())
+		topP = math.Max(0.01, topP)
+		request.TopP = &topP
 
 		// Temperature (0.0, 1.0)
-		request.Temperature = math.Min(0.99, request.Temperature)
-		request.Temperature = math.Max(0.01, request.Temperature)
+		temperature := math.Min(0.99, request.GetTemperature())
+		temperature = math.Max(0.01, temperature)
+		request.Temperature = &temperature
 		a.SetVersionByModeName(request.Model)
 		if a.APIVersion == "v4" {
 			return request, nil
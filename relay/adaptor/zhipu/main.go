@@ -85,8 +85,8 @@ func ConvertRequest(request model.GeneralOpenAIRequest) *Request {
 	}
 	return &Request{
 		Prompt:      messages,
-		Temperature: request.Temperature,
-		TopP:        request.TopP,
+		Temperature: request.GetTemperature(),
+		TopP:        request.GetTopP(),
 		Incremental: false,
 	}
 }
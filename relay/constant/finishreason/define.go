@@ -1,5 +1,8 @@
 package finishreason
 
 const (
-	Stop = "stop"
+	Stop          = "stop"
+	Length        = "length"
+	ContentFilter = "content_filter"
+	ToolCalls     = "tool_calls"
 )
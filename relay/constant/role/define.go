@@ -1,5 +1,9 @@
 package role
 
 const (
+	System    = "system"
+	User      = "user"
 	Assistant = "assistant"
+	Tool      = "tool"
+	Function  = "function"
 )
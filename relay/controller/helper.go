@@ -11,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common"
 	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/helper"
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/model"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
@@ -119,6 +120,12 @@ func postConsumeQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.M
 		logger.Error(ctx, "error update user quota cache: "+err.Error())
 	}
 	logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f，补全倍率 %.2f", modelRatio, groupRatio, completionRatio)
+	// only the gemini adaptor records the end user so far
+	if meta.ChannelType == channeltype.Gemini {
+		if user := helper.SanitizeEndUser(textRequest.User); user != "" {
+			logContent += fmt.Sprintf("，终端用户 %s", user)
+		}
+	}
 	model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, promptTokens, completionTokens, textRequest.Model, meta.TokenName, quota, logContent)
 	model.UpdateUserUsedQuotaAndRequestCount(meta.UserId, quota)
 	model.UpdateChannelUsedQuota(meta.ChannelId, quota)
@@ -149,6 +156,10 @@ func isErrorHappened(meta *meta.Meta, resp *http.Response) bool {
 		// skip stream check for deepl
 		return false
 	}
+	if meta.ChannelType == channeltype.Gemini {
+		// gemini streams without alt=sse are a JSON array, errors it embeds are parsed by the adaptor
+		return false
+	}
 	if meta.IsStream && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
 		return true
 	}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/songquanpeng/one-api/relay/channeltype"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsErrorHappenedGemini(t *testing.T) {
+	response := func(statusCode int, contentType string) *http.Response {
+		return &http.Response{StatusCode: statusCode, Header: http.Header{"Content-Type": []string{contentType}}}
+	}
+	geminiMeta := &meta.Meta{ChannelType: channeltype.Gemini}
+	assert.True(t, isErrorHappened(geminiMeta, response(http.StatusInternalServerError, "application/json")))
+	assert.True(t, isErrorHappened(geminiMeta, response(http.StatusBadGateway, "text/html")))
+	assert.True(t, isErrorHappened(geminiMeta, response(http.StatusTooManyRequests, "application/json")))
+	assert.False(t, isErrorHappened(geminiMeta, response(http.StatusOK, "application/json")))
+
+	// a stream without alt=sse is a JSON array, the adaptor reads the errors it embeds
+	geminiStreamMeta := &meta.Meta{ChannelType: channeltype.Gemini, IsStream: true}
+	assert.False(t, isErrorHappened(geminiStreamMeta, response(http.StatusOK, "application/json")))
+	assert.True(t, isErrorHappened(geminiStreamMeta, response(http.StatusInternalServerError, "application/json")))
+
+	// other channels keep the stream check
+	assert.True(t, isErrorHappened(&meta.Meta{ChannelType: channeltype.OpenAI, IsStream: true}, response(http.StatusOK, "application/json")))
+}
@@ -2,7 +2,9 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -71,6 +73,11 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	} else {
 		convertedRequest, err := adaptor.ConvertRequest(c, meta.Mode, textRequest)
 		if err != nil {
+			if errors.Is(err, model.ErrInvalidRequest) {
+				bizErr := openai.ErrorWrapper(err, "invalid_request", http.StatusBadRequest)
+				bizErr.Error.Type = "invalid_request_error"
+				return bizErr
+			}
 			return openai.ErrorWrapper(err, "convert_request_failed", http.StatusInternalServerError)
 		}
 		jsonData, err := json.Marshal(convertedRequest)
@@ -85,6 +92,18 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	resp, err := adaptor.DoRequest(c, meta, requestBody)
 	if err != nil {
 		logger.Errorf(ctx, "DoRequest failed: %s", err.Error())
+		if errors.Is(err, model.ErrRateLimited) {
+			billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+			return openai.ErrorWrapper(err, "rate_limit_exceeded", http.StatusTooManyRequests)
+		}
+		if errors.Is(err, model.ErrUpstreamUnavailable) {
+			billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+			return openai.ErrorWrapper(err, "upstream_unavailable", http.StatusServiceUnavailable)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+			return openai.ErrorWrapper(err, "upstream_timeout", http.StatusGatewayTimeout)
+		}
 		return openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
 	if isErrorHappened(meta, resp) {
@@ -96,6 +115,10 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	usage, respErr := adaptor.DoResponse(c, resp, meta)
 	if respErr != nil {
 		logger.Errorf(ctx, "respErr is not nil: %+v", respErr)
+		if respErr.Billed && usage != nil {
+			go postConsumeQuota(ctx, usage, meta, textRequest, ratio, preConsumedQuota, modelRatio, groupRatio)
+			return respErr
+		}
 		billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
 		return respErr
 	}
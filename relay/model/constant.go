@@ -1,6 +1,10 @@
 package model
 
 const (
-	ContentTypeText     = "text"
-	ContentTypeImageURL = "image_url"
+	ContentTypeText       = "text"
+	ContentTypeImageURL   = "image_url"
+	ContentTypeInputAudio = "input_audio"
+	ContentTypeVideoURL   = "video_url"
 )
+
+const AnnotationTypeURLCitation = "url_citation"
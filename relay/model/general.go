@@ -1,33 +1,83 @@
 package model
 
 type ResponseFormat struct {
-	Type string `json:"type,omitempty"`
+	Type       string      `json:"type,omitempty"`
+	JsonSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Description string         `json:"description,omitempty"`
+	Name        string         `json:"name"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
+
+// https://platform.openai.com/docs/guides/tools-web-search
+type WebSearchOptions struct {
+	SearchContextSize string `json:"search_context_size,omitempty"`
 }
 
 type GeneralOpenAIRequest struct {
-	Messages         []Message       `json:"messages,omitempty"`
-	Model            string          `json:"model,omitempty"`
-	FrequencyPenalty float64         `json:"frequency_penalty,omitempty"`
-	MaxTokens        int             `json:"max_tokens,omitempty"`
-	N                int             `json:"n,omitempty"`
-	PresencePenalty  float64         `json:"presence_penalty,omitempty"`
-	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
-	Seed             float64         `json:"seed,omitempty"`
-	Stream           bool            `json:"stream,omitempty"`
-	Temperature      float64         `json:"temperature,omitempty"`
-	TopP             float64         `json:"top_p,omitempty"`
-	TopK             int             `json:"top_k,omitempty"`
-	Tools            []Tool          `json:"tools,omitempty"`
-	ToolChoice       any             `json:"tool_choice,omitempty"`
-	FunctionCall     any             `json:"function_call,omitempty"`
-	Functions        any             `json:"functions,omitempty"`
-	User             string          `json:"user,omitempty"`
-	Prompt           any             `json:"prompt,omitempty"`
-	Input            any             `json:"input,omitempty"`
-	EncodingFormat   string          `json:"encoding_format,omitempty"`
-	Dimensions       int             `json:"dimensions,omitempty"`
-	Instruction      string          `json:"instruction,omitempty"`
-	Size             string          `json:"size,omitempty"`
+	Messages         []Message          `json:"messages,omitempty"`
+	Model            string             `json:"model,omitempty"`
+	FrequencyPenalty float64            `json:"frequency_penalty,omitempty"`
+	LogitBias        map[string]float64 `json:"logit_bias,omitempty"`
+	Logprobs         bool               `json:"logprobs,omitempty"`
+	TopLogprobs      int                `json:"top_logprobs,omitempty"`
+	MaxTokens        int                `json:"max_tokens,omitempty"`
+	Modalities       []string           `json:"modalities,omitempty"`
+	N                int                `json:"n,omitempty"`
+	PresencePenalty  float64            `json:"presence_penalty,omitempty"`
+	ResponseFormat   *ResponseFormat    `json:"response_format,omitempty"`
+	Seed             float64            `json:"seed,omitempty"`
+	Stop             any                `json:"stop,omitempty"`
+	Stream           bool               `json:"stream,omitempty"`
+	StreamOptions    *StreamOptions     `json:"stream_options,omitempty"`
+	Temperature      *float64           `json:"temperature,omitempty"`
+	TopP             *float64           `json:"top_p,omitempty"`
+	TopK             *int               `json:"top_k,omitempty"`
+	ThinkingBudget   *int               `json:"thinking_budget,omitempty"` // gemini, 0 disables thinking, -1 lets the model decide
+	Tools            []Tool             `json:"tools,omitempty"`
+	ToolChoice       any                `json:"tool_choice,omitempty"`
+	FunctionCall     any                `json:"function_call,omitempty"`
+	Functions        any                `json:"functions,omitempty"`
+	User             string             `json:"user,omitempty"`
+	WebSearchOptions *WebSearchOptions  `json:"web_search_options,omitempty"`
+	Prompt           any                `json:"prompt,omitempty"`
+	Input            any                `json:"input,omitempty"`
+	EncodingFormat   string             `json:"encoding_format,omitempty"`
+	Dimensions       int                `json:"dimensions,omitempty"`
+	Instruction      string             `json:"instruction,omitempty"`
+	Size             string             `json:"size,omitempty"`
+}
+
+// GetTemperature returns 0 when the client left temperature out, for upstreams that treat an
+// omitted and a zero temperature alike
+func (r GeneralOpenAIRequest) GetTemperature() float64 {
+	if r.Temperature == nil {
+		return 0
+	}
+	return *r.Temperature
+}
+
+// GetTopP returns 0 when the client left top_p out, like GetTemperature
+func (r GeneralOpenAIRequest) GetTopP() float64 {
+	if r.TopP == nil {
+		return 0
+	}
+	return *r.TopP
+}
+
+// GetTopK returns 0 when the client left top_k out, like GetTemperature
+func (r GeneralOpenAIRequest) GetTopK() int {
+	if r.TopK == nil {
+		return 0
+	}
+	return *r.TopK
 }
 
 func (r GeneralOpenAIRequest) ParseInput() []string {
@@ -1,11 +1,26 @@
 package model
 
 type Message struct {
-	Role       string  `json:"role,omitempty"`
-	Content    any     `json:"content,omitempty"`
-	Name       *string `json:"name,omitempty"`
-	ToolCalls  []Tool  `json:"tool_calls,omitempty"`
-	ToolCallId string  `json:"tool_call_id,omitempty"`
+	Role             string       `json:"role,omitempty"`
+	Content          any          `json:"content,omitempty"`
+	ReasoningContent string       `json:"reasoning_content,omitempty"`
+	Name             *string      `json:"name,omitempty"`
+	ToolCalls        []Tool       `json:"tool_calls,omitempty"`
+	ToolCallId       string       `json:"tool_call_id,omitempty"`
+	Annotations      []Annotation `json:"annotations,omitempty"`
+}
+
+// Annotation points a span of the answer at a web page the upstream searched
+type Annotation struct {
+	Type        string       `json:"type"`
+	URLCitation *URLCitation `json:"url_citation,omitempty"`
+}
+
+type URLCitation struct {
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+	Title      string `json:"title,omitempty"`
+	URL        string `json:"url"`
 }
 
 func (m Message) IsStringContent() bool {
@@ -71,6 +86,34 @@ func (m Message) ParseContent() []MessageContent {
 						},
 					})
 				}
+			case ContentTypeInputAudio:
+				if subObj, ok := contentMap["input_audio"].(map[string]any); ok {
+					data, _ := subObj["data"].(string)
+					format, _ := subObj["format"].(string)
+					contentList = append(contentList, MessageContent{
+						Type: ContentTypeInputAudio,
+						InputAudio: &InputAudio{
+							Data:   data,
+							Format: format,
+						},
+					})
+				}
+			case ContentTypeVideoURL:
+				if subObj, ok := contentMap["video_url"].(map[string]any); ok {
+					url, _ := subObj["url"].(string)
+					startOffset, _ := subObj["start_offset"].(float64)
+					endOffset, _ := subObj["end_offset"].(float64)
+					fps, _ := subObj["fps"].(float64)
+					contentList = append(contentList, MessageContent{
+						Type: ContentTypeVideoURL,
+						VideoURL: &VideoURL{
+							Url:         url,
+							StartOffset: startOffset,
+							EndOffset:   endOffset,
+							Fps:         fps,
+						},
+					})
+				}
 			}
 		}
 		return contentList
@@ -83,8 +126,24 @@ type ImageURL struct {
 	Detail string `json:"detail,omitempty"`
 }
 
+type InputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+// VideoURL is not part of the OpenAI API, it lets clients of models that understand video
+// (gemini for now) send a clip, optionally cut to the seconds between the offsets
+type VideoURL struct {
+	Url         string  `json:"url"`
+	StartOffset float64 `json:"start_offset,omitempty"` // unit is second
+	EndOffset   float64 `json:"end_offset,omitempty"`   // unit is second
+	Fps         float64 `json:"fps,omitempty"`
+}
+
 type MessageContent struct {
-	Type     string    `json:"type,omitempty"`
-	Text     string    `json:"text"`
-	ImageURL *ImageURL `json:"image_url,omitempty"`
+	Type       string      `json:"type,omitempty"`
+	Text       string      `json:"text"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+	VideoURL   *VideoURL   `json:"video_url,omitempty"`
 }
@@ -1,9 +1,29 @@
 package model
 
+import "errors"
+
+// ErrInvalidRequest is wrapped by adaptors when a request can not be converted because
+// of what the client sent, the relay then answers 400 instead of 500
+var ErrInvalidRequest = errors.New("invalid request")
+
+// ErrRateLimited is wrapped by adaptors that hold a request back to stay within the rate of
+// the channel, the relay then answers 429 and may try another channel
+var ErrRateLimited = errors.New("rate limited")
+
+// ErrUpstreamUnavailable is wrapped by adaptors that refuse to send a request to a channel known
+// to be failing, the relay then answers 503 and may try another channel
+var ErrUpstreamUnavailable = errors.New("upstream unavailable")
+
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// PromptTokensDetails breaks the prompt tokens down, CachedTokens of them were read from a cache
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
 type Error struct {
@@ -16,4 +36,7 @@ type Error struct {
 type ErrorWithStatusCode struct {
 	Error
 	StatusCode int `json:"status_code"`
+	// Billed is set when upstream charged for the request all the same (e.g. a prompt it refused),
+	// the relay then bills the usage returned along with the error instead of refunding the quota
+	Billed bool `json:"-"`
 }
@@ -1,6 +1,7 @@
 package model
 
 type Tool struct {
+	Index    *int     `json:"index,omitempty"` // only in stream deltas, tells apart the calls of one message
 	Id       string   `json:"id,omitempty"`
 	Type     string   `json:"type,omitempty"` // when splicing claude tools stream messages, it is empty
 	Function Function `json:"function"`
@@ -4,8 +4,10 @@ import (
 	"embed"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/middleware"
 	"net/http"
 	"os"
 	"strings"
@@ -15,6 +17,10 @@ func SetRouter(router *gin.Engine, buildFS embed.FS) {
 	SetApiRouter(router)
 	SetDashboardRouter(router)
 	SetRelayRouter(router)
+	if config.EnablePrometheusMetric {
+		// per-model and per-channel traffic is for admins only, scrape it with an admin access token
+		router.GET("/metrics", middleware.AdminAuth(), gin.WrapH(promhttp.Handler()))
+	}
 	frontendBaseUrl := os.Getenv("FRONTEND_BASE_URL")
 	if config.IsMasterNode && frontendBaseUrl != "" {
 		frontendBaseUrl = ""